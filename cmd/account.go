@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"bufio"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+	"golang.org/x/crypto/bcrypt"
+
+	publish "github.com/rancher/telemetry/publish"
+)
+
+var accountPassword string
+
+func AccountCommand() cli.Command {
+	return cli.Command{
+		Name:      "account",
+		Usage:     "add an admin account to the storage, or change its password",
+		ArgsUsage: "NAME",
+		Action:    accountRun,
+		Flags: append(storageFlags(),
+			cli.StringFlag{
+				Name:        "password",
+				Usage:       "password of the account, read from stdin if not set",
+				EnvVar:      "TELEMETRY_ACCOUNT_PASSWORD",
+				Destination: &accountPassword,
+			},
+		),
+	}
+}
+
+func accountRun(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return cli.NewExitError("An account name is required", 1)
+	}
+	name := c.Args().First()
+
+	password := accountPassword
+	if password == "" {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return cli.NewExitError("Error reading password: "+err.Error(), 1)
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+	if password == "" {
+		return cli.NewExitError("A password is required", 1)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	store, err := publish.NewStore(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	if pg, ok := store.(*publish.Postgres); ok {
+		if err := pg.CheckSchema(false); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+	}
+
+	if err = store.SetAccount(name, string(hash)); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	log.Infof("Saved account %s", name)
+	return nil
+}
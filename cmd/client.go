@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -10,6 +11,8 @@ import (
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 
@@ -21,18 +24,21 @@ import (
 )
 
 const (
-	RECORD_VERSION = 2
+	RECORD_VERSION = record.VERSION
 	EXISTING_FILE  = ".existing"
 )
 
 var (
-	publisher *publish.ToUrl
+	publisher *publish.Multi
 	url       string
 	accessKey string
 	secretKey string
 	tokenKey  string
 	caCert    string
 	target    string
+
+	collectorWorkers int
+	collectorTimeout time.Duration
 )
 
 func ClientCommand() cli.Command {
@@ -46,6 +52,11 @@ func ClientCommand() cli.Command {
 				Usage: "print stats to stdout once and exit",
 			},
 
+			cli.StringFlag{
+				Name:  "record-fixture",
+				Usage: "collect once, saving the stats and every Rancher API response to this directory for replay, and exit",
+			},
+
 			cli.StringFlag{
 				Name:   "listen, l",
 				Usage:  "address/port to listen on",
@@ -105,6 +116,92 @@ func ClientCommand() cli.Command {
 				Value:  "https://telemetry.rancher.io/publish",
 				EnvVar: "TELEMETRY_TO_URL",
 			},
+
+			cli.StringSliceFlag{
+				Name:   "publish",
+				Usage:  "additional place to send stats to: an http(s) url, stdout or file:///path with optional max-size (MB), max-age, keep and retain parameters, e.g. file:///var/lib/telemetry/records.jsonl?max-age=24h&retain=720h",
+				EnvVar: "TELEMETRY_PUBLISH",
+			},
+
+			cli.StringFlag{
+				Name:   "key-file",
+				Usage:  "file holding the key stats are signed with, created if missing; keep it on persistent storage, as a server rejects records signed with a new key until an admin resets the install's key",
+				Value:  "",
+				EnvVar: "TELEMETRY_KEY_FILE",
+			},
+
+			cli.BoolFlag{
+				Name:   "gzip",
+				Usage:  "gzip compress stats sent to the server",
+				EnvVar: "TELEMETRY_GZIP",
+			},
+
+			cli.IntFlag{
+				Name:   "batch-size",
+				Usage:  "maximum number of spooled stats to send in one request",
+				Value:  1,
+				EnvVar: "TELEMETRY_BATCH_SIZE",
+			},
+
+			cli.StringFlag{
+				Name:   "outbox-dir",
+				Usage:  "directory to spool unsent stats to, empty to disable",
+				Value:  ".outbox",
+				EnvVar: "TELEMETRY_OUTBOX_DIR",
+			},
+
+			cli.IntFlag{
+				Name:   "outbox-max-size",
+				Usage:  "maximum size of the outbox in MB",
+				Value:  50,
+				EnvVar: "TELEMETRY_OUTBOX_MAX_SIZE",
+			},
+
+			cli.DurationFlag{
+				Name:   "outbox-max-age",
+				Usage:  "maximum age of spooled stats",
+				Value:  30 * 24 * time.Hour,
+				EnvVar: "TELEMETRY_OUTBOX_MAX_AGE",
+			},
+
+			cli.DurationFlag{
+				Name:   "retry-min",
+				Usage:  "initial delay before retrying unsent stats, at least 1s",
+				Value:  time.Minute,
+				EnvVar: "TELEMETRY_RETRY_MIN",
+			},
+
+			cli.DurationFlag{
+				Name:   "retry-max",
+				Usage:  "maximum delay between retries of unsent stats",
+				Value:  time.Hour,
+				EnvVar: "TELEMETRY_RETRY_MAX",
+			},
+
+			cli.BoolFlag{
+				Name:   "exporter",
+				Usage:  "expose the collected stats as Prometheus metrics on /metrics",
+				EnvVar: "TELEMETRY_EXPORTER",
+			},
+
+			scrubFlag("default"),
+			scrubSaltFlag(),
+
+			cli.IntFlag{
+				Name:        "collector-workers",
+				Usage:       "number of collectors to run concurrently",
+				Value:       collector.DefaultWorkers,
+				EnvVar:      "TELEMETRY_COLLECTOR_WORKERS",
+				Destination: &collectorWorkers,
+			},
+
+			cli.DurationFlag{
+				Name:        "collector-timeout",
+				Usage:       "maximum time a single collector may run",
+				Value:       collector.DefaultTimeout,
+				EnvVar:      "TELEMETRY_COLLECTOR_TIMEOUT",
+				Destination: &collectorTimeout,
+			},
 		},
 	}
 }
@@ -136,14 +233,32 @@ func clientRun(c *cli.Context) error {
 		caCert = string(crt)
 	}
 
+	if err := loadScrubRules(); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	if dir := c.String("record-fixture"); dir != "" {
+		return clientRecordFixture(dir)
+	}
+
 	if c.Bool("once") {
 		return clientShowOnce()
 	}
 
-	publisher = publish.NewToUrl(c)
+	targets := append([]string{c.String("to-url")}, c.StringSlice("publish")...)
+	var err error
+	publisher, err = publish.NewMulti(c, targets)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	registerClientMetrics()
+	if c.Bool("exporter") {
+		prometheus.MustRegister(exporter)
+	}
 
 	router := mux.NewRouter()
 	router.HandleFunc("/favicon.ico", http.NotFound)
+	router.Handle("/metrics", promhttp.Handler()).Methods("GET")
 	router.HandleFunc("/v1-telemetry", clientShow).Methods("GET")
 	router.HandleFunc("/v1-telemetry/reload", clientReload).Methods("POST")
 	router.HandleFunc("/v1-telemetry/report", clientReport).Methods("POST")
@@ -171,6 +286,8 @@ func clientRun(c *cli.Context) error {
 	// Report immediately on only the first run
 	if !isExisting() {
 		go report()
+	} else if c.Bool("exporter") {
+		go refresh()
 	}
 
 	listen := c.String("listen")
@@ -181,11 +298,15 @@ func clientRun(c *cli.Context) error {
 
 // CLI Handlers
 func clientShowOnce() error {
-	r, err := collect()
+	r, err := collect(context.Background())
 	if err != nil {
 		return cli.NewExitError(err.Error(), 1)
 	}
 
+	if err = scrubRules.Scrub(r); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
 	str, err := json.MarshalIndent(r, "", "  ")
 	if err != nil {
 		return cli.NewExitError(err.Error(), 1)
@@ -198,7 +319,7 @@ func clientShowOnce() error {
 
 // HTTP Handlers
 func clientShow(w http.ResponseWriter, req *http.Request) {
-	r, err := collect()
+	r, err := collect(req.Context())
 	if err == nil {
 		respondSuccess(w, req, r)
 	} else {
@@ -219,15 +340,23 @@ func report() {
 	start := time.Now()
 	log.Debug("Starting report")
 
-	r, err := collect()
+	r, err := collect(context.Background())
 	if err != nil {
 		log.Errorf("Error collecting data: %s", err)
 		return
 	}
 	diff := time.Now().Sub(start).String()
 	log.Debugf("Collected stats in %s", diff)
+	exporter.Update(r)
+
+	err = scrubRules.Scrub(r)
+	if err != nil {
+		log.Errorf("Error scrubbing report: %s", err)
+		return
+	}
 
 	err = publisher.Report(r, "")
+	observeReport(err)
 	if err != nil {
 		log.Errorf("Error publishing report: %s", err)
 		return
@@ -237,7 +366,17 @@ func report() {
 	log.Debugf("Completed report in %s", diff)
 }
 
-func collect() (record.Record, error) {
+// refresh collects without reporting, so the exporter has data before the first report
+func refresh() {
+	r, err := collect(context.Background())
+	if err != nil {
+		log.Errorf("Error collecting data: %s", err)
+		return
+	}
+	exporter.Update(r)
+}
+
+func collect(ctx context.Context) (record.Record, error) {
 	log.Infof("Collecting anonymous data from %s", url)
 	client, err := rancher.NewClient(&clientbase.ClientOpts{
 		URL:      url,
@@ -254,10 +393,14 @@ func collect() (record.Record, error) {
 	r["ts"] = time.Now().UTC().Format(time.RFC3339)
 
 	opt := collector.CollectorOpts{
-		Client: client,
+		Client:  client,
+		Ctx:     ctx,
+		Workers: collectorWorkers,
+		Timeout: collectorTimeout,
 	}
 
 	collector.Run(&r, &opt)
+	observeCollectors(r)
 
 	return r, nil
 }
@@ -0,0 +1,112 @@
+package cmd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/urfave/cli"
+
+	publish "github.com/rancher/telemetry/publish"
+)
+
+// clientContext parses args with the flags of the client command
+func clientContext(t *testing.T, args ...string) *cli.Context {
+	set := flag.NewFlagSet("client", flag.ContinueOnError)
+	for _, f := range ClientCommand().Flags {
+		f.Apply(set)
+	}
+	if err := set.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return cli.NewContext(cli.NewApp(), set, nil)
+}
+
+// TestPublishBatch spools records while the server is down and sends them in one gzipped request
+// once it is back
+func TestPublishBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := newTestServer(nil)
+	defer s.Close()
+
+	type request struct {
+		encoding string
+		first    byte
+	}
+	var mu sync.Mutex
+	down := true
+	requests := []request{}
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if down {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		// Note what was sent, leaving the body for the server to read
+		raw, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(raw))
+
+		r := request{encoding: req.Header.Get("Content-Encoding")}
+		if gz, err := gzip.NewReader(bytes.NewReader(raw)); err == nil {
+			b, _ := ioutil.ReadAll(gz)
+			if len(b) > 0 {
+				r.first = b[0]
+			}
+		}
+		requests = append(requests, r)
+		s.Config.Handler.ServeHTTP(w, req)
+	}))
+	defer proxy.Close()
+
+	c := clientContext(t, "--gzip", "--batch-size=3", "--outbox-dir="+dir, "--retry-min=1h", "--retry-max=1h")
+	p := publish.NewToUrl(c, proxy.URL+"/publish")
+
+	for _, uid := range []string{"a", "b", "c"} {
+		if err := p.Report(serverRecord(uid, "v2.5.1", 1), ""); err == nil {
+			t.Fatalf("Report %s to a server that is down: got no error", uid)
+		}
+	}
+	if p.Depth() != 3 {
+		t.Fatalf("Spooled: got %d, want 3", p.Depth())
+	}
+
+	mu.Lock()
+	down = false
+	mu.Unlock()
+	if err := p.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if p.Depth() != 0 {
+		t.Errorf("Left in the outbox: got %d, want 0", p.Depth())
+	}
+
+	mu.Lock()
+	if len(requests) != 1 || requests[0].encoding != "gzip" || requests[0].first != '[' {
+		t.Errorf("Requests: got %+v, want one gzipped array", requests)
+	}
+	mu.Unlock()
+
+	fields := publish.AggregatedFields{}
+	if err := s.Admin("/admin/active/value/install.version", &fields); err != nil {
+		t.Fatal(err)
+	}
+	if fields["v2.5.1"] != 3 {
+		t.Errorf("Active installs: got %v, want 3 on v2.5.1", fields)
+	}
+}
@@ -20,6 +20,11 @@ func respondError(w http.ResponseWriter, req *http.Request, msg string, statusCo
 }
 
 func respondSuccess(w http.ResponseWriter, req *http.Request, val interface{}) {
+	if format := req.URL.Query().Get("format"); format != "" && format != "json" {
+		respondExport(w, req, format, val)
+		return
+	}
+
 	bytes, err := json.MarshalIndent(val, "", "  ")
 	if err == nil {
 		w.Write(bytes)
@@ -0,0 +1,275 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+
+	export "github.com/rancher/telemetry/export"
+	publish "github.com/rancher/telemetry/publish"
+)
+
+var (
+	exportFormat  string
+	exportDays    int
+	exportFilters cli.StringSlice
+	exportQuery   string
+	exportOutput  string
+)
+
+func ExportCommand() cli.Command {
+	return cli.Command{
+		Name:  "export",
+		Usage: "write flattened records, or the result of an aggregation query, as CSV, NDJSON or Parquet",
+		Description: "CSV and Parquet list every column before the first row, so records are read twice. Columns\n" +
+			"   found only in records stored between the two reads are left out, and named in a warning.",
+		Action: exportRun,
+		Flags: append(storageFlags(),
+			cli.StringFlag{
+				Name:        "format",
+				Usage:       "csv, ndjson or parquet",
+				Value:       export.FormatCSV,
+				Destination: &exportFormat,
+			},
+			cli.IntFlag{
+				Name:        "days",
+				Usage:       "days of records to export",
+				Value:       DEF_DAYS,
+				Destination: &exportDays,
+			},
+			cli.StringSliceFlag{
+				Name:  "filter",
+				Usage: "only export records matching a filter like install.version=v2.5.*, may be repeated",
+				Value: &exportFilters,
+			},
+			cli.StringFlag{
+				Name:        "query",
+				Usage:       "JSON file with an aggregation query, as posted to /admin/query, to export the result of instead of records",
+				Destination: &exportQuery,
+			},
+			cli.StringFlag{
+				Name:        "output, o",
+				Usage:       "file to write, defaults to stdout",
+				Destination: &exportOutput,
+			},
+		),
+	}
+}
+
+func exportRun(c *cli.Context) error {
+	if export.ContentType(exportFormat) == "" {
+		return cli.NewExitError(fmt.Sprintf("Unknown format %s, known: csv, ndjson, parquet", exportFormat), 1)
+	}
+
+	filters := []publish.Filter{}
+	for _, str := range exportFilters {
+		filter, err := publish.ParseFilter(str)
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		filters = append(filters, filter)
+	}
+
+	var q *publish.Query
+	if exportQuery != "" {
+		b, err := ioutil.ReadFile(exportQuery)
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		q = &publish.Query{}
+		if err = json.Unmarshal(b, q); err != nil {
+			return cli.NewExitError(fmt.Sprintf("%s: %s", exportQuery, err), 1)
+		}
+		if err = q.Validate(); err != nil {
+			return cli.NewExitError(fmt.Sprintf("%s: %s", exportQuery, err), 1)
+		}
+	}
+
+	store, err := publish.NewStore(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	if pg, ok := store.(*publish.Postgres); ok {
+		if err := pg.CheckSchema(false); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+	}
+
+	var out io.Writer = os.Stdout
+	if exportOutput != "" {
+		f, err := os.Create(exportOutput)
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	if q != nil {
+		result, err := store.Query(q)
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		rows, columns, err := export.Table(result, "")
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		err = exportTable(out, exportFormat, rows, columns)
+	} else {
+		err = exportRecords(out, store, exportFormat, exportDays, filters)
+	}
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	if f, ok := out.(*os.File); ok && f != os.Stdout {
+		if err = f.Close(); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+	}
+	return nil
+}
+
+// exportRecords writes the last record of each install on each day, flattened, after day and uid
+// columns. CSV and Parquet need every column first, so the records are read twice; columns that
+// only show up in between are left out, with a warning naming them.
+func exportRecords(w io.Writer, store publish.Store, format string, days int, filters []publish.Filter) error {
+	columns := export.NewColumns("day", "uid")
+	if export.NeedsColumns(format) {
+		err := store.EachRecordByDay(days, filters, func(day string, rec publish.ApiRecord) error {
+			columns.Add(recordRow(day, rec))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	list := columns.List()
+	writer, err := export.NewWriter(format, w, list)
+	if err != nil {
+		return err
+	}
+
+	known := map[string]bool{}
+	for _, c := range list {
+		known[c.Name] = true
+	}
+	left := map[string]bool{}
+
+	err = store.EachRecordByDay(days, filters, func(day string, rec publish.ApiRecord) error {
+		row := recordRow(day, rec)
+		if export.NeedsColumns(format) {
+			for name := range row {
+				if !known[name] {
+					left[name] = true
+				}
+			}
+		}
+		return writer.Write(row)
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(left) > 0 {
+		names := make([]string, 0, len(left))
+		for name := range left {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		log.Warnf("Left out %d columns of records stored while exporting: %s", len(names), strings.Join(names, ", "))
+	}
+
+	return writer.Close()
+}
+
+func recordRow(day string, rec publish.ApiRecord) map[string]interface{} {
+	row := export.Flatten(rec.Record)
+	row["day"] = day
+	row["uid"] = rec.Uid
+	return row
+}
+
+func exportTable(w io.Writer, format string, rows []map[string]interface{}, columns []export.Column) error {
+	writer, err := export.NewWriter(format, w, columns)
+	if err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		if err = writer.Write(row); err != nil {
+			return err
+		}
+	}
+
+	return writer.Close()
+}
+
+// respondExport writes an admin API result as a table, for ?format=csv, ndjson or parquet
+func respondExport(w http.ResponseWriter, req *http.Request, format string, val interface{}) {
+	if export.ContentType(format) == "" {
+		respondError(w, req, fmt.Sprintf("Unknown format %s, known: json, csv, ndjson, parquet", format), 422)
+		return
+	}
+
+	rows, columns, err := export.Table(val, req.URL.Query().Get("table"))
+	if err != nil {
+		respondError(w, req, err.Error(), 422)
+		return
+	}
+
+	w.Header().Set("Content-Type", export.ContentType(format))
+	if err = exportTable(w, format, rows, columns); err != nil {
+		log.Errorf("Failed to export result err=%s", err)
+	}
+}
+
+func apiExportRecords(w http.ResponseWriter, req *http.Request) {
+	opt, err := getOptions(req, RequiredOptions{})
+	if err != nil {
+		respondError(w, req, err.Error(), 422)
+		return
+	}
+
+	format := req.URL.Query().Get("format")
+	if format == "" {
+		format = export.FormatCSV
+	}
+	if export.ContentType(format) == "" {
+		respondError(w, req, fmt.Sprintf("Unknown format %s, known: csv, ndjson, parquet", format), 422)
+		return
+	}
+
+	w.Header().Set("Content-Type", export.ContentType(format))
+	w.Header().Set("Content-Disposition", "attachment; filename=records."+format)
+
+	out := &writeCounter{w: w}
+	err = exportRecords(out, dbPublisher, format, opt.Days, opt.Filters)
+	if err != nil && out.n == 0 {
+		w.Header().Del("Content-Disposition")
+		respondError(w, req, err.Error(), 500)
+	} else if err != nil {
+		log.Errorf("Failed to export records err=%s", err)
+	}
+}
+
+// writeCounter tells whether a response has started, after which errors can only be logged
+type writeCounter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *writeCounter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,204 @@
+package cmd
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	collector "github.com/rancher/telemetry/collector"
+	record "github.com/rancher/telemetry/record"
+)
+
+// recordExporter publishes the last collected record as gauges. Numbers become a gauge each,
+// maps (like LabelCount) add a label per key, named by the field's `label` tag, and strings
+// become a gauge of 1 labelled with the value.
+type recordExporter struct {
+	sync.Mutex
+	record record.Record
+}
+
+var exporter = &recordExporter{}
+
+// Top level sections that are maps rather than collector structs
+var exporterSectionLabels = map[string][]string{
+	collector.MetaRecordKey: {"collector"},
+}
+
+func (e *recordExporter) Update(r record.Record) {
+	e.Lock()
+	defer e.Unlock()
+	e.record = r
+}
+
+// Describe sends nothing, making this an unchecked collector as the metrics depend on the record
+func (e *recordExporter) Describe(ch chan<- *prometheus.Desc) {
+}
+
+func (e *recordExporter) Collect(ch chan<- prometheus.Metric) {
+	e.Lock()
+	r := e.record
+	e.Unlock()
+
+	keys := make([]string, 0, len(r))
+	for k := range r {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	w := &recordWalker{
+		ch:   ch,
+		seen: map[string]bool{},
+	}
+
+	for _, key := range keys {
+		if key == "r" || key == "ts" {
+			continue
+		}
+
+		name := metricsNamespace + "_" + metricName(strings.TrimLeft(key, "_"))
+		w.walk(reflect.ValueOf(r[key]), name, key, nil, nil, exporterSectionLabels[key])
+	}
+}
+
+type recordWalker struct {
+	ch   chan<- prometheus.Metric
+	seen map[string]bool
+}
+
+func (w *recordWalker) walk(v reflect.Value, name, path string, labels, values []string, mapLabels []string) {
+	if !v.IsValid() {
+		return
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return
+		}
+		w.walk(v.Elem(), name, path, labels, values, mapLabels)
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+
+			jsonName := strings.Split(field.Tag.Get("json"), ",")[0]
+			if jsonName == "-" {
+				continue
+			}
+			if jsonName == "" {
+				jsonName = field.Name
+			}
+
+			var fieldLabels []string
+			if tag := field.Tag.Get("label"); tag != "" {
+				fieldLabels = strings.Split(tag, ",")
+			}
+
+			w.walk(v.Field(i), name+"_"+metricName(jsonName), path+"."+jsonName, labels, values, fieldLabels)
+		}
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return
+		}
+
+		label := "name"
+		var rest []string
+		if len(mapLabels) > 0 {
+			label = mapLabels[0]
+			rest = mapLabels[1:]
+		}
+
+		// Maps of plain numbers are counts of the label, e.g. node_kubelet_version{version="v1.18.3"}
+		if isNumeric(v.Type().Elem()) {
+			name = name + "_" + metricName(label)
+		}
+
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i].String() < keys[j].String()
+		})
+
+		for _, k := range keys {
+			w.walk(v.MapIndex(k), name, path, append(labels[:len(labels):len(labels)], label), append(values[:len(values):len(values)], k.String()), rest)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		w.emit(name, path, labels, values, float64(v.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		w.emit(name, path, labels, values, float64(v.Uint()))
+	case reflect.Float32, reflect.Float64:
+		w.emit(name, path, labels, values, v.Float())
+	case reflect.Bool:
+		if v.Bool() {
+			w.emit(name, path, labels, values, 1)
+		} else {
+			w.emit(name, path, labels, values, 0)
+		}
+	case reflect.String:
+		if v.String() == "" {
+			return
+		}
+
+		label := "value"
+		if len(mapLabels) > 0 {
+			label = mapLabels[0]
+		}
+		w.emit(name, path, append(labels[:len(labels):len(labels)], label), append(values[:len(values):len(values)], v.String()), 1)
+	}
+}
+
+func (w *recordWalker) emit(name, path string, labels, values []string, value float64) {
+	key := name + "{" + strings.Join(values, ",") + "}"
+	if w.seen[key] {
+		return
+	}
+	w.seen[key] = true
+
+	desc := prometheus.NewDesc(name, "Record field "+path, labels, nil)
+	metric, err := prometheus.NewConstMetric(desc, prometheus.GaugeValue, value, values...)
+	if err != nil {
+		w.ch <- prometheus.NewInvalidMetric(desc, err)
+		return
+	}
+	w.ch <- metric
+}
+
+func isNumeric(t reflect.Type) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+
+	return false
+}
+
+// metricName turns a JSON field name like cloudProvider into cloud_provider
+func metricName(in string) string {
+	var b strings.Builder
+	for i, r := range in {
+		switch {
+		case unicode.IsUpper(r):
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			b.WriteRune(unicode.ToLower(r))
+		case r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
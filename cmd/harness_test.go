@@ -0,0 +1,110 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	collector "github.com/rancher/telemetry/collector"
+	publish "github.com/rancher/telemetry/publish"
+	record "github.com/rancher/telemetry/record"
+)
+
+const (
+	testAdminKey    = "admin"
+	testAdminSecret = "secret"
+)
+
+// testServer runs the full server router against a store, so tests can publish records and query
+// them back over HTTP. The server keeps its state in package variables, so run one at a time.
+type testServer struct {
+	*httptest.Server
+	Store publish.Store
+}
+
+// newTestServer starts a server on a local port, with a fresh in-memory store if store is nil.
+// The admin API accepts testAdminKey and testAdminSecret.
+func newTestServer(store publish.Store) *testServer {
+	if store == nil {
+		store = publish.NewMemory()
+	}
+
+	version = "test"
+	recordSchema = collector.RecordSchema()
+	dbPublisher = store
+	requireSignature = false
+	if signatureWindow == 0 {
+		signatureWindow = 15 * time.Minute
+	}
+	setAdmin(testAdminKey, testAdminSecret)
+
+	return &testServer{
+		Server: httptest.NewServer(serverRouter()),
+		Store:  store,
+	}
+}
+
+// Publish posts a record as a client would, returning the response status
+func (s *testServer) Publish(r record.Record) (int, error) {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := http.Post(s.URL+"/publish", "application/json", bytes.NewReader(b))
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	return res.StatusCode, nil
+}
+
+// Admin GETs an admin API path like /admin/active/fields/cluster.total and decodes the response
+func (s *testServer) Admin(path string, out interface{}) error {
+	return s.admin("GET", path, nil, out)
+}
+
+// Query runs an aggregation query through the admin API
+func (s *testServer) Query(q publish.Query) (*publish.QueryResult, error) {
+	b, err := json.Marshal(q)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &publish.QueryResult{}
+	return out, s.admin("POST", "/admin/query", bytes.NewReader(b), out)
+}
+
+func (s *testServer) admin(method string, path string, body io.Reader, out interface{}) error {
+	req, err := http.NewRequest(method, s.URL+path, body)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(testAdminKey, testAdminSecret)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("%s %s: %d %s", method, path, res.StatusCode, b)
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(b, out)
+}
@@ -0,0 +1,162 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+
+	collector "github.com/rancher/telemetry/collector"
+	publish "github.com/rancher/telemetry/publish"
+	record "github.com/rancher/telemetry/record"
+)
+
+var importDryRun bool
+
+func ImportCommand() cli.Command {
+	return cli.Command{
+		Name:      "import",
+		Usage:     "load records from files written by a client into the database",
+		ArgsUsage: "FILE... (- for stdin)",
+		Action:    importRun,
+		Flags: append(storageFlags(),
+			scrubFlag("default"),
+			scrubSecretFlag(),
+			cli.BoolFlag{
+				Name:        "dry-run",
+				Usage:       "validate the records without storing them",
+				Destination: &importDryRun,
+			},
+		),
+	}
+}
+
+func importRun(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return cli.NewExitError("At least one file is required", 1)
+	}
+
+	recordSchema = collector.RecordSchema()
+	if err := loadScrubRules(); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	if !importDryRun {
+		var err error
+		dbPublisher, err = publish.NewStore(c)
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		if pg, ok := dbPublisher.(*publish.Postgres); ok {
+			if err := pg.CheckSchema(false); err != nil {
+				return cli.NewExitError(err.Error(), 1)
+			}
+		}
+	}
+
+	var imported, failed int
+	for _, path := range c.Args() {
+		ok, bad, err := importFile(path)
+		imported += ok
+		failed += bad
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("Error reading %s: %s", path, err), 1)
+		}
+		log.Infof("Imported %d records from %s, %d failed", ok, path, bad)
+	}
+
+	log.Infof("Imported %d records, %d failed", imported, failed)
+	if failed > 0 {
+		return cli.NewExitError(fmt.Sprintf("%d records failed to import", failed), 1)
+	}
+
+	return nil
+}
+
+// importFile stores every record in a file of JSON lines, or of any sequence of JSON records and
+// arrays of records, through the same validation as a publish request. Gzipped files are
+// decompressed. Records keep the time they were collected at rather than the time of import.
+func importFile(path string) (int, int, error) {
+	var in io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return 0, 0, err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	buf := bufio.NewReader(in)
+	in = buf
+	if magic, _ := buf.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(buf)
+		if err != nil {
+			return 0, 0, err
+		}
+		defer gz.Close()
+		in = gz
+	}
+
+	var imported, failed int
+
+	decoder := json.NewDecoder(in)
+	for n := 1; ; n++ {
+		var raw json.RawMessage
+		err := decoder.Decode(&raw)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return imported, failed, err
+		}
+
+		records, err := decodeRecords(bytes.NewReader(raw))
+		if err != nil {
+			log.Errorf("%s entry %d: %s", path, n, err)
+			failed++
+			continue
+		}
+
+		for _, r := range records {
+			err = importRecord(r)
+
+			if err != nil {
+				log.Errorf("%s entry %d: %s", path, n, err)
+				failed++
+				continue
+			}
+			imported++
+		}
+	}
+
+	return imported, failed, nil
+}
+
+func importRecord(r record.Record) error {
+	err := validateRecord(r)
+	if err != nil {
+		return err
+	}
+
+	ts, err := r.Time()
+	if err != nil {
+		return err
+	}
+
+	if err = scrubRules.Scrub(r); err != nil {
+		return err
+	}
+
+	if importDryRun {
+		return nil
+	}
+
+	return dbPublisher.ReportAt(r, "", ts)
+}
@@ -0,0 +1,118 @@
+package cmd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	collector "github.com/rancher/telemetry/collector"
+	publish "github.com/rancher/telemetry/publish"
+)
+
+// importRecords writes content to a file and imports it into a fresh in-memory store
+func importRecords(t *testing.T, content []byte) (publish.Store, int, int, error) {
+	dir, err := ioutil.TempDir("", "import")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "records")
+	if err = ioutil.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store := publish.NewMemory()
+	recordSchema = collector.RecordSchema()
+	dbPublisher = store
+	importDryRun = false
+
+	imported, failed, err := importFile(path)
+	return store, imported, failed, err
+}
+
+func importLine(uid string, version string) string {
+	r := serverRecord(uid, version, 1)
+	r["ts"] = time.Now().UTC().Format(time.RFC3339)
+	b, _ := json.Marshal(r)
+	return string(b)
+}
+
+func TestImportFormats(t *testing.T) {
+	a, b, c := importLine("a", "v2.4.8"), importLine("b", "v2.5.1"), importLine("c", "v2.5.1")
+
+	gzipped := func(s string) []byte {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write([]byte(s))
+		gz.Close()
+		return buf.Bytes()
+	}
+
+	tests := []struct {
+		name    string
+		content []byte
+	}{
+		{"JSON lines", []byte(a + "\n" + b + "\n" + c + "\n")},
+		{"array", []byte("[" + a + ",\n" + b + ",\n" + c + "]")},
+		{"lines and arrays", []byte(a + "\n[" + b + "," + c + "]\n")},
+		{"gzip", gzipped(a + "\n" + b + "\n" + c + "\n")},
+	}
+
+	for _, test := range tests {
+		store, imported, failed, err := importRecords(t, test.content)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if imported != 3 || failed != 0 {
+			t.Errorf("%s: got %d imported and %d failed, want 3 and 0", test.name, imported, failed)
+		}
+
+		for _, uid := range []string{"a", "b", "c"} {
+			records, err := store.GetRecordsByUid(uid, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != 1 {
+				t.Errorf("%s: got %d records of %s, want 1", test.name, len(records), uid)
+			}
+		}
+	}
+}
+
+func TestImportRejects(t *testing.T) {
+	noUid := serverRecord("", "v2.5.1", 1)
+	noUid["ts"] = time.Now().UTC().Format(time.RFC3339)
+	b, _ := json.Marshal(noUid)
+	noTs, _ := json.Marshal(serverRecord("b", "v2.5.1", 1))
+
+	lines := []string{
+		importLine("a", "v2.5.1"),
+		string(b),
+		string(noTs),
+		`"not a record"`,
+		// An array with anything but records in it fails as a whole
+		`[` + importLine("c", "v2.5.1") + `, 1]`,
+	}
+	store, imported, failed, err := importRecords(t, []byte(strings.Join(lines, "\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported != 1 || failed != 4 {
+		t.Errorf("Got %d imported and %d failed, want 1 and 4", imported, failed)
+	}
+	if records, _ := store.GetRecordsByUid("a", 1); len(records) != 1 {
+		t.Errorf("Valid record: got %d, want 1", len(records))
+	}
+
+	// A file that isn't JSON stops the import
+	if _, imported, _, err = importRecords(t, []byte(importLine("a", "v2.5.1")+"\n{\"r\":")); err == nil || imported != 1 {
+		t.Errorf("Truncated file: got %d imported and error %v", imported, err)
+	}
+}
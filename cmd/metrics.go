@@ -0,0 +1,153 @@
+package cmd
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	collector "github.com/rancher/telemetry/collector"
+	record "github.com/rancher/telemetry/record"
+)
+
+const metricsNamespace = "telemetry"
+
+// Client
+var (
+	collectorDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "client",
+		Name:      "collector_duration_seconds",
+		Help:      "Time taken by each collector",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 14),
+	}, []string{"collector"})
+
+	collectorFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "client",
+		Name:      "collector_failures_total",
+		Help:      "Collector runs that failed, by error class",
+	}, []string{"collector", "error"})
+
+	reportsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "client",
+		Name:      "reports_total",
+		Help:      "Reports sent to the telemetry server, by result",
+	}, []string{"result"})
+
+	lastReport = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "client",
+		Name:      "last_success_timestamp_seconds",
+		Help:      "Unix time of the last successful report",
+	})
+)
+
+// Server
+var (
+	publishRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "server",
+		Name:      "publish_requests_total",
+		Help:      "Publish requests, by HTTP status code",
+	}, []string{"code"})
+
+	dbReportDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "server",
+		Name:      "db_report_duration_seconds",
+		Help:      "Time taken to store a record in the database",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	unknownProperties = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "server",
+		Name:      "unknown_properties_total",
+		Help:      "Properties of accepted records that the record schema doesn't describe",
+	})
+
+	adminQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "server",
+		Name:      "admin_query_duration_seconds",
+		Help:      "Time taken to answer admin API requests, by route",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 14),
+	}, []string{"route"})
+)
+
+func registerClientMetrics() {
+	prometheus.MustRegister(collectorDuration, collectorFailures, reportsTotal, lastReport)
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "client",
+		Name:      "outbox_depth",
+		Help:      "Reports waiting in the outbox to be sent",
+	}, func() float64 {
+		if publisher == nil {
+			return 0
+		}
+		return float64(publisher.Depth())
+	}))
+}
+
+func registerServerMetrics() {
+	prometheus.MustRegister(publishRequests, dbReportDuration, unknownProperties, adminQueryDuration)
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "server",
+		Name:      "active_installs",
+		Help:      "Installs that reported within the default active window",
+	}, func() float64 {
+		count, err := dbPublisher.CountActiveInstalls(DEF_HOURS)
+		if err != nil {
+			log.Errorf("Error counting active installs: %s", err)
+			return 0
+		}
+		return float64(count)
+	}))
+}
+
+// observeCollectors records the collector timings and failures from a record's meta section
+func observeCollectors(r record.Record) {
+	metas, ok := r[collector.MetaRecordKey].(map[string]*collector.Meta)
+	if !ok {
+		return
+	}
+
+	for key, meta := range metas {
+		collectorDuration.WithLabelValues(key).Observe(float64(meta.DurationMs) / 1000)
+		if !meta.Success {
+			collectorFailures.WithLabelValues(key, meta.Error).Inc()
+		}
+	}
+}
+
+func observeReport(err error) {
+	if err != nil {
+		reportsTotal.WithLabelValues("failure").Inc()
+		return
+	}
+
+	reportsTotal.WithLabelValues("success").Inc()
+	lastReport.SetToCurrentTime()
+}
+
+// timeAdminQuery is a middleware that observes admin request latency by route template
+func timeAdminQuery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		next.ServeHTTP(w, req)
+
+		route := "unknown"
+		if cur := mux.CurrentRoute(req); cur != nil {
+			if tpl, err := cur.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+		}
+		adminQueryDuration.WithLabelValues(route).Observe(time.Since(start).Seconds())
+	})
+}
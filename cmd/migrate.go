@@ -0,0 +1,138 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/urfave/cli"
+
+	publish "github.com/rancher/telemetry/publish"
+)
+
+func MigrateCommand() cli.Command {
+	return cli.Command{
+		Name:  "migrate",
+		Usage: "manage the server database schema",
+		Subcommands: []cli.Command{
+			{
+				Name:      "up",
+				Usage:     "apply migrations, up to the latest by default",
+				ArgsUsage: "[VERSION]",
+				Action:    migrateUp,
+				Flags:     postgresFlags(),
+			},
+			{
+				Name:      "down",
+				Usage:     "revert migrations, the last one by default",
+				ArgsUsage: "[VERSION]",
+				Action:    migrateDown,
+				Flags:     postgresFlags(),
+			},
+			{
+				Name:   "status",
+				Usage:  "show the applied and pending migrations",
+				Action: migrateStatus,
+				Flags:  postgresFlags(),
+			},
+		},
+	}
+}
+
+func migrateConnect(c *cli.Context) (*publish.Postgres, error) {
+	db := publish.NewPostgres(c)
+	if db.Conn == nil {
+		return nil, cli.NewExitError("Postgres host, user and password are required", 1)
+	}
+	return db, nil
+}
+
+// migrateTarget reads the optional VERSION argument
+func migrateTarget(c *cli.Context, def int) (int, error) {
+	if c.NArg() == 0 {
+		return def, nil
+	}
+
+	target, err := strconv.Atoi(c.Args().First())
+	if err != nil {
+		return 0, cli.NewExitError(fmt.Sprintf("Invalid version %s", c.Args().First()), 1)
+	}
+	return target, nil
+}
+
+func migrateUp(c *cli.Context) error {
+	db, err := migrateConnect(c)
+	if err != nil {
+		return err
+	}
+
+	target, err := migrateTarget(c, publish.LatestSchemaVersion())
+	if err != nil {
+		return err
+	}
+
+	err = db.MigrateUp(target)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	return migrateStatus(c)
+}
+
+func migrateDown(c *cli.Context) error {
+	db, err := migrateConnect(c)
+	if err != nil {
+		return err
+	}
+
+	current, err := db.SchemaVersion()
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	target, err := migrateTarget(c, current-1)
+	if err != nil {
+		return err
+	}
+
+	err = db.MigrateDown(target)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	return migrateStatus(c)
+}
+
+func migrateStatus(c *cli.Context) error {
+	db, err := migrateConnect(c)
+	if err != nil {
+		return err
+	}
+
+	applied, err := db.AppliedMigrations()
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	known := map[int]bool{}
+	for _, m := range publish.Migrations {
+		known[m.Version] = true
+	}
+
+	done := map[int]bool{}
+	for _, m := range applied {
+		done[m.Version] = true
+		name := m.Name
+		if !known[m.Version] {
+			name += " (unknown to this version)"
+		}
+		fmt.Printf("%4d  %-27s  %s\n", m.Version, "applied "+m.Applied.Format("2006-01-02 15:04:05"), name)
+	}
+
+	for _, m := range publish.Migrations {
+		if !done[m.Version] {
+			fmt.Printf("%4d  %-27s  %s\n", m.Version, "pending", m.Name)
+		}
+	}
+
+	return nil
+}
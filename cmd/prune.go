@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+
+	publish "github.com/rancher/telemetry/publish"
+)
+
+var (
+	retentionMonths int
+	pruneDryRun     bool
+)
+
+func retentionFlag() cli.Flag {
+	return cli.IntFlag{
+		Name:        "retention-months",
+		Usage:       "months of raw records and days of installs to keep, 0 to keep everything; the daily rollups and each install's last record are kept",
+		EnvVar:      "TELEMETRY_RETENTION_MONTHS",
+		Destination: &retentionMonths,
+	}
+}
+
+func PruneCommand() cli.Command {
+	return cli.Command{
+		Name:   "prune",
+		Usage:  "drop raw records and days of installs older than the retention, keeping installs and the daily rollups",
+		Action: pruneRun,
+		Flags: append(postgresFlags(),
+			retentionFlag(),
+			cli.BoolFlag{
+				Name:        "dry-run",
+				Usage:       "show what would be dropped without dropping it",
+				Destination: &pruneDryRun,
+			},
+		),
+	}
+}
+
+func pruneRun(c *cli.Context) error {
+	if retentionMonths < 1 {
+		return cli.NewExitError("--retention-months is required", 1)
+	}
+
+	db := publish.NewPostgres(c)
+	if db.Conn == nil {
+		return cli.NewExitError("Postgres host, user and password are required", 1)
+	}
+	if err := db.CheckSchema(false); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	pruned, err := db.Prune(retentionMonths, pruneDryRun)
+	for _, p := range pruned {
+		if pruneDryRun {
+			log.Infof("Would prune %s, keeping %d of %d records", p.Name, p.Kept, p.Records)
+		}
+	}
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	log.Infof("Pruned %d partitions", len(pruned))
+	return nil
+}
+
+// maintain creates upcoming partitions and applies the retention once a day
+func maintain(db *publish.Postgres) {
+	for {
+		err := db.EnsurePartitions()
+		if err != nil {
+			log.Errorf("Failed to create partitions err=%s", err)
+		}
+
+		if retentionMonths > 0 {
+			_, err = db.Prune(retentionMonths, false)
+			if err != nil {
+				log.Errorf("Failed to prune records err=%s", err)
+			}
+		}
+
+		time.Sleep(24 * time.Hour)
+	}
+}
+
+// refreshRollups recomputes the rollups of the days reports couldn't update in place
+func refreshRollups(db *publish.Postgres) {
+	for {
+		n, err := db.RefreshRollups()
+		if err != nil {
+			log.Errorf("Failed to refresh rollups err=%s", err)
+		} else if n > 0 {
+			log.Debugf("Refreshed rollups of %d days", n)
+		}
+
+		time.Sleep(rollupInterval)
+	}
+}
@@ -0,0 +1,131 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+
+	fake "github.com/rancher/telemetry/collector/fake"
+	record "github.com/rancher/telemetry/record"
+)
+
+var (
+	replayRecord string
+	replayJson   bool
+)
+
+func ReplayCommand() cli.Command {
+	return cli.Command{
+		Name:      "replay",
+		Usage:     "re-run the collectors against responses saved by client --record-fixture and diff the record with the saved one",
+		ArgsUsage: "DIR",
+		Action:    replayRun,
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:        "record",
+				Usage:       "record to compare with, defaults to the one saved in DIR",
+				Destination: &replayRecord,
+			},
+			cli.BoolFlag{
+				Name:        "json",
+				Usage:       "print the differences as JSON",
+				Destination: &replayJson,
+			},
+		},
+	}
+}
+
+// clientRecordFixture collects once through a recording proxy, saving the responses and the record
+func clientRecordFixture(dir string) error {
+	recorder, err := fake.NewRecorder(url)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	defer recorder.Close()
+
+	apiURL := url
+	url = recorder.URL + recorder.Path
+	r, err := collect(context.Background())
+	url = apiURL
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	if err = recorder.Save(dir); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, fake.RecordFile), append(b, '\n'), 0644); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	log.Infof("Recorded fixture to %s", dir)
+	return nil
+}
+
+func replayRun(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return cli.NewExitError("A fixture directory is required", 1)
+	}
+	dir := c.Args().First()
+
+	path := replayRecord
+	if path == "" {
+		path = filepath.Join(dir, fake.RecordFile)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	saved := record.Record{}
+	if err = json.Unmarshal(b, &saved); err != nil {
+		return cli.NewExitError(fmt.Sprintf("%s: %s", path, err), 1)
+	}
+	fake.Normalize(saved)
+
+	replay, err := fake.NewReplay(dir)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	defer replay.Close()
+
+	r, err := fake.Collect(replay.URL + replay.Path)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	r["r"] = RECORD_VERSION
+
+	changes, err := record.Diff(saved, r)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	if replayJson {
+		b, err = json.MarshalIndent(changes, "", "  ")
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		fmt.Println(string(b))
+	} else {
+		for _, change := range changes {
+			fmt.Println(change.String())
+		}
+	}
+
+	if len(changes) > 0 {
+		return cli.NewExitError(fmt.Sprintf("%d fields differ from %s", len(changes), path), 1)
+	}
+
+	log.Infof("Replayed record matches %s", path)
+	return nil
+}
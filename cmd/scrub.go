@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/urfave/cli"
+
+	record "github.com/rancher/telemetry/record"
+)
+
+var (
+	scrubRulesSpec string
+	scrubSalt      string
+	scrubSaltFile  string
+	scrubRules     *record.ScrubRules
+)
+
+// scrubFlag selects the rules applied to records before they are sent or stored
+func scrubFlag(value string) cli.Flag {
+	return cli.StringFlag{
+		Name:        "scrub-rules",
+		Usage:       "rules removing values that could identify an install: a JSON file, default for the built in rules, or empty to keep records as they are",
+		Value:       value,
+		EnvVar:      "TELEMETRY_SCRUB_RULES",
+		Destination: &scrubRulesSpec,
+	}
+}
+
+// scrubSecretFlag sets the salt of hashed values on the server, which has to be the same on every
+// replica and across restarts for the hashes of one value to match
+func scrubSecretFlag() cli.Flag {
+	return cli.StringFlag{
+		Name:        "scrub-salt",
+		Usage:       "secret salt of values hashed by the scrub rules, the same on every replica; required when the rules hash values",
+		EnvVar:      "TELEMETRY_SCRUB_SALT",
+		Destination: &scrubSalt,
+	}
+}
+
+// scrubSaltFlag selects the file holding the salt a client hashes values with, which must stay
+// secret and the same from one run to the next for hashes to be comparable
+func scrubSaltFlag() cli.Flag {
+	return cli.StringFlag{
+		Name:        "scrub-salt-file",
+		Usage:       "file holding the secret salt of values hashed by the scrub rules, created if missing",
+		Value:       ".telemetry-salt",
+		EnvVar:      "TELEMETRY_SCRUB_SALT_FILE",
+		Destination: &scrubSaltFile,
+	}
+}
+
+func loadScrubRules() error {
+	if scrubRulesSpec == "" {
+		scrubRules = nil
+		return nil
+	}
+
+	salt := scrubSalt
+	if salt == "" {
+		var err error
+		if salt, err = loadScrubSalt(scrubSaltFile); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	scrubRules, err = record.LoadScrubRules(scrubRulesSpec, salt)
+	if err != nil && salt == "" {
+		return fmt.Errorf("%s, set one with --scrub-salt or TELEMETRY_SCRUB_SALT", err)
+	}
+	return err
+}
+
+// loadScrubSalt reads the salt in path, or creates it with a random one
+func loadScrubSalt(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err == nil {
+		return strings.TrimSpace(string(b)), nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	salt := make([]byte, 32)
+	if _, err = rand.Read(salt); err != nil {
+		return "", err
+	}
+	out := hex.EncodeToString(salt)
+	return out, ioutil.WriteFile(path, []byte(out+"\n"), 0600)
+}
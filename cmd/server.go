@@ -1,12 +1,18 @@
 package cmd
 
 import (
+	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
 	"math/rand"
 	"net"
 	"net/http"
+	neturl "net/url"
 	"os"
 	"strconv"
 	"strings"
@@ -15,35 +21,46 @@ import (
 	auth "github.com/abbot/go-http-auth"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 	"github.com/urfave/negroni"
 	"golang.org/x/crypto/bcrypt"
 
+	collector "github.com/rancher/telemetry/collector"
 	publish "github.com/rancher/telemetry/publish"
 	record "github.com/rancher/telemetry/record"
 )
 
 const DEF_HOURS = 7
 const DEF_DAYS = 28
+const MAX_PUBLISH_BYTES = 64 * 1024 * 1024
+const MAX_QUERY_BYTES = 64 * 1024
 
 var (
-	version       string
-	enableXff     bool
-	dbPublisher   *publish.Postgres
-	adminUser     string
-	adminHash     string
-	authenticator *auth.BasicAuth
+	version          string
+	enableXff        bool
+	requireSignature bool
+	autoMigrate      bool
+	rollupInterval   time.Duration
+	signatureWindow  time.Duration
+	dbPublisher      publish.Store
+	adminUser        string
+	adminHash        string
+	authenticator    *auth.BasicAuth
+	recordSchema     *record.Schema
+	eolVersions      string
 )
 
 type RequiredOptions []string
 
 type RequestOpts struct {
-	Hours  int
-	Days   int
-	Uid    string
-	Fields []string
-	Field  string
+	Hours   int
+	Days    int
+	Uid     string
+	Fields  []string
+	Field   string
+	Filters []publish.Filter
 }
 
 type InstallCounts struct {
@@ -60,7 +77,7 @@ func ServerCommand() cli.Command {
 		Name:   "server",
 		Usage:  "gather stats from a telemetry client",
 		Action: serverRun,
-		Flags: []cli.Flag{
+		Flags: append(storageFlags(), []cli.Flag{
 			cli.StringFlag{
 				Name:  "listen, l",
 				Usage: "address/port to listen on",
@@ -73,41 +90,46 @@ func ServerCommand() cli.Command {
 				Destination: &enableXff,
 			},
 
-			cli.StringFlag{
-				Name:   "pg-host",
-				Usage:  "postgres host",
-				Value:  "localhost",
-				EnvVar: "TELEMETRY_PG_HOST",
+			cli.BoolTFlag{
+				Name:        "migrate",
+				Usage:       "apply pending database migrations on startup, otherwise refuse to start",
+				EnvVar:      "TELEMETRY_MIGRATE",
+				Destination: &autoMigrate,
 			},
-			cli.StringFlag{
-				Name:   "pg-port",
-				Usage:  "postgres port",
-				Value:  "5432",
-				EnvVar: "TELEMETRY_PG_PORT",
+
+			retentionFlag(),
+
+			scrubFlag("default"),
+			scrubSecretFlag(),
+
+			cli.DurationFlag{
+				Name:        "rollup-interval",
+				Usage:       "how often to recompute the daily rollups reports can't update in place: days from before the rollups, and days whose min or max a report replaced, which lag by up to this long",
+				Value:       time.Minute,
+				EnvVar:      "TELEMETRY_ROLLUP_INTERVAL",
+				Destination: &rollupInterval,
 			},
+
 			cli.StringFlag{
-				Name:   "pg-user",
-				Usage:  "postgres user",
-				Value:  "telemetry",
-				EnvVar: "TELEMETRY_PG_USER",
+				Name:        "eol-versions",
+				Usage:       "comma separated versions no longer supported, with * and ? wildcards, for the upgrades API",
+				EnvVar:      "TELEMETRY_EOL_VERSIONS",
+				Destination: &eolVersions,
 			},
-			cli.StringFlag{
-				Name:   "pg-pass",
-				Usage:  "postgres password",
-				Value:  "",
-				EnvVar: "TELEMETRY_PG_PASS",
-			},
-			cli.StringFlag{
-				Name:   "pg-dbname",
-				Usage:  "postgres dbname",
-				Value:  "telemetry",
-				EnvVar: "TELEMETRY_PG_DBNAME",
+
+			cli.BoolFlag{
+				Name:        "require-signature",
+				Usage:       "reject records that are not signed",
+				EnvVar:      "TELEMETRY_REQUIRE_SIGNATURE",
+				Destination: &requireSignature,
 			},
-			cli.StringFlag{
-				Name:   "pg-ssl",
-				Usage:  "postgres ssl mode (disable, require, verify-ca, verify-full)",
-				Value:  "disable",
-				EnvVar: "TELEMETRY_PG_SSL",
+
+			cli.DurationFlag{
+				Name:        "signature-window",
+				Usage:       "maximum clock skew accepted on signed records",
+				Value:       15 * time.Minute,
+				EnvVar:      "TELEMETRY_SIGNATURE_WINDOW",
+				Destination: &signatureWindow,
 			},
 
 			cli.StringFlag{
@@ -123,6 +145,65 @@ func ServerCommand() cli.Command {
 				Value:  "",
 				EnvVar: "TELEMETRY_SECRET_KEY",
 			},
+		}...),
+	}
+}
+
+// storageFlags selects and configures the server storage
+func storageFlags() []cli.Flag {
+	return append([]cli.Flag{
+		cli.StringFlag{
+			Name:   "storage",
+			Usage:  "where to keep records: postgres, embedded (a single file, for small deployments and CI) or memory (for tests)",
+			Value:  "postgres",
+			EnvVar: "TELEMETRY_STORAGE",
+		},
+		cli.StringFlag{
+			Name:   "embedded-path",
+			Usage:  "file for embedded storage",
+			Value:  "telemetry.db",
+			EnvVar: "TELEMETRY_EMBEDDED_PATH",
+		},
+	}, postgresFlags()...)
+}
+
+func postgresFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:   "pg-host",
+			Usage:  "postgres host",
+			Value:  "localhost",
+			EnvVar: "TELEMETRY_PG_HOST",
+		},
+		cli.StringFlag{
+			Name:   "pg-port",
+			Usage:  "postgres port",
+			Value:  "5432",
+			EnvVar: "TELEMETRY_PG_PORT",
+		},
+		cli.StringFlag{
+			Name:   "pg-user",
+			Usage:  "postgres user",
+			Value:  "telemetry",
+			EnvVar: "TELEMETRY_PG_USER",
+		},
+		cli.StringFlag{
+			Name:   "pg-pass",
+			Usage:  "postgres password",
+			Value:  "",
+			EnvVar: "TELEMETRY_PG_PASS",
+		},
+		cli.StringFlag{
+			Name:   "pg-dbname",
+			Usage:  "postgres dbname",
+			Value:  "telemetry",
+			EnvVar: "TELEMETRY_PG_DBNAME",
+		},
+		cli.StringFlag{
+			Name:   "pg-ssl",
+			Usage:  "postgres ssl mode (disable, require, verify-ca, verify-full)",
+			Value:  "disable",
+			EnvVar: "TELEMETRY_PG_SSL",
 		},
 	}
 }
@@ -145,26 +226,61 @@ func serverRun(c *cli.Context) error {
 	rand.Seed(time.Now().UnixNano())
 
 	version = c.App.Version
-	dbPublisher = publish.NewPostgres(c)
+	recordSchema = collector.RecordSchema()
+	if err := loadScrubRules(); err != nil {
+		log.Fatalf("Error loading scrub rules: %s", err)
+	}
+
+	var err error
+	dbPublisher, err = publish.NewStore(c)
+	if err != nil {
+		log.Fatalf("Error opening storage: %s", err)
+	}
+	if pg, ok := dbPublisher.(*publish.Postgres); ok {
+		if err := pg.CheckSchema(autoMigrate); err != nil {
+			log.Fatalf("Error checking database schema: %s", err)
+		}
+		go maintain(pg)
+		go refreshRollups(pg)
+	}
+	registerServerMetrics()
+
+	setAdmin(c.String("admin-key"), c.String("admin-secret"))
 
-	adminUser = c.String("admin-key")
-	adminSecret := c.String("admin-secret")
-	if adminUser != "" && adminSecret != "" {
-		bytes, _ := bcrypt.GenerateFromPassword([]byte(adminSecret), bcrypt.DefaultCost)
+	logged := handlers.LoggingHandler(os.Stdout, serverRouter())
+
+	listen := c.String("listen")
+	log.Info("Listening on ", listen)
+	log.Fatal(http.ListenAndServe(listen, logged))
+	return nil
+}
+
+// setAdmin sets the admin credentials accepted besides the accounts in storage
+func setAdmin(user string, secret string) {
+	adminUser = user
+	adminHash = ""
+	if user != "" && secret != "" {
+		bytes, _ := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
 		adminHash = string(bytes)
 	}
+}
 
+// serverRouter returns the handler for every server route, without request logging
+func serverRouter() http.Handler {
 	router := mux.NewRouter()
 	router.HandleFunc("/favicon.ico", http.NotFound)
 	router.HandleFunc("/healthcheck.html", serverCheck).Methods("GET")
-	router.HandleFunc("/publish", serverPublish).Methods("POST")
+	router.Handle("/publish", promhttp.InstrumentHandlerCounter(publishRequests, http.HandlerFunc(serverPublish))).Methods("POST")
+	router.HandleFunc("/schema", serverSchema).Methods("GET")
 	router.HandleFunc("/", serverRoot).Methods("GET")
 
 	// Admin
 	authenticator = auth.NewBasicAuthenticator("telemetry", getHash)
 
 	admin := mux.NewRouter()
+	admin.Use(timeAdminQuery)
 
+	// Active and history also take filters on record fields, e.g. ?install.version=v2.5.*&cluster.total>=10
 	admin.HandleFunc("/admin/active", apiActive)                       // ?hours=7
 	admin.HandleFunc("/admin/active/fields/{fields}", apiActiveFields) // ?hours=7
 	admin.HandleFunc("/admin/active/map/{field}", apiActiveMap)        // ?hours=7
@@ -180,25 +296,32 @@ func serverRun(c *cli.Context) error {
 	admin.HandleFunc("/admin/installs/{uid}/fields/{fields}", apiInstallFields) // ?days=28
 	admin.HandleFunc("/admin/installs/{uid}/map/{field}", apiInstallMap)        // ?days=28
 	admin.HandleFunc("/admin/installs/{uid}/value/{field}", apiInstallValue)    // ?days=28
+	admin.HandleFunc("/admin/installs/{uid}/key", apiResetInstallKey).Methods("DELETE")
 
 	admin.HandleFunc("/admin/records/{id}", apiRecordById) // nothing
 
+	admin.HandleFunc("/admin/query", apiQuery).Methods("POST") // JSON publish.Query
+	admin.HandleFunc("/admin/cohorts", apiCohorts)             // ?interval=week&periods=12&split=version&from=&to=
+	admin.HandleFunc("/admin/upgrades", apiUpgrades)           // ?from=&to=&eol=v2.3.*,v2.4.*
+
+	// Results above are also available as ?format=csv, ndjson or parquet, with ?table= naming the
+	// list to export when there are several
+	admin.HandleFunc("/admin/export/records", apiExportRecords) // ?days=28&format=csv, and filters
+
 	n := negroni.New()
 	n.Use(negroni.HandlerFunc(checkAuth))
 	n.UseHandler(admin)
 	router.PathPrefix("/admin").Handler(n)
+
+	metrics := negroni.New()
+	metrics.Use(negroni.HandlerFunc(checkAuth))
+	metrics.UseHandler(promhttp.Handler())
+	router.Handle("/metrics", metrics).Methods("GET")
 	// End: Admin
 
-	cors := handlers.CORS(
-		handlers.AllowedHeaders([]string{"authorization"}),
+	return handlers.CORS(
+		handlers.AllowedHeaders([]string{"authorization", "content-type"}),
 	)(router)
-
-	logged := handlers.LoggingHandler(os.Stdout, cors)
-
-	listen := c.String("listen")
-	log.Info("Listening on ", listen)
-	log.Fatal(http.ListenAndServe(listen, logged))
-	return nil
 }
 
 func checkAuth(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
@@ -320,32 +443,161 @@ func serverRoot(w http.ResponseWriter, req *http.Request) {
 }
 
 func serverPublish(w http.ResponseWriter, req *http.Request) {
-	var r record.Record
+	raw, err := ioutil.ReadAll(io.LimitReader(req.Body, MAX_PUBLISH_BYTES))
+	if err != nil {
+		respondError(w, req, "Error reading Record", 400)
+		return
+	}
 
-	decoder := json.NewDecoder(req.Body)
-	err := decoder.Decode(&r)
+	uid, status, err := verifyRequest(req, raw)
+	if err != nil {
+		respondError(w, req, err.Error(), status)
+		return
+	}
+
+	var body io.Reader = bytes.NewReader(raw)
+	if strings.EqualFold(req.Header.Get("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			respondError(w, req, "Error decompressing Record", 400)
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	records, err := decodeRecords(io.LimitReader(body, MAX_PUBLISH_BYTES))
 	if err != nil {
 		respondError(w, req, "Error parsing Record", 400)
 		return
 	}
 
+	for i, r := range records {
+		err = validateRecord(r)
+		if err != nil {
+			if len(records) > 1 {
+				err = fmt.Errorf("record %d: %s", i, err)
+			}
+			respondError(w, req, err.Error(), 422)
+			return
+		}
+	}
+
+	if uid != "" {
+		for _, r := range records {
+			if recordUid(r) != uid {
+				respondError(w, req, "Record uid does not match signature", 401)
+				return
+			}
+		}
+	} else if status, err := verifyUnsigned(records); err != nil {
+		respondError(w, req, err.Error(), status)
+		return
+	}
+
 	realIp := requestIp(req)
 	ip := anonymizeIp(realIp)
-	log.Debugf("Publish from %s: %s", realIp, r)
 
-	dbPublisher.Report(r, ip)
-	if err != nil {
-		log.Errorf("Error publishing to DB: %s", err)
+	// Records that can't be stored fail the request, so the client keeps them and retries
+	failed := 0
+	for _, r := range records {
+		log.Debugf("Publish from %s: %s", realIp, r)
+
+		if err = scrubRules.Scrub(r); err != nil {
+			log.Errorf("Error scrubbing record: %s", err)
+			failed++
+			continue
+		}
+
+		err = storeRecord(r, ip)
+		if err != nil {
+			log.Errorf("Error publishing to DB: %s", err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		respondError(w, req, fmt.Sprintf("Error storing %d of %d records", failed, len(records)), 500)
+		return
 	}
 
 	respondSuccess(w, req, map[string]string{"ok": "1"})
 }
 
+func storeRecord(r record.Record, ip string) error {
+	start := time.Now()
+	err := dbPublisher.Report(r, ip)
+	dbReportDuration.Observe(time.Since(start).Seconds())
+	return err
+}
+
+// validateRecord upgrades a record to the current version and checks it against the schema
+func validateRecord(r record.Record) error {
+	err := record.Migrate(r)
+	if err != nil {
+		return err
+	}
+
+	errs := recordSchema.Validate(map[string]interface{}(r))
+	if len(errs) == 0 {
+		if unknown := recordSchema.Unknown(map[string]interface{}(r)); len(unknown) > 0 {
+			unknownProperties.Add(float64(len(unknown)))
+			log.Debugf("Record has properties the schema doesn't describe: %s", strings.Join(unknown, ", "))
+		}
+		return nil
+	}
+
+	msgs := make([]string, len(errs))
+	for i, e := range errs {
+		msgs[i] = e.Error()
+	}
+
+	return errors.New("Invalid record: " + strings.Join(msgs, "; "))
+}
+
+func serverSchema(w http.ResponseWriter, req *http.Request) {
+	respondSuccess(w, req, map[string]interface{}{
+		"version": record.VERSION,
+		"schema":  recordSchema,
+	})
+}
+
+// decodeRecords accepts either a single record or a JSON array of records
+func decodeRecords(body io.Reader) ([]record.Record, error) {
+	var raw json.RawMessage
+
+	err := json.NewDecoder(body).Decode(&raw)
+	if err != nil {
+		return nil, err
+	}
+
+	trimmed := bytes.TrimSpace(raw)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		var records []record.Record
+		err = json.Unmarshal(trimmed, &records)
+		return records, err
+	}
+
+	var r record.Record
+	err = json.Unmarshal(trimmed, &r)
+	if err != nil {
+		return nil, err
+	}
+
+	return []record.Record{r}, nil
+}
+
 // ------------
 // History
 // ------------
 func apiHistoryInstalls(w http.ResponseWriter, req *http.Request) {
-	installs, err := dbPublisher.GetAllInstalls()
+	opt, err := getOptions(req, RequiredOptions{})
+	if err != nil {
+		respondError(w, req, err.Error(), 422)
+		return
+	}
+
+	installs, err := dbPublisher.GetAllInstalls(opt.Filters)
 	if err != nil {
 		respondError(w, req, err.Error(), 500)
 		return
@@ -401,7 +653,7 @@ func apiHistoryInstalls(w http.ResponseWriter, req *http.Request) {
 	}
 
 	// Second pass: Active from Records
-	days, err := dbPublisher.GetActiveCountByDay()
+	days, err := dbPublisher.GetActiveCountByDay(opt.Filters)
 	if err != nil {
 		respondError(w, req, err.Error(), 500)
 		return
@@ -423,78 +675,215 @@ func apiHistoryInstalls(w http.ResponseWriter, req *http.Request) {
 // ------------
 // Counts
 // ------------
-func getFields(w http.ResponseWriter, req *http.Request, which string) {
-	var out interface{}
-	var err error
+// The fields, map and value endpoints are shorthands for queries of the active installs, those
+// with a record in the given hours as /admin/active counts them, or of each day's installs
 
+func countsQuery(opt RequestOpts, which string) *publish.Query {
+	q := &publish.Query{}
+	switch which {
+	case "active":
+		since := time.Now().Add(-time.Duration(opt.Hours) * time.Hour)
+		q.Since = &since
+	default:
+		q.From = time.Now().AddDate(0, 0, -opt.Days).Format("2006-01-02")
+		q.Interval = "day"
+	}
+
+	if which == "install" {
+		q.Filters = append(q.Filters, publish.Filter{Field: "install.uid", Op: "=", Value: opt.Uid}.String())
+	}
+	for _, f := range opt.Filters {
+		q.Filters = append(q.Filters, f.String())
+	}
+
+	return q
+}
+
+// respondCounts runs a counts query, adding each row to the counts of the active installs or to
+// those of its day
+func respondCounts(w http.ResponseWriter, req *http.Request, which string, q *publish.Query, add func(publish.QueryRow, publish.AggregatedFields)) {
+	if err := q.Validate(); err != nil {
+		respondError(w, req, err.Error(), 422)
+		return
+	}
+
+	result, err := dbPublisher.Query(q)
+	if err != nil {
+		respondError(w, req, err.Error(), 500)
+		return
+	}
+
+	if which == "active" {
+		out := make(publish.AggregatedFields)
+		for _, row := range result.Rows {
+			add(row, out)
+		}
+		respondSuccess(w, req, out)
+		return
+	}
+
+	out := make(publish.AggregatedFieldsByDate)
+	for _, row := range result.Rows {
+		day, ok := out[row.Period]
+		if !ok {
+			day = make(publish.AggregatedFields)
+			out[row.Period] = day
+		}
+		add(row, day)
+	}
+	respondSuccess(w, req, out)
+}
+
+// getFields sums each field across installs, or takes the min, max or average of fields named
+// with a _min, _max or _avg suffix
+func getFields(w http.ResponseWriter, req *http.Request, which string) {
 	opt, err := getOptions(req, RequiredOptions{"Fields"})
 	if err != nil {
 		respondError(w, req, err.Error(), 422)
 		return
 	}
 
-	switch which {
-	case "active":
-		out, err = dbPublisher.SumOfActiveInstalls(opt.Hours, opt.Fields)
-	case "history":
-		out, err = dbPublisher.SumByDay(opt.Days, opt.Fields, "")
-	case "install":
-		out, err = dbPublisher.SumByDay(opt.Days, opt.Fields, opt.Uid)
-	default:
-		respondError(w, req, "Invalid which", 400)
-		return
+	q := countsQuery(opt, which)
+	for _, field := range opt.Fields {
+		fn := "sum"
+		switch {
+		case strings.HasSuffix(field, "_min"):
+			fn = "min"
+		case strings.HasSuffix(field, "_avg"):
+			fn = "avg"
+		case strings.HasSuffix(field, "_max"):
+			fn = "max"
+		}
+		q.Aggregates = append(q.Aggregates, publish.Aggregate{Fn: fn, Field: field, As: field})
 	}
 
-	respond(w, req, out, err)
+	respondCounts(w, req, which, q, func(row publish.QueryRow, out publish.AggregatedFields) {
+		for field, v := range row.Values {
+			out[field] = int64(math.Round(v))
+		}
+	})
 }
 
+// getMap sums the entries of a map field, like a LabelCount, across installs
 func getMap(w http.ResponseWriter, req *http.Request, which string) {
-	var out interface{}
-	var err error
+	opt, err := getOptions(req, RequiredOptions{"Field"})
+	if err != nil {
+		respondError(w, req, err.Error(), 422)
+		return
+	}
+
+	q := countsQuery(opt, which)
+	q.GroupBy = []string{opt.Field + ".*"}
+	q.Aggregates = []publish.Aggregate{{Fn: "sum", Field: opt.Field + ".*", As: "sum"}}
+
+	respondCounts(w, req, which, q, func(row publish.QueryRow, out publish.AggregatedFields) {
+		key, _ := row.Group[opt.Field+".*"].(string)
+		if v, ok := row.Values["sum"]; ok {
+			out[key] = int64(math.Round(v))
+		}
+	})
+}
 
+// getValue counts the installs by the value of a field
+func getValue(w http.ResponseWriter, req *http.Request, which string) {
 	opt, err := getOptions(req, RequiredOptions{"Field"})
 	if err != nil {
 		respondError(w, req, err.Error(), 422)
 		return
 	}
 
-	switch which {
-	case "active":
-		out, err = dbPublisher.SumOfActiveInstallsMap(opt.Hours, opt.Field)
-	case "history":
-		out, err = dbPublisher.SumByDayMap(opt.Days, opt.Field, "")
-	case "install":
-		out, err = dbPublisher.SumByDayMap(opt.Days, opt.Field, opt.Uid)
-	default:
-		respondError(w, req, "Invalid which", 400)
+	q := countsQuery(opt, which)
+	q.GroupBy = []string{opt.Field}
+	q.Aggregates = []publish.Aggregate{{Fn: "count", As: "count"}}
+
+	respondCounts(w, req, which, q, func(row publish.QueryRow, out publish.AggregatedFields) {
+		// Installs without the field are left out
+		if key, ok := row.Group[opt.Field].(string); ok {
+			out[key] = int64(row.Values["count"])
+		}
+	})
+}
+
+// ------------
+// Query
+// ------------
+func apiQuery(w http.ResponseWriter, req *http.Request) {
+	var q publish.Query
+	err := json.NewDecoder(io.LimitReader(req.Body, MAX_QUERY_BYTES)).Decode(&q)
+	if err != nil {
+		respondError(w, req, "Error parsing query: "+err.Error(), 400)
 		return
 	}
 
+	err = q.Validate()
+	if err != nil {
+		respondError(w, req, err.Error(), 422)
+		return
+	}
+
+	out, err := dbPublisher.Query(&q)
 	respond(w, req, out, err)
 }
 
-func getValue(w http.ResponseWriter, req *http.Request, which string) {
-	var out interface{}
-	var err error
+// ------------
+// Cohorts
+// ------------
+func apiCohorts(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	q := publish.CohortQuery{
+		From:     query.Get("from"),
+		To:       query.Get("to"),
+		Interval: query.Get("interval"),
+		Split:    query.Get("split"),
+	}
 
-	opt, err := getOptions(req, RequiredOptions{"Field"})
+	str := query.Get("periods")
+	if str != "" {
+		num, err := strconv.Atoi(str)
+		if err != nil {
+			respondError(w, req, "Invalid periods", 422)
+			return
+		}
+		q.Periods = num
+	}
+
+	err := q.Validate()
 	if err != nil {
 		respondError(w, req, err.Error(), 422)
 		return
 	}
 
-	switch which {
-	case "active":
-		out, err = dbPublisher.SumOfActiveInstallsValue(opt.Hours, opt.Field)
-	case "history":
-		out, err = dbPublisher.SumByDayValue(opt.Days, opt.Field, "")
-	case "install":
-		out, err = dbPublisher.SumByDayValue(opt.Days, opt.Field, opt.Uid)
-	default:
-		respondError(w, req, "Invalid which", 400)
+	out, err := dbPublisher.Cohorts(&q)
+	respond(w, req, out, err)
+}
+
+// ------------
+// Upgrades
+// ------------
+func apiUpgrades(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	q := publish.UpgradeQuery{
+		From: query.Get("from"),
+		To:   query.Get("to"),
+	}
+
+	eol := eolVersions
+	if _, ok := query["eol"]; ok {
+		eol = query.Get("eol")
+	}
+	for _, version := range strings.Split(eol, ",") {
+		if version = strings.TrimSpace(version); version != "" {
+			q.EOL = append(q.EOL, version)
+		}
+	}
+
+	err := q.Validate()
+	if err != nil {
+		respondError(w, req, err.Error(), 422)
 		return
 	}
 
+	out, err := dbPublisher.Upgrades(&q)
 	respond(w, req, out, err)
 }
 
@@ -508,7 +897,7 @@ func apiActive(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	installs, err := dbPublisher.GetActiveInstalls(opt.Hours)
+	installs, err := dbPublisher.GetActiveInstalls(opt.Hours, opt.Filters)
 	if err != nil {
 		respondError(w, req, err.Error(), 500)
 		return
@@ -545,7 +934,7 @@ func apiHistory(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	out, err := dbPublisher.GetRecordsGroupedByDay(opt.Days)
+	out, err := dbPublisher.GetRecordsGroupedByDay(opt.Days, opt.Filters)
 	respond(w, req, out, err)
 }
 
@@ -566,6 +955,10 @@ func apiHistoryValue(w http.ResponseWriter, req *http.Request) {
 // ------------
 func apiInstallByUid(w http.ResponseWriter, req *http.Request) {
 	opt, err := getOptions(req, RequiredOptions{"Uid"})
+	if err != nil {
+		respondError(w, req, err.Error(), 400)
+		return
+	}
 
 	records, err := dbPublisher.GetRecordsByUid(opt.Uid, opt.Days)
 	if err != nil {
@@ -594,6 +987,19 @@ func apiInstallValue(w http.ResponseWriter, req *http.Request) {
 	getValue(w, req, "install")
 }
 
+// apiResetInstallKey forgets the signing key of an install that lost it, so the client registers
+// the new key it made with its next record
+func apiResetInstallKey(w http.ResponseWriter, req *http.Request) {
+	uid := mux.Vars(req)["uid"]
+	if err := dbPublisher.ResetInstallKey(uid); err != nil {
+		respondError(w, req, err.Error(), 500)
+		return
+	}
+
+	log.Infof("Reset the signing key of install %s", uid)
+	w.WriteHeader(http.StatusNoContent)
+}
+
 // ------------
 // By Record
 // ------------
@@ -681,6 +1087,12 @@ func getOptions(req *http.Request, required RequiredOptions) (RequestOpts, error
 		return out, errors.New("Days must be > 0")
 	}
 
+	filters, err := getFilters(req)
+	if err != nil {
+		return out, err
+	}
+	out.Filters = filters
+
 	if required != nil {
 		if required.Contains("Uid") && len(out.Uid) == 0 {
 			return out, errors.New("You must provide a field")
@@ -698,6 +1110,37 @@ func getOptions(req *http.Request, required RequiredOptions) (RequestOpts, error
 	return out, nil
 }
 
+// getFilters reads filters on record fields from the query, e.g.
+// ?install.version=v2.5.*&cluster.total>=10. The raw query is parsed, as operators other than =
+// don't survive splitting it into keys and values.
+func getFilters(req *http.Request) ([]publish.Filter, error) {
+	out := []publish.Filter{}
+
+	for _, pair := range strings.Split(req.URL.RawQuery, "&") {
+		str, err := neturl.QueryUnescape(pair)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid filter %q", pair)
+		}
+
+		// Record fields always have a section, which tells them from options like hours
+		name := str
+		if i := strings.IndexAny(str, "=!<>"); i >= 0 {
+			name = str[:i]
+		}
+		if !strings.Contains(name, ".") {
+			continue
+		}
+
+		filter, err := publish.ParseFilter(str)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, filter)
+	}
+
+	return out, nil
+}
+
 func (r *RequiredOptions) Contains(needle string) bool {
 	needle = strings.ToLower(needle)
 	for _, val := range *r {
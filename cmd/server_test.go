@@ -0,0 +1,264 @@
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	publish "github.com/rancher/telemetry/publish"
+	record "github.com/rancher/telemetry/record"
+)
+
+// testStores returns the stores the server runs against without a database
+func testStores() map[string]func(t *testing.T) publish.Store {
+	return map[string]func(t *testing.T) publish.Store{
+		"memory": func(t *testing.T) publish.Store {
+			return publish.NewMemory()
+		},
+		"embedded": func(t *testing.T) publish.Store {
+			dir, err := ioutil.TempDir("", "telemetry")
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { os.RemoveAll(dir) })
+
+			store, err := publish.NewEmbedded(filepath.Join(dir, "telemetry.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { store.Close() })
+			return store
+		},
+	}
+}
+
+func serverRecord(uid string, version string, clusters int) record.Record {
+	return record.Record{
+		"r":       float64(record.VERSION),
+		"install": map[string]interface{}{"uid": uid, "version": version},
+		"cluster": map[string]interface{}{"active": float64(clusters), "total": float64(clusters)},
+		"node":    map[string]interface{}{"kubelet": map[string]interface{}{"v1.19.3": float64(clusters), "v1.18.9": float64(1)}},
+	}
+}
+
+func TestPublishThenQuery(t *testing.T) {
+	for name, newStore := range testStores() {
+		t.Run(name, func(t *testing.T) {
+			s := newTestServer(newStore(t))
+			defer s.Close()
+
+			send := func(r record.Record) {
+				status, err := s.Publish(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if status != http.StatusOK {
+					t.Fatalf("Publish %v: got %d, want 200", r, status)
+				}
+			}
+			send(serverRecord("a", "v2.4.8", 3))
+			send(serverRecord("b", "v2.5.1", 5))
+			send(serverRecord("c", "v2.5.1", 2))
+			// a upgrades, replacing its record
+			send(serverRecord("a", "v2.5.2", 4))
+
+			active := struct {
+				Data []publish.ApiInstallation `json:"data"`
+			}{}
+			if err := s.Admin("/admin/active", &active); err != nil {
+				t.Fatal(err)
+			}
+			if len(active.Data) != 3 {
+				t.Errorf("Active installs: got %d, want 3", len(active.Data))
+			}
+
+			check := func(path string, want interface{}) {
+				t.Helper()
+				got := reflect.New(reflect.TypeOf(want))
+				if err := s.Admin(path, got.Interface()); err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got.Elem().Interface(), want) {
+					t.Errorf("%s: got %v, want %v", path, got.Elem().Interface(), want)
+				}
+			}
+			check("/admin/active/fields/cluster.total,cluster.active", publish.AggregatedFields{"cluster.total": 11, "cluster.active": 11})
+			check("/admin/active/fields/cluster.total?install.version=v2.5.*", publish.AggregatedFields{"cluster.total": 11})
+			check("/admin/active/fields/cluster.total?install.version=v2.5.1", publish.AggregatedFields{"cluster.total": 7})
+			check("/admin/active/value/install.version", publish.AggregatedFields{"v2.5.1": 2, "v2.5.2": 1})
+			check("/admin/active/map/node.kubelet", publish.AggregatedFields{"v1.19.3": 11, "v1.18.9": 3})
+
+			today := time.Now().Format("2006-01-02")
+			check("/admin/history/fields/cluster.total?days=1", publish.AggregatedFieldsByDate{today: {"cluster.total": 11}})
+			check("/admin/history/value/install.version?days=1", publish.AggregatedFieldsByDate{today: {"v2.5.1": 2, "v2.5.2": 1}})
+			check("/admin/history/map/node.kubelet?days=1&cluster.total>=4", publish.AggregatedFieldsByDate{today: {"v1.19.3": 9, "v1.18.9": 2}})
+			check("/admin/installs/a/fields/cluster.total?days=1", publish.AggregatedFieldsByDate{today: {"cluster.total": 4}})
+
+			result, err := s.Query(publish.Query{
+				GroupBy: []string{"install.version"},
+				Aggregates: []publish.Aggregate{
+					{Fn: "count", As: "installs"},
+					{Fn: "sum", Field: "cluster.total"},
+					{Fn: "max", Field: "cluster.total"},
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := map[string]map[string]float64{}
+			for _, row := range result.Rows {
+				version, _ := row.Group["install.version"].(string)
+				got[version] = row.Values
+			}
+			// Each install counts once, with its last record
+			want := map[string]map[string]float64{
+				"v2.5.1": {"installs": 2, "sum(cluster.total)": 7, "max(cluster.total)": 5},
+				"v2.5.2": {"installs": 1, "sum(cluster.total)": 4, "max(cluster.total)": 4},
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Query by version: got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestPublishRejects(t *testing.T) {
+	for name, newStore := range testStores() {
+		t.Run(name, func(t *testing.T) {
+			s := newTestServer(newStore(t))
+			defer s.Close()
+
+			post := func(body string) int {
+				res, err := http.Post(s.URL+"/publish", "application/json", bytes.NewBufferString(body))
+				if err != nil {
+					t.Fatal(err)
+				}
+				res.Body.Close()
+				return res.StatusCode
+			}
+
+			if status := post(`{"r":2,`); status != http.StatusBadRequest {
+				t.Errorf("Invalid JSON: got %d, want 400", status)
+			}
+			if status := post(`{"r":2,"install":{"version":"v2.5.1"}}`); status != http.StatusUnprocessableEntity {
+				t.Errorf("Record without a uid: got %d, want 422", status)
+			}
+
+			fields := publish.AggregatedFields{}
+			if err := s.Admin("/admin/active/value/install.version", &fields); err != nil {
+				t.Fatal(err)
+			}
+			if len(fields) != 0 {
+				t.Errorf("Active installs after rejected records: got %v, want none", fields)
+			}
+		})
+	}
+}
+
+// TestActiveHours counts the same installs as active in /admin/active and the fields endpoints,
+// to the hour
+func TestActiveHours(t *testing.T) {
+	for name, newStore := range testStores() {
+		t.Run(name, func(t *testing.T) {
+			s := newTestServer(newStore(t))
+			defer s.Close()
+
+			now := time.Now()
+			if err := s.Store.ReportAt(serverRecord("a", "v2.5.1", 3), "", now.Add(-10*time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Store.ReportAt(serverRecord("b", "v2.5.1", 5), "", now.Add(-time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, test := range []struct {
+				hours    string
+				installs int
+				total    int64
+			}{
+				{"7", 1, 5},
+				{"12", 2, 8},
+			} {
+				active := struct {
+					Data []publish.ApiInstallation `json:"data"`
+				}{}
+				if err := s.Admin("/admin/active?hours="+test.hours, &active); err != nil {
+					t.Fatal(err)
+				}
+				if len(active.Data) != test.installs {
+					t.Errorf("Active installs in %s hours: got %d, want %d", test.hours, len(active.Data), test.installs)
+				}
+
+				fields := publish.AggregatedFields{}
+				if err := s.Admin("/admin/active/fields/cluster.total?hours="+test.hours, &fields); err != nil {
+					t.Fatal(err)
+				}
+				if fields["cluster.total"] != test.total {
+					t.Errorf("Active clusters in %s hours: got %v, want %v", test.hours, fields["cluster.total"], test.total)
+				}
+			}
+		})
+	}
+}
+
+func TestInstallByUidRejectsFilters(t *testing.T) {
+	s := newTestServer(nil)
+	defer s.Close()
+
+	err := s.Admin("/admin/installs/a?cluster.total>=many", &struct{}{})
+	if err == nil || !strings.Contains(err.Error(), ": 400 ") {
+		t.Errorf("Invalid filter: got %v, want 400", err)
+	}
+}
+
+// TestAdminFilters filters admin queries by record fields, where only * is a wildcard
+func TestAdminFilters(t *testing.T) {
+	for name, newStore := range testStores() {
+		t.Run(name, func(t *testing.T) {
+			s := newTestServer(newStore(t))
+			defer s.Close()
+
+			for _, r := range []record.Record{
+				serverRecord("a", "v2.5_1", 1),
+				serverRecord("b", "v2.5a1", 2),
+				serverRecord("c", "v2.5%1", 4),
+			} {
+				if status, err := s.Publish(r); err != nil || status != http.StatusOK {
+					t.Fatalf("Publish: got %d, %v", status, err)
+				}
+			}
+
+			tests := map[string]int64{
+				"install.version=v2.5_*":                  1,
+				"install.version=v2.5%25*":                4,
+				"install.version!=v2.5_*":                 6,
+				"install.version=v2.5*":                   7,
+				"install.version=v2.5_1":                  1,
+				"cluster.total%3E%3D2":                    6,
+				"install.version=v2.5*&cluster.total%3C4": 3,
+			}
+			for filter, want := range tests {
+				fields := publish.AggregatedFields{}
+				if err := s.Admin("/admin/active/fields/cluster.total?"+filter, &fields); err != nil {
+					t.Fatal(err)
+				}
+				if fields["cluster.total"] != want {
+					t.Errorf("%s: got %v, want %d clusters", filter, fields, want)
+				}
+			}
+
+			for _, filter := range []string{"install'.version=v2.5.1", "install.version%3Ev2.5", "cluster.total%3C"} {
+				err := s.Admin("/admin/active/fields/cluster.total?"+filter, nil)
+				if err == nil || !strings.Contains(err.Error(), "Invalid filter") {
+					t.Errorf("%s: got %v, want an invalid filter", filter, err)
+				}
+			}
+		})
+	}
+}
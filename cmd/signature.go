@@ -0,0 +1,108 @@
+package cmd
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	publish "github.com/rancher/telemetry/publish"
+	record "github.com/rancher/telemetry/record"
+)
+
+// verifyRequest checks the signature of a publish request, returning the signing install uid
+// ("" for an unsigned request, whose records are checked by verifyUnsigned) and the status code
+// to fail with on error.
+func verifyRequest(req *http.Request, body []byte) (string, int, error) {
+	signature := req.Header.Get(publish.HeaderSignature)
+	if signature == "" {
+		if requireSignature {
+			return "", 401, errors.New("Signature is required")
+		}
+		return "", 0, nil
+	}
+
+	uid := req.Header.Get(publish.HeaderUid)
+	nonce := req.Header.Get(publish.HeaderNonce)
+	if uid == "" || nonce == "" {
+		return "", 401, errors.New("Uid and nonce are required")
+	}
+
+	ts, err := strconv.ParseInt(req.Header.Get(publish.HeaderTimestamp), 10, 64)
+	if err != nil {
+		return "", 401, errors.New("Invalid timestamp")
+	}
+
+	skew := time.Since(time.Unix(ts, 0))
+	if skew > signatureWindow || skew < -signatureWindow {
+		return "", 401, errors.New("Stale timestamp")
+	}
+
+	key, err := dbPublisher.GetInstallKey(uid)
+	if err != nil {
+		return "", 500, err
+	}
+
+	register := false
+	if key == "" {
+		key = req.Header.Get(publish.HeaderKey)
+		if key == "" {
+			return "", 401, errors.New("Unknown install")
+		}
+		register = true
+	}
+
+	if !publish.VerifySignature(key, ts, nonce, body, signature) {
+		if offered := req.Header.Get(publish.HeaderKey); !register && offered != "" && offered != key {
+			return "", 401, errors.New("Install has a different key, reset it with DELETE /admin/installs/{uid}/key")
+		}
+		return "", 401, errors.New("Invalid signature")
+	}
+
+	fresh, err := dbPublisher.UseNonce(uid, nonce, signatureWindow)
+	if err != nil {
+		return "", 500, err
+	}
+	if !fresh {
+		return "", 401, errors.New("Reused nonce")
+	}
+
+	// Another request may have registered a key since it was read
+	if register {
+		stored, err := dbPublisher.RegisterInstallKey(uid, key)
+		if err != nil {
+			return "", 500, err
+		}
+		if stored != key {
+			return "", 401, errors.New("Install has a different key, reset it with DELETE /admin/installs/{uid}/key")
+		}
+	}
+
+	return uid, 0, nil
+}
+
+// verifyUnsigned checks that none of the records of an unsigned request belong to an install that
+// registered a key, which only accepts records signed with it
+func verifyUnsigned(records []record.Record) (int, error) {
+	for _, r := range records {
+		key, err := dbPublisher.GetInstallKey(recordUid(r))
+		if err != nil {
+			return 500, err
+		}
+		if key != "" {
+			return 401, errors.New("Signature is required for this install")
+		}
+	}
+
+	return 0, nil
+}
+
+func recordUid(r record.Record) string {
+	install, ok := r["install"].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+
+	uid, _ := install["uid"].(string)
+	return uid
+}
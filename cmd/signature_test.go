@@ -0,0 +1,135 @@
+package cmd
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	publish "github.com/rancher/telemetry/publish"
+)
+
+// signedRequest builds a publish request signed with key, sending the key along if offer is set
+func signedRequest(uid string, key string, offer bool, ts time.Time, nonce string, body []byte) *http.Request {
+	req, _ := http.NewRequest("POST", "/publish", bytes.NewReader(body))
+	req.Header.Set(publish.HeaderUid, uid)
+	req.Header.Set(publish.HeaderTimestamp, strconv.FormatInt(ts.Unix(), 10))
+	req.Header.Set(publish.HeaderNonce, nonce)
+	req.Header.Set(publish.HeaderSignature, publish.Sign(key, ts.Unix(), nonce, body))
+	if offer {
+		req.Header.Set(publish.HeaderKey, key)
+	}
+	return req
+}
+
+func TestVerifyRequest(t *testing.T) {
+	s := newTestServer(nil)
+	defer s.Close()
+
+	body := []byte(`{"install":{"uid":"a"}}`)
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		req    *http.Request
+		body   []byte
+		status int
+	}{
+		{"unknown install without a key", signedRequest("a", "key-1", false, now, "n1", body), body, 401},
+		{"first contact registers the key", signedRequest("a", "key-1", true, now, "n2", body), body, 0},
+		{"registered key", signedRequest("a", "key-1", false, now, "n3", body), body, 0},
+		{"registered key offered again", signedRequest("a", "key-1", true, now, "n4", body), body, 0},
+		{"replayed nonce", signedRequest("a", "key-1", false, now, "n3", body), body, 401},
+		{"stale timestamp", signedRequest("a", "key-1", false, now.Add(-2*signatureWindow), "n5", body), body, 401},
+		{"future timestamp", signedRequest("a", "key-1", false, now.Add(2*signatureWindow), "n6", body), body, 401},
+		{"changed body", signedRequest("a", "key-1", false, now, "n7", body), []byte(`{"install":{"uid":"b"}}`), 401},
+		{"different key", signedRequest("a", "key-2", true, now, "n8", body), body, 401},
+		{"no nonce", signedRequest("a", "key-1", false, now, "", body), body, 401},
+	}
+
+	for _, test := range tests {
+		uid, status, err := verifyRequest(test.req, test.body)
+		if status != test.status {
+			t.Errorf("%s: got %d (%v), want %d", test.name, status, err, test.status)
+		}
+		if status == 0 && uid != "a" {
+			t.Errorf("%s: got uid %q, want a", test.name, uid)
+		}
+	}
+
+	if key, _ := s.Store.GetInstallKey("a"); key != "key-1" {
+		t.Errorf("Registered key: got %q, want key-1", key)
+	}
+}
+
+func TestVerifyRequestRequireSignature(t *testing.T) {
+	s := newTestServer(nil)
+	defer s.Close()
+
+	requireSignature = true
+	defer func() { requireSignature = false }()
+
+	req, _ := http.NewRequest("POST", "/publish", bytes.NewReader([]byte(`{}`)))
+	if _, status, _ := verifyRequest(req, []byte(`{}`)); status != 401 {
+		t.Errorf("Unsigned request: got %d, want 401", status)
+	}
+}
+
+// TestVerifyRequestConcurrentRegistration registers different keys for one install at once, of
+// which only one may be accepted
+func TestVerifyRequestConcurrentRegistration(t *testing.T) {
+	s := newTestServer(nil)
+	defer s.Close()
+
+	body := []byte(`{"install":{"uid":"a"}}`)
+	accepted := make(chan string, 10)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(accepted); i++ {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			req := signedRequest("a", key, true, time.Now(), publish.NewNonce(), body)
+			if _, status, _ := verifyRequest(req, body); status == 0 {
+				accepted <- key
+			}
+		}("key-" + strconv.Itoa(i))
+	}
+	wg.Wait()
+	close(accepted)
+
+	keys := []string{}
+	for key := range accepted {
+		keys = append(keys, key)
+	}
+	stored, _ := s.Store.GetInstallKey("a")
+	if len(keys) != 1 || keys[0] != stored {
+		t.Errorf("Accepted %v with %q registered, want only the registered key", keys, stored)
+	}
+}
+
+// TestResetInstallKey lets an install that lost its key register a new one after an admin reset
+func TestResetInstallKey(t *testing.T) {
+	s := newTestServer(nil)
+	defer s.Close()
+
+	body := []byte(`{"install":{"uid":"a"}}`)
+	if _, status, err := verifyRequest(signedRequest("a", "old", true, time.Now(), "n1", body), body); status != 0 {
+		t.Fatalf("Registering: %d %v", status, err)
+	}
+	if _, status, _ := verifyRequest(signedRequest("a", "new", true, time.Now(), "n2", body), body); status != 401 {
+		t.Fatalf("New key before the reset: got %d, want 401", status)
+	}
+
+	if err := s.admin("DELETE", "/admin/installs/a/key", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, status, err := verifyRequest(signedRequest("a", "new", true, time.Now(), "n3", body), body); status != 0 {
+		t.Errorf("New key after the reset: got %d (%v), want it accepted", status, err)
+	}
+	if _, status, _ := verifyRequest(signedRequest("a", "old", false, time.Now(), "n4", body), body); status != 401 {
+		t.Errorf("Old key after the reset: got %d, want 401", status)
+	}
+}
@@ -19,14 +19,14 @@ var (
 )
 
 type AppTemplate struct {
-	State string                 `json:"state"`
-	Apps  map[string]*LabelCount `json:"apps"`
+	State string                 `json:"state" label:"state"`
+	Apps  map[string]*LabelCount `json:"apps" label:"template,version"`
 }
 
 type App struct {
 	Total    int                     `json:"total"`
 	Active   int                     `json:"active"`
-	Catalogs map[string]*AppTemplate `json:"rancheCatalogs"`
+	Catalogs map[string]*AppTemplate `json:"rancheCatalogs" label:"catalog"`
 }
 
 func (a App) RecordKey() string {
@@ -46,6 +46,7 @@ func (a App) Collect(c *CollectorOpts) interface{} {
 		state, err := GetAppCatalogState(c, catalog)
 		if err != nil {
 			log.Errorf("Failed to get Catalog ID %s err=%s", catalog, err)
+			c.Fail(err)
 			return nil
 		}
 		a.Catalogs[catalog] = &AppTemplate{
@@ -58,14 +59,22 @@ func (a App) Collect(c *CollectorOpts) interface{} {
 	projectList, err := c.Client.Project.ListAll(&opts)
 	if err != nil {
 		log.Errorf("Failed to get Projects err=%s", err)
+		c.Fail(err)
 		return nil
 	}
 	log.Debugf("  Found %d Projects", len(projectList.Data))
 
 	for _, project := range projectList.Data {
+		if err := c.Err(); err != nil {
+			log.Errorf("Stopped collecting Apps err=%s", err)
+			c.PartialFail("project", err)
+			break
+		}
+
 		projectClient, err := GetProjectClient(c, project.ID)
 		if err != nil {
 			log.Errorf("Failed to get project client ID %s err=%s", project.ID, err)
+			c.PartialFail("project", err)
 			continue
 		}
 
@@ -73,6 +82,7 @@ func (a App) Collect(c *CollectorOpts) interface{} {
 		appsCollection, err := projectClient.App.ListAll(&nonRemoved)
 		if err != nil {
 			log.Errorf("Failed to get Apps for project %s err=%s", project.ID, err)
+			c.PartialFail("app", err)
 		} else {
 			log.Debugf("  Found %d Apps", len(appsCollection.Data))
 			for _, app := range appsCollection.Data {
@@ -1,14 +1,39 @@
 package collector
 
 import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rancher/norman/clientbase"
 	rancherCluster "github.com/rancher/rancher/pkg/client/generated/cluster/v3"
 	rancher "github.com/rancher/rancher/pkg/client/generated/management/v3"
 	rancherProject "github.com/rancher/rancher/pkg/client/generated/project/v3"
 	"github.com/rancher/telemetry/record"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultWorkers = 4
+	DefaultTimeout = 10 * time.Minute
 )
 
 type CollectorOpts struct {
-	Client *rancher.Client
+	Client  *rancher.Client
+	Ctx     context.Context
+	Workers int
+	Timeout time.Duration
+
+	status *collectorStatus
+}
+
+// Err returns the error of the collector context, if it is done
+func (c *CollectorOpts) Err() error {
+	if c.Ctx == nil {
+		return nil
+	}
+	return c.Ctx.Err()
 }
 
 type Collector interface {
@@ -23,21 +48,156 @@ func Register(c Collector) {
 }
 
 func Run(record *record.Record, opt *CollectorOpts) {
-	for _, c := range registered {
-		(*record)[c.RecordKey()] = c.Collect(opt)
+	workers := opt.Workers
+	if workers < 1 {
+		workers = DefaultWorkers
+	}
+
+	results := make([]interface{}, len(registered))
+	metas := make([]*Meta, len(registered))
+	jobs := make(chan int)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i], metas[i] = runCollector(registered[i], opt)
+			}
+		}()
+	}
+
+	for i := range registered {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	// Results are stored in registration order, whatever order collectors finished in
+	meta := make(map[string]*Meta)
+	for i, c := range registered {
+		(*record)[c.RecordKey()] = results[i]
+		meta[c.RecordKey()] = metas[i]
+	}
+	(*record)[MetaRecordKey] = meta
+}
+
+func runCollector(c Collector, opt *CollectorOpts) (interface{}, *Meta) {
+	start := time.Now()
+
+	parent := opt.Ctx
+	if parent == nil {
+		parent = context.Background()
+	}
+
+	timeout := opt.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	defer cancel()
+
+	collectorOpt := *opt
+	collectorOpt.Ctx = ctx
+	collectorOpt.status = &collectorStatus{}
+
+	// The Rancher client doesn't take a context, so each collector gets one whose requests carry
+	// its own, letting a timeout stop a collector instead of leaving it to run in the background
+	client, err := contextClient(opt.Client, ctx)
+	if err != nil {
+		log.Errorf("Failed to collect %s err=%s", c.RecordKey(), err)
+		collectorOpt.Fail(err)
+		return nil, collectorOpt.status.meta(nil, start)
+	}
+	collectorOpt.Client = client
+
+	// Buffered, so a collector finishing after its deadline doesn't block forever
+	done := make(chan interface{}, 1)
+	go func() {
+		done <- c.Collect(&collectorOpt)
+	}()
+
+	select {
+	case out := <-done:
+		return out, collectorOpt.status.meta(out, start)
+	case <-ctx.Done():
+		log.Errorf("Failed to collect %s err=%s", c.RecordKey(), ctx.Err())
+		collectorOpt.Fail(ctx.Err())
+		return nil, collectorOpt.status.meta(nil, start)
+	}
+}
+
+// contextClient returns a copy of client whose requests are canceled with ctx
+func contextClient(client *rancher.Client, ctx context.Context) (*rancher.Client, error) {
+	if client == nil || client.Opts == nil {
+		return client, nil
+	}
+
+	options := clientOpts(client.Opts)
+	copied, err := rancher.NewClient(&options)
+	if err != nil {
+		return nil, err
 	}
+	withContext(&copied.APIBaseClient, ctx)
+	return copied, nil
+}
+
+// withContext makes the requests of a client carry ctx. The transport is wrapped once the client
+// is created, since creating it sets one.
+func withContext(client *clientbase.APIBaseClient, ctx context.Context) {
+	if ctx == nil || client.Ops == nil || client.Ops.Client == nil {
+		return
+	}
+
+	base := client.Ops.Client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	client.Ops.Client.Transport = &contextTransport{ctx: ctx, base: base}
+}
+
+type contextTransport struct {
+	ctx  context.Context
+	base http.RoundTripper
+}
+
+func (t *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.base.RoundTrip(req.WithContext(t.ctx))
+}
+
+// clientOpts copies the options of a client, with an HTTP client of its own since creating a
+// client sets its transport and timeout
+func clientOpts(opts *clientbase.ClientOpts) clientbase.ClientOpts {
+	options := *opts
+	if options.HTTPClient != nil {
+		httpClient := *options.HTTPClient
+		options.HTTPClient = &httpClient
+	}
+	return options
 }
 
 func GetClusterClient(c *CollectorOpts, id string) (*rancherCluster.Client, error) {
-	options := *c.Client.Opts
+	options := clientOpts(c.Client.Opts)
 	options.URL = options.URL + "/clusters/" + id
 
-	return rancherCluster.NewClient(&options)
+	client, err := rancherCluster.NewClient(&options)
+	if err != nil {
+		return nil, err
+	}
+	withContext(&client.APIBaseClient, c.Ctx)
+	return client, nil
 }
 
 func GetProjectClient(c *CollectorOpts, id string) (*rancherProject.Client, error) {
-	options := *c.Client.Opts
+	options := clientOpts(c.Client.Opts)
 	options.URL = options.URL + "/projects/" + id
 
-	return rancherProject.NewClient(&options)
+	client, err := rancherProject.NewClient(&options)
+	if err != nil {
+		return nil, err
+	}
+	withContext(&client.APIBaseClient, c.Ctx)
+	return client, nil
 }
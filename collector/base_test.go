@@ -0,0 +1,164 @@
+package collector
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rancher/norman/clientbase"
+	rancher "github.com/rancher/rancher/pkg/client/generated/management/v3"
+	"github.com/rancher/telemetry/record"
+)
+
+type testCollector struct {
+	key     string
+	collect func(opt *CollectorOpts) interface{}
+}
+
+func (c testCollector) RecordKey() string {
+	return c.key
+}
+
+func (c testCollector) Collect(opt *CollectorOpts) interface{} {
+	return c.collect(opt)
+}
+
+// withCollectors registers only cs for the rest of a test
+func withCollectors(t *testing.T, cs ...Collector) {
+	saved := registered
+	registered = cs
+	t.Cleanup(func() { registered = saved })
+}
+
+// TestRun runs collectors that finish in another order than they were registered in, one that
+// times out in the middle of a request and one that fails, on fewer workers than collectors
+func TestRun(t *testing.T) {
+	var canceled sync.Once
+	requestCanceled := make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/v3/slow" {
+			<-req.Context().Done()
+			canceled.Do(func() { close(requestCanceled) })
+			return
+		}
+		// An API without types is enough to create a client
+		w.Header().Set("X-API-Schemas", "http://"+req.Host+"/v3")
+		w.Write([]byte(`{"data":[]}`))
+	}))
+	defer s.Close()
+
+	client, err := rancher.NewClient(&clientbase.ClientOpts{URL: s.URL + "/v3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var running, most int32
+	track := func(collect func(opt *CollectorOpts) interface{}) func(opt *CollectorOpts) interface{} {
+		return func(opt *CollectorOpts) interface{} {
+			n := atomic.AddInt32(&running, 1)
+			defer atomic.AddInt32(&running, -1)
+			for {
+				m := atomic.LoadInt32(&most)
+				if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+					break
+				}
+			}
+			return collect(opt)
+		}
+	}
+
+	withCollectors(t,
+		testCollector{"first", track(func(opt *CollectorOpts) interface{} {
+			time.Sleep(50 * time.Millisecond)
+			return "first"
+		})},
+		testCollector{"slow", track(func(opt *CollectorOpts) interface{} {
+			resp, err := opt.Client.Ops.Client.Get(s.URL + "/v3/slow")
+			if err != nil {
+				return nil
+			}
+			resp.Body.Close()
+			return "slow"
+		})},
+		testCollector{"failing", track(func(opt *CollectorOpts) interface{} {
+			opt.Fail(&clientbase.APIError{StatusCode: http.StatusServiceUnavailable})
+			return nil
+		})},
+		testCollector{"partial", track(func(opt *CollectorOpts) interface{} {
+			opt.PartialFail("project", context.DeadlineExceeded)
+			return "partial"
+		})},
+		testCollector{"last", track(func(opt *CollectorOpts) interface{} {
+			return "last"
+		})},
+	)
+
+	r := record.Record{}
+	Run(&r, &CollectorOpts{Client: client, Workers: 2, Timeout: 200 * time.Millisecond})
+
+	want := map[string]interface{}{"first": "first", "slow": nil, "failing": nil, "partial": "partial", "last": "last"}
+	for key, v := range want {
+		if got, ok := r[key]; !ok || got != v {
+			t.Errorf("%s: got %v, want %v", key, got, v)
+		}
+	}
+
+	metas, _ := r[MetaRecordKey].(map[string]*Meta)
+	wantMetas := map[string]Meta{
+		"first":   {Success: true},
+		"slow":    {Error: ErrorTimeout},
+		"failing": {Error: "http_503"},
+		"partial": {Success: true, Partial: LabelCount{"project": 1}, Errors: LabelCount{ErrorTimeout: 1}},
+		"last":    {Success: true},
+	}
+	if len(metas) != len(wantMetas) {
+		t.Errorf("Meta: got %d collectors, want %d", len(metas), len(wantMetas))
+	}
+	for key, want := range wantMetas {
+		got := metas[key]
+		if got == nil {
+			t.Errorf("Meta of %s is missing", key)
+			continue
+		}
+		got.DurationMs = 0
+		if !reflect.DeepEqual(*got, want) {
+			t.Errorf("Meta of %s: got %+v, want %+v", key, *got, want)
+		}
+	}
+
+	if most > 2 {
+		t.Errorf("Collectors running at once: got %d, want at most 2", most)
+	}
+
+	// The timeout canceled the request the slow collector was waiting on
+	select {
+	case <-requestCanceled:
+	case <-time.After(5 * time.Second):
+		t.Error("The slow collector's request was not canceled")
+	}
+}
+
+// TestRunCanceled stops every collector when the context of the run is canceled
+func TestRunCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	withCollectors(t, testCollector{"blocked", func(opt *CollectorOpts) interface{} {
+		<-opt.Ctx.Done()
+		time.Sleep(10 * time.Millisecond)
+		return "blocked"
+	}})
+
+	r := record.Record{}
+	Run(&r, &CollectorOpts{Ctx: ctx})
+
+	metas := r[MetaRecordKey].(map[string]*Meta)
+	if r["blocked"] != nil || metas["blocked"].Error != ErrorCanceled {
+		t.Errorf("Canceled run: got %v with meta %+v", r["blocked"], metas["blocked"])
+	}
+}
@@ -21,11 +21,11 @@ type Cluster struct {
 	Cpu              *CpuInfo    `json:"cpu"`
 	Mem              *MemoryInfo `json:"mem"`
 	Pod              *PodInfo    `json:"pod"`
-	Driver           LabelCount  `json:"driver"`
+	Driver           LabelCount  `json:"driver" label:"driver"`
 	IstioTotal       int         `json:"istio"`
 	MonitoringTotal  int         `json:"monitoring"`
-	LogProviderCount LabelCount  `json:"logging"`
-	CloudProvider    LabelCount  `json:"cloudProvider"`
+	LogProviderCount LabelCount  `json:"logging" label:"provider"`
+	CloudProvider    LabelCount  `json:"cloudProvider" label:"provider"`
 }
 
 func (h Cluster) RecordKey() string {
@@ -39,6 +39,7 @@ func (h Cluster) Collect(c *CollectorOpts) interface{} {
 	clusterList, err := c.Client.Cluster.ListAll(&nonRemoved)
 	if err != nil {
 		log.Errorf("Failed to get Clusters err=%s", err)
+		c.Fail(err)
 		return nil
 	}
 
@@ -58,6 +59,12 @@ func (h Cluster) Collect(c *CollectorOpts) interface{} {
 
 	// Clusters
 	for _, cluster := range clusterList.Data {
+		if err := c.Err(); err != nil {
+			log.Errorf("Stopped collecting Clusters err=%s", err)
+			c.PartialFail("cluster", err)
+			break
+		}
+
 		var utilFloat float64
 		var util int
 
@@ -125,10 +132,12 @@ func (h Cluster) Collect(c *CollectorOpts) interface{} {
 		clusterClient, err := GetClusterClient(c, cluster.ID)
 		if err != nil {
 			log.Errorf("Failed to get Cluster client err=%s", err)
+			c.PartialFail("cluster", err)
 		}
 		nsCollection, err := clusterClient.Namespace.ListAll(nil)
 		if err != nil {
 			log.Errorf("Failed to get Namespaces err=%s", err)
+			c.PartialFail("namespace", err)
 		} else {
 			totalNs := len(nsCollection.Data)
 			h.Ns.Update(totalNs)
@@ -158,6 +167,7 @@ func (h Cluster) Collect(c *CollectorOpts) interface{} {
 	logList, err := c.Client.ClusterLogging.ListAll(nil)
 	if err != nil {
 		log.Errorf("Failed to get Cluster Loggings err=%s", err)
+		c.Fail(err)
 		return nil
 	}
 
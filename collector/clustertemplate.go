@@ -7,7 +7,7 @@ import (
 type ClusterTemplate struct {
 	TotalClusterTemplates  int    `json:"total"`
 	TotalTemplateRevisions int    `json:"revisions"`
-	Enforcement            string `json:"enforcement"`
+	Enforcement            string `json:"enforcement" label:"enforcement"`
 }
 
 func (ct ClusterTemplate) RecordKey() string {
@@ -20,6 +20,7 @@ func (ct ClusterTemplate) Collect(c *CollectorOpts) interface{} {
 	clusterTemplateList, err := c.Client.ClusterTemplate.ListAll(&nonRemoved)
 	if err != nil {
 		log.Errorf("Failed to get Clusters Templates err=%s", err)
+		c.Fail(err)
 		return nil
 	}
 	ct.TotalClusterTemplates = len(clusterTemplateList.Data)
@@ -27,6 +28,7 @@ func (ct ClusterTemplate) Collect(c *CollectorOpts) interface{} {
 	revisionsList, err := c.Client.ClusterTemplateRevision.ListAll(&nonRemoved)
 	if err != nil {
 		log.Errorf("Failed to get Cluster Revisions err=%s", err)
+		c.Fail(err)
 		return nil
 	}
 	ct.TotalTemplateRevisions = len(revisionsList.Data)
@@ -34,6 +36,7 @@ func (ct ClusterTemplate) Collect(c *CollectorOpts) interface{} {
 	setting, err := c.Client.Setting.ByID("cluster-template-enforcement")
 	if err != nil {
 		log.Errorf("Failed to get setting in Clusters Templates collect err=%s", err)
+		c.Fail(err)
 		return nil
 	}
 
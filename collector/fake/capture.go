@@ -0,0 +1,190 @@
+package fake
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	CaptureFile = "responses.json"
+	RecordFile  = "record.json"
+
+	// Captured responses refer to the API by this URL instead of the address of the server recorded
+	// or replaying them
+	capturedURL = "http://rancher.capture"
+)
+
+// Capture is every API response seen during a collection, by request path and query
+type Capture struct {
+	Path      string               `json:"path"`
+	Responses map[string]*Response `json:"responses"`
+}
+
+type Response struct {
+	Status  int             `json:"status"`
+	Schemas string          `json:"schemas,omitempty"`
+	Body    json.RawMessage `json:"body,omitempty"`
+	Text    string          `json:"text,omitempty"`
+}
+
+// Recorder is a proxy to a Rancher API that keeps the responses passing through it. Point the
+// client at r.URL + r.Path.
+type Recorder struct {
+	*httptest.Server
+	Path string
+
+	target  string
+	mu      sync.Mutex
+	capture Capture
+}
+
+// NewRecorder starts a recording proxy on a local port for the API at url, e.g. https://rancher/v3
+func NewRecorder(url string) (*Recorder, error) {
+	u, err := neturl.Parse(url)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("Invalid API url %s", url)
+	}
+
+	r := &Recorder{
+		Path:   u.Path,
+		target: u.Scheme + "://" + u.Host,
+		capture: Capture{
+			Path:      u.Path,
+			Responses: map[string]*Response{},
+		},
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = u.Scheme
+			req.URL.Host = u.Host
+			req.Host = u.Host
+			// Bodies are rewritten, so they must not come back compressed
+			req.Header.Del("Accept-Encoding")
+		},
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			Proxy:           http.ProxyFromEnvironment,
+		},
+		ModifyResponse: r.record,
+	}
+
+	r.Server = httptest.NewServer(proxy)
+	return r, nil
+}
+
+// record keeps a response, pointing the URLs in it at the proxy so the client keeps using it
+func (r *Recorder) record(res *http.Response) error {
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	captured := &Response{
+		Status:  res.StatusCode,
+		Schemas: strings.Replace(res.Header.Get("X-API-Schemas"), r.target, capturedURL, -1),
+	}
+	if text := strings.Replace(string(body), r.target, capturedURL, -1); json.Valid([]byte(text)) {
+		captured.Body = json.RawMessage(text)
+	} else {
+		captured.Text = text
+	}
+
+	r.mu.Lock()
+	r.capture.Responses[res.Request.URL.RequestURI()] = captured
+	r.mu.Unlock()
+
+	body = bytes.Replace(body, []byte(r.target), []byte(r.URL), -1)
+	if schemas := res.Header.Get("X-API-Schemas"); schemas != "" {
+		res.Header.Set("X-API-Schemas", strings.Replace(schemas, r.target, r.URL, -1))
+	}
+	res.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	res.ContentLength = int64(len(body))
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return nil
+}
+
+// Save writes the captured responses to dir. They hold everything the API returned, not only what
+// ends up in the record.
+func (r *Recorder) Save(dir string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	b, err := json.MarshalIndent(r.capture, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, CaptureFile), append(b, '\n'), 0644)
+}
+
+// Replay is a fake Rancher API answering with the responses a Recorder saved. Point the client at
+// r.URL + r.Path.
+type Replay struct {
+	*httptest.Server
+	Path string
+
+	capture Capture
+}
+
+func NewReplay(dir string) (*Replay, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, CaptureFile))
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Replay{}
+	if err = json.Unmarshal(b, &r.capture); err != nil {
+		return nil, fmt.Errorf("%s: %s", CaptureFile, err)
+	}
+	r.Path = r.capture.Path
+
+	r.Server = httptest.NewServer(http.HandlerFunc(r.serve))
+	return r, nil
+}
+
+func (r *Replay) serve(w http.ResponseWriter, req *http.Request) {
+	res, ok := r.capture.Responses[req.URL.RequestURI()]
+	if !ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"type":    "error",
+			"status":  http.StatusNotFound,
+			"code":    "NotFound",
+			"message": req.URL.RequestURI() + " was not captured",
+		})
+		return
+	}
+
+	body := []byte(res.Text)
+	if len(res.Body) > 0 {
+		body = res.Body
+		w.Header().Set("Content-Type", "application/json")
+	}
+
+	if res.Schemas != "" {
+		w.Header().Set("X-API-Schemas", strings.Replace(res.Schemas, capturedURL, r.URL, -1))
+	}
+	w.WriteHeader(res.Status)
+	w.Write(bytes.Replace(body, []byte(capturedURL), []byte(r.URL), -1))
+}
@@ -0,0 +1,287 @@
+package collector_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	rancherCluster "github.com/rancher/rancher/pkg/client/generated/cluster/v3"
+	rancher "github.com/rancher/rancher/pkg/client/generated/management/v3"
+	rancherProject "github.com/rancher/rancher/pkg/client/generated/project/v3"
+)
+
+// Types served at each API scope, the ones the collectors use
+var (
+	managementTypes = []string{
+		rancher.AuthConfigType,
+		rancher.CatalogType,
+		rancher.ClusterType,
+		rancher.ClusterLoggingType,
+		rancher.ClusterTemplateType,
+		rancher.ClusterTemplateRevisionType,
+		rancher.GlobalDnsType,
+		rancher.GlobalDnsProviderType,
+		rancher.KontainerDriverType,
+		rancher.MultiClusterAppType,
+		rancher.NodeType,
+		rancher.NodeDriverType,
+		rancher.NodeTemplateType,
+		rancher.ProjectType,
+		rancher.SettingType,
+		rancher.TemplateVersionType,
+		rancher.UserType,
+	}
+	clusterTypes = []string{
+		rancherCluster.NamespaceType,
+	}
+	projectTypes = []string{
+		rancherProject.AppType,
+		rancherProject.HorizontalPodAutoscalerType,
+		rancherProject.PipelineType,
+		rancherProject.PodType,
+		rancherProject.SourceCodeProviderType,
+		rancherProject.WorkloadType,
+	}
+)
+
+// Filters that change how a list is returned rather than what is in it
+var ignoredFilters = map[string]bool{
+	"all":    true,
+	"limit":  true,
+	"marker": true,
+	"order":  true,
+	"sort":   true,
+}
+
+// fakeAPI is a fake Rancher v3 API answering from a directory of fixtures, for running the collectors
+// without a Rancher. The directory holds a JSON array of resources per type and scope:
+//
+//	<type>.json                  management resources, e.g. cluster.json, node.json, setting.json
+//	clusters/<id>/<type>.json    cluster resources, e.g. namespace.json
+//	projects/<id>/<type>.json    project resources, e.g. workload.json, pod.json
+//	errors.json                  status codes to answer with instead, by path below /v3,
+//	                             e.g. {"setting/server-version": 500, "projects/c-1:p-1/pod": 503}
+//
+// A missing file is an empty collection. Fixtures are read on every request, so they can be
+// changed while the server runs.
+type fakeAPI struct {
+	*httptest.Server
+	Dir string
+}
+
+// newFakeAPI starts a fake API on a local port; point the client at s.URL + "/v3"
+func newFakeAPI(dir string) (*fakeAPI, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+
+	s := &fakeAPI{Dir: dir}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s, nil
+}
+
+func (s *fakeAPI) serve(w http.ResponseWriter, req *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(req.URL.Path, "/v3"), "/")
+
+	errors, err := s.errors()
+	if err != nil {
+		s.respondError(w, http.StatusInternalServerError, "ServerError", err.Error())
+		return
+	}
+	if status, ok := errors[path]; ok {
+		s.respondError(w, status, http.StatusText(status), "Injected by errors.json")
+		return
+	}
+
+	if req.Method != http.MethodGet {
+		s.respondError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", req.Method+" is not supported by the fake API")
+		return
+	}
+
+	scope, types, rest := "", managementTypes, []string{}
+	if path != "" {
+		rest = strings.Split(path, "/")
+	}
+	if len(rest) >= 2 && (rest[0] == "clusters" || rest[0] == "projects") {
+		scope = rest[0] + "/" + rest[1]
+		if rest[0] == "clusters" {
+			types = clusterTypes
+		} else {
+			types = projectTypes
+		}
+		rest = rest[2:]
+	}
+
+	switch {
+	case len(rest) == 0:
+		s.serveSchemas(w, req, scope, types)
+	case !contains(types, rest[0]):
+		s.respondError(w, http.StatusNotFound, "NotFound", "Unknown type "+rest[0])
+	case len(rest) == 1:
+		s.serveCollection(w, req, scope, rest[0])
+	default:
+		s.serveResource(w, scope, rest[0], strings.Join(rest[1:], "/"))
+	}
+}
+
+// serveSchemas answers a client being created, pointing X-API-Schemas back at the same URL so the
+// client reads the schemas from this response
+func (s *fakeAPI) serveSchemas(w http.ResponseWriter, req *http.Request, scope string, types []string) {
+	base := s.URL + "/v3"
+	if scope != "" {
+		base += "/" + scope
+	}
+
+	data := []map[string]interface{}{}
+	for _, t := range types {
+		data = append(data, map[string]interface{}{
+			"id":                t,
+			"type":              "schema",
+			"collectionMethods": []string{"GET"},
+			"resourceMethods":   []string{"GET"},
+			"links": map[string]string{
+				"collection": base + "/" + t,
+			},
+		})
+	}
+
+	w.Header().Set("X-API-Schemas", s.URL+req.URL.Path)
+	s.respond(w, http.StatusOK, map[string]interface{}{
+		"type":         "collection",
+		"resourceType": "schema",
+		"data":         data,
+	})
+}
+
+func (s *fakeAPI) serveCollection(w http.ResponseWriter, req *http.Request, scope string, t string) {
+	items, err := s.load(scope, t)
+	if err != nil {
+		s.respondError(w, http.StatusInternalServerError, "ServerError", err.Error())
+		return
+	}
+
+	data := []map[string]interface{}{}
+	for _, item := range items {
+		if matches(item, req.URL.Query()) {
+			data = append(data, item)
+		}
+	}
+
+	s.respond(w, http.StatusOK, map[string]interface{}{
+		"type":         "collection",
+		"resourceType": t,
+		"data":         data,
+	})
+}
+
+func (s *fakeAPI) serveResource(w http.ResponseWriter, scope string, t string, id string) {
+	items, err := s.load(scope, t)
+	if err != nil {
+		s.respondError(w, http.StatusInternalServerError, "ServerError", err.Error())
+		return
+	}
+
+	for _, item := range items {
+		if item["id"] == id {
+			s.respond(w, http.StatusOK, item)
+			return
+		}
+	}
+
+	s.respondError(w, http.StatusNotFound, "NotFound", t+" "+id+" not found")
+}
+
+// load reads the resources of a type, filling in their type
+func (s *fakeAPI) load(scope string, t string) ([]map[string]interface{}, error) {
+	items := []map[string]interface{}{}
+
+	b, err := ioutil.ReadFile(filepath.Join(s.Dir, filepath.FromSlash(scope), t+".json"))
+	if os.IsNotExist(err) {
+		return items, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(b, &items); err != nil {
+		return nil, fmt.Errorf("%s/%s.json: %s", scope, t, err)
+	}
+
+	for _, item := range items {
+		if _, ok := item["type"]; !ok {
+			item["type"] = t
+		}
+	}
+
+	return items, nil
+}
+
+func (s *fakeAPI) errors() (map[string]int, error) {
+	out := map[string]int{}
+
+	b, err := ioutil.ReadFile(filepath.Join(s.Dir, "errors.json"))
+	if os.IsNotExist(err) {
+		return out, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(b, &out); err != nil {
+		return nil, fmt.Errorf("errors.json: %s", err)
+	}
+	return out, nil
+}
+
+func (s *fakeAPI) respond(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// respondError answers in the Rancher error format, which the client turns into an APIError
+func (s *fakeAPI) respondError(w http.ResponseWriter, status int, code string, message string) {
+	s.respond(w, status, map[string]interface{}{
+		"type":    "error",
+		"status":  status,
+		"code":    code,
+		"message": message,
+	})
+}
+
+// matches applies the list filters the collectors use: field=value and field_ne=value on top level
+// fields of the resource
+func matches(item map[string]interface{}, filters map[string][]string) bool {
+	for k, values := range filters {
+		if ignoredFilters[k] || len(values) == 0 {
+			continue
+		}
+
+		field, negate := k, false
+		if strings.HasSuffix(k, "_ne") {
+			field, negate = strings.TrimSuffix(k, "_ne"), true
+		}
+
+		value := ""
+		if v, ok := item[field]; ok && v != nil {
+			value = fmt.Sprint(v)
+		}
+
+		if (value == values[0]) == negate {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
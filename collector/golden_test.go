@@ -0,0 +1,87 @@
+package collector_test
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	collector "github.com/rancher/telemetry/collector"
+	fake "github.com/rancher/telemetry/collector/fake"
+	record "github.com/rancher/telemetry/record"
+)
+
+const goldenFile = "record.golden.json"
+
+var update = flag.Bool("update", false, "write the golden files instead of comparing")
+
+// TestGolden runs the collectors against each fixture directory under testdata and compares the
+// record with the golden file there. Run with -update to write the golden files instead.
+func TestGolden(t *testing.T) {
+	dirs, err := filepath.Glob(filepath.Join("testdata", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dir := range dirs {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			continue
+		}
+
+		dir := dir
+		t.Run(filepath.Base(dir), func(t *testing.T) {
+			s, err := newFakeAPI(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			r, err := fake.Collect(s.URL + "/v3")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			path := filepath.Join(dir, goldenFile)
+			if *update {
+				b, err := json.MarshalIndent(r, "", "  ")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err = ioutil.WriteFile(path, append(b, '\n'), 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatalf("%s, run with -update to create it", err)
+			}
+			want := record.Record{}
+			if err = json.Unmarshal(b, &want); err != nil {
+				t.Fatalf("%s: %s", path, err)
+			}
+
+			changes, err := record.Diff(want, r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, c := range changes {
+				t.Error(c.String())
+			}
+
+			// The schema the server checks records with describes all of it, once the client has
+			// added the version
+			want["r"] = float64(record.VERSION)
+			schema := collector.RecordSchema()
+			for _, err := range schema.Validate(map[string]interface{}(want)) {
+				t.Errorf("Schema: %s", err)
+			}
+			for _, path := range schema.Unknown(map[string]interface{}(want)) {
+				t.Errorf("Schema: %s is not described", path)
+			}
+		})
+	}
+}
@@ -19,14 +19,14 @@ const (
 
 type Installation struct {
 	Uid                  string     `json:"uid"`
-	Version              string     `json:"version"`
-	UiLanding            string     `json:"uiLanding"`
-	AuthConfig           LabelCount `json:"auth"`
-	Users                LabelCount `json:"users"`
+	Version              string     `json:"version" label:"version"`
+	UiLanding            string     `json:"uiLanding" label:"landing"`
+	AuthConfig           LabelCount `json:"auth" label:"provider"`
+	Users                LabelCount `json:"users" label:"provider"`
 	KontainerDriverCount int        `json:"kontainerDriverCount"`
-	KontainerDrivers     LabelCount `json:"kontainerDrivers"`
+	KontainerDrivers     LabelCount `json:"kontainerDrivers" label:"driver"`
 	NodeDriverCount      int        `json:"nodeDriverCount"`
-	NodeDrivers          LabelCount `json:"nodeDrivers"`
+	NodeDrivers          LabelCount `json:"nodeDrivers" label:"driver"`
 	HasInternal          bool       `json:"hasInternal"`
 }
 
@@ -58,6 +58,7 @@ func (i Installation) Collect(c *CollectorOpts) interface{} {
 		}
 	} else {
 		log.Errorf("Failed to get authProviders err=%s", err)
+		c.PartialFail("authConfig", err)
 	}
 
 	log.Debug("  Collecting Users")
@@ -73,6 +74,7 @@ func (i Installation) Collect(c *CollectorOpts) interface{} {
 		}
 	} else {
 		log.Errorf("Failed to get users err=%s", err)
+		c.PartialFail("user", err)
 	}
 
 	log.Debug("  Collecting NodeDrivers")
@@ -86,6 +88,7 @@ func (i Installation) Collect(c *CollectorOpts) interface{} {
 		}
 	} else {
 		log.Errorf("Failed to get nodeDrivers err=%s", err)
+		c.PartialFail("nodeDriver", err)
 	}
 
 	log.Debug("  Collecting KontainerDrivers")
@@ -99,6 +102,7 @@ func (i Installation) Collect(c *CollectorOpts) interface{} {
 		}
 	} else {
 		log.Errorf("Failed to get kontainerDrivers err=%s", err)
+		c.PartialFail("kontainerDriver", err)
 	}
 
 	i.HasInternal = false
@@ -114,6 +118,7 @@ func (i Installation) Collect(c *CollectorOpts) interface{} {
 		}
 	} else {
 		log.Errorf("Failed to get Clusters err=%s", err)
+		c.PartialFail("cluster", err)
 	}
 
 	return i
@@ -124,6 +129,7 @@ func (i *Installation) GetUILanding(c *CollectorOpts) {
 	if err != nil {
 		if !IsNotFound(err) {
 			log.Errorf("Failed to get setting %s err=%s", UI_DEFAULT_LANDING_SETTING, err)
+			c.PartialFail("setting", err)
 		}
 	}
 	defer log.Debugf("  Installation UI Landing: %s", i.UiLanding)
@@ -138,6 +144,7 @@ func (i *Installation) GetVersion(c *CollectorOpts) {
 	version, err := c.Client.Setting.ByID(SERVER_VERSION_SETTING)
 	if err != nil {
 		log.Errorf("Failed to get setting %s err=%s", SERVER_VERSION_SETTING, err)
+		c.PartialFail("setting", err)
 	}
 	defer log.Debugf("  Installation Server Version: %s", i.Version)
 	if version == nil || len(version.Value) == 0 {
@@ -153,6 +160,7 @@ func GetTelemetryUid(c *CollectorOpts) (string, bool) {
 	if err != nil {
 		if !IsNotFound(err) {
 			log.Errorf("Failed to get setting %s err=%s", TELEMETRY_UID_SETTING, err)
+			c.PartialFail("setting", err)
 			return "", false
 		}
 	}
@@ -168,6 +176,7 @@ func GetTelemetryUid(c *CollectorOpts) (string, bool) {
 	err = SetSetting(c.Client, TELEMETRY_UID_SETTING, uid)
 	if err != nil {
 		log.Errorf("Error Setting generated Telemetry Uid: %s", err)
+		c.PartialFail("setting", err)
 		return "", false
 	}
 
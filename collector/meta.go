@@ -0,0 +1,133 @@
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rancher/norman/clientbase"
+)
+
+const (
+	MetaRecordKey = "_meta"
+
+	ErrorTimeout  = "timeout"
+	ErrorCanceled = "canceled"
+	ErrorNetwork  = "network"
+	ErrorDecode   = "decode"
+	ErrorEmpty    = "empty"
+	ErrorUnknown  = "unknown"
+)
+
+// Meta describes how a single collector run went
+type Meta struct {
+	DurationMs int64      `json:"durationMs"`
+	Success    bool       `json:"success"`
+	Error      string     `json:"error,omitempty" label:"error"`
+	Partial    LabelCount `json:"partial,omitempty" label:"resource"`
+	Errors     LabelCount `json:"errors,omitempty" label:"error"`
+}
+
+type collectorStatus struct {
+	sync.Mutex
+	err     string
+	partial LabelCount
+	errors  LabelCount
+}
+
+// Fail records that the collector could not produce its section
+func (c *CollectorOpts) Fail(err error) {
+	if c.status == nil {
+		return
+	}
+
+	c.status.Lock()
+	defer c.status.Unlock()
+	if c.status.err == "" {
+		c.status.err = ErrorClass(err)
+	}
+}
+
+// PartialFail records that part of the collector section, e.g. a single project, could not be collected
+func (c *CollectorOpts) PartialFail(resource string, err error) {
+	if c.status == nil {
+		return
+	}
+
+	c.status.Lock()
+	defer c.status.Unlock()
+	if c.status.partial == nil {
+		c.status.partial = make(LabelCount)
+		c.status.errors = make(LabelCount)
+	}
+	c.status.partial.Increment(resource)
+	c.status.errors.Increment(ErrorClass(err))
+}
+
+func (s *collectorStatus) meta(out interface{}, start time.Time) *Meta {
+	s.Lock()
+	defer s.Unlock()
+
+	m := &Meta{
+		DurationMs: time.Since(start).Nanoseconds() / int64(time.Millisecond),
+		Error:      s.err,
+	}
+
+	if len(s.partial) > 0 {
+		m.Partial = make(LabelCount)
+		for k, v := range s.partial {
+			m.Partial[k] = v
+		}
+		m.Errors = make(LabelCount)
+		for k, v := range s.errors {
+			m.Errors[k] = v
+		}
+	}
+
+	if out == nil && m.Error == "" {
+		m.Error = ErrorEmpty
+	}
+	m.Success = m.Error == ""
+
+	return m
+}
+
+// ErrorClass reduces an error to a short class safe to report, dropping URLs, hostnames and messages
+func ErrorClass(err error) string {
+	if err == nil {
+		return ErrorUnknown
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrorTimeout
+	}
+
+	if errors.Is(err, context.Canceled) {
+		return ErrorCanceled
+	}
+
+	var apiErr *clientbase.APIError
+	if errors.As(err, &apiErr) {
+		return "http_" + strconv.Itoa(apiErr.StatusCode)
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return ErrorTimeout
+		}
+		return ErrorNetwork
+	}
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+		return ErrorDecode
+	}
+
+	return ErrorUnknown
+}
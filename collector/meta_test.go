@@ -0,0 +1,123 @@
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rancher/norman/clientbase"
+)
+
+type netError struct {
+	timeout bool
+}
+
+func (e netError) Error() string   { return "dial tcp 10.0.0.1:443: something" }
+func (e netError) Timeout() bool   { return e.timeout }
+func (e netError) Temporary() bool { return false }
+
+func TestErrorClass(t *testing.T) {
+	var syntaxErr error
+	if err := json.Unmarshal([]byte("{"), &struct{}{}); err != nil {
+		syntaxErr = err
+	}
+	var typeErr error
+	if err := json.Unmarshal([]byte(`{"a":"b"}`), &struct{ A int }{}); err != nil {
+		typeErr = err
+	}
+
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{nil, ErrorUnknown},
+		{errors.New("https://rancher.example.com/v3 is down"), ErrorUnknown},
+		{context.DeadlineExceeded, ErrorTimeout},
+		{fmt.Errorf("listing nodes: %w", context.DeadlineExceeded), ErrorTimeout},
+		{context.Canceled, ErrorCanceled},
+		{&clientbase.APIError{StatusCode: 403, URL: "https://rancher.example.com/v3/users"}, "http_403"},
+		{fmt.Errorf("get: %w", &clientbase.APIError{StatusCode: 500}), "http_500"},
+		{&net.OpError{Op: "dial", Err: netError{}}, ErrorNetwork},
+		{netError{timeout: true}, ErrorTimeout},
+		{syntaxErr, ErrorDecode},
+		{typeErr, ErrorDecode},
+	}
+
+	for _, test := range tests {
+		if got := ErrorClass(test.err); got != test.want {
+			t.Errorf("%v: got %s, want %s", test.err, got, test.want)
+		}
+	}
+}
+
+func TestMeta(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(opt *CollectorOpts)
+		out  interface{}
+		want Meta
+	}{
+		{
+			name: "success",
+			run:  func(opt *CollectorOpts) {},
+			out:  "section",
+			want: Meta{Success: true},
+		},
+		{
+			name: "empty",
+			run:  func(opt *CollectorOpts) {},
+			want: Meta{Error: ErrorEmpty},
+		},
+		{
+			name: "first failure wins",
+			run: func(opt *CollectorOpts) {
+				opt.Fail(context.Canceled)
+				opt.Fail(context.DeadlineExceeded)
+			},
+			want: Meta{Error: ErrorCanceled},
+		},
+		{
+			name: "partial",
+			run: func(opt *CollectorOpts) {
+				opt.PartialFail("project", &clientbase.APIError{StatusCode: 403})
+				opt.PartialFail("project", context.DeadlineExceeded)
+				opt.PartialFail("cluster", &clientbase.APIError{StatusCode: 403})
+			},
+			out: "section",
+			want: Meta{
+				Success: true,
+				Partial: LabelCount{"project": 2, "cluster": 1},
+				Errors:  LabelCount{"http_403": 2, ErrorTimeout: 1},
+			},
+		},
+		{
+			name: "partial then failed",
+			run: func(opt *CollectorOpts) {
+				opt.PartialFail("node", errors.New("oops"))
+				opt.Fail(context.DeadlineExceeded)
+			},
+			want: Meta{Error: ErrorTimeout, Partial: LabelCount{"node": 1}, Errors: LabelCount{ErrorUnknown: 1}},
+		},
+	}
+
+	for _, test := range tests {
+		opt := &CollectorOpts{status: &collectorStatus{}}
+		test.run(opt)
+
+		got := opt.status.meta(test.out, time.Now())
+		got.DurationMs = 0
+		if !reflect.DeepEqual(*got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, *got, test.want)
+		}
+	}
+
+	// Without a status, as when a collector runs outside of Run, failures are ignored
+	opt := &CollectorOpts{}
+	opt.Fail(context.Canceled)
+	opt.PartialFail("project", context.Canceled)
+}
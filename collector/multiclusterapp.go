@@ -16,7 +16,7 @@ type MultiClusterApp struct {
 	TargetTotal  int                     `json:"targetTotal"`
 	DnsProviders int                     `json:"dnsProviders"`
 	DnsEntries   int                     `json:"dnsEntries"`
-	Catalogs     map[string]*AppTemplate `json:"rancheCatalogs"`
+	Catalogs     map[string]*AppTemplate `json:"rancheCatalogs" label:"catalog"`
 }
 
 func (mca MultiClusterApp) RecordKey() string {
@@ -38,6 +38,7 @@ func (mca MultiClusterApp) Collect(c *CollectorOpts) interface{} {
 			state, err := GetAppCatalogState(c, catalog)
 			if err != nil {
 				log.Errorf("Failed to get Catalog ID %s err=%s", catalog, err)
+				c.Fail(err)
 				return nil
 			}
 			mca.Catalogs[catalog] = &AppTemplate{
@@ -82,6 +83,7 @@ func (mca MultiClusterApp) Collect(c *CollectorOpts) interface{} {
 		mca.TargetAvg = Average(targetCounts)
 	} else {
 		log.Errorf("Failed to get Apps err=%s", err)
+		c.PartialFail("multiClusterApp", err)
 	}
 
 	// Global DNS Providers (only with management cluster, so ignore errors)
@@ -13,13 +13,13 @@ type Node struct {
 	Cpu       CpuInfo    `json:"cpu"`
 	Mem       MemoryInfo `json:"mem"`
 	Pod       PodInfo    `json:"pod"`
-	Kernel    LabelCount `json:"kernel"`
-	Kubelet   LabelCount `json:"kubelet"`
-	Kubeproxy LabelCount `json:"kubeproxy"`
-	Os        LabelCount `json:"os"`
-	Docker    LabelCount `json:"docker"`
-	Driver    LabelCount `json:"driver"`
-	Role      LabelCount `json:"role"`
+	Kernel    LabelCount `json:"kernel" label:"version"`
+	Kubelet   LabelCount `json:"kubelet" label:"version"`
+	Kubeproxy LabelCount `json:"kubeproxy" label:"version"`
+	Os        LabelCount `json:"os" label:"os"`
+	Docker    LabelCount `json:"docker" label:"version"`
+	Driver    LabelCount `json:"driver" label:"driver"`
+	Role      LabelCount `json:"role" label:"role"`
 }
 
 func (m Node) RecordKey() string {
@@ -33,6 +33,7 @@ func (h Node) Collect(c *CollectorOpts) interface{} {
 	nodeList, err := c.Client.Node.ListAll(&nonRemoved)
 	if err != nil {
 		log.Errorf("Failed to get Nodes err=%s", err)
+		c.Fail(err)
 		return nil
 	}
 
@@ -52,6 +53,12 @@ func (h Node) Collect(c *CollectorOpts) interface{} {
 
 	// Nodes
 	for _, node := range nodeList.Data {
+		if err := c.Err(); err != nil {
+			log.Errorf("Stopped collecting Nodes err=%s", err)
+			c.PartialFail("node", err)
+			break
+		}
+
 		var utilFloat float64
 		var util int
 
@@ -135,6 +142,7 @@ func (h Node) Collect(c *CollectorOpts) interface{} {
 					log.Debugf("    nodeTemplate not found [%s]", node.NodeTemplateID)
 				} else {
 					log.Errorf("Failed to get nodeTemplate [%s] err=%s", node.NodeTemplateID, err)
+					c.PartialFail("nodeTemplate", err)
 				}
 			} else {
 				h.FromTmpl++
@@ -2,6 +2,6 @@ package collector
 
 type PipelineInfo struct {
 	Enabled        int        `json:"enabled"` // 1 if user has any # pipeline provider enabled
-	SourceProvider LabelCount `json:"source"`
+	SourceProvider LabelCount `json:"source" label:"provider"`
 	TotalPipelines int        `json:"total"`
 }
@@ -17,10 +17,10 @@ type Project struct {
 	Ns            NsInfo       `json:"namespace"`
 	Workload      WorkloadInfo `json:"workload"`
 	Pipeline      PipelineInfo `json:"pipeline"`
-	LibraryCharts LabelCount   `json:"charts"`
+	LibraryCharts LabelCount   `json:"charts" label:"chart"`
 	HPA           HPAInfo      `json:"hpa"`
 	Pod           PodData      `json:"pod"`
-	Orchestration LabelCount   `json:"orch"`
+	Orchestration LabelCount   `json:"orch" label:"orchestration"`
 }
 
 func (p Project) RecordKey() string {
@@ -38,6 +38,7 @@ func (p Project) Collect(c *CollectorOpts) interface{} {
 
 	if err != nil {
 		log.Errorf("Failed to get Projects err=%s", err)
+		c.Fail(err)
 		return nil
 	}
 
@@ -64,11 +65,18 @@ func (p Project) Collect(c *CollectorOpts) interface{} {
 	}
 
 	for _, project := range list.Data {
+		if err := c.Err(); err != nil {
+			log.Errorf("Stopped collecting Projects err=%s", err)
+			c.PartialFail("project", err)
+			break
+		}
+
 		parts := strings.SplitN(project.ID, ":", 2)
 		clusterID := parts[0]
 		clusterClient, err := GetClusterClient(c, clusterID)
 		if err != nil {
 			log.Errorf("Failed to get cluster client ID %s err=%s", clusterID, err)
+			c.PartialFail("cluster", err)
 		} else {
 			// Namespace
 			log.Debugf("  Collecting namespaces")
@@ -77,6 +85,7 @@ func (p Project) Collect(c *CollectorOpts) interface{} {
 			nsCollection, err := clusterClient.Namespace.ListAll(&nsFilter)
 			if err != nil {
 				log.Errorf("Failed to get Namespaces for project %s err=%s", project.ID, err)
+				c.PartialFail("namespace", err)
 			} else {
 				totalNs := len(nsCollection.Data)
 				p.Ns.Update(totalNs)
@@ -89,6 +98,7 @@ func (p Project) Collect(c *CollectorOpts) interface{} {
 		projectClient, err := GetProjectClient(c, project.ID)
 		if err != nil {
 			log.Errorf("Failed to get project client ID %s err=%s", project.ID, err)
+			c.PartialFail("project", err)
 			continue
 		}
 
@@ -97,6 +107,7 @@ func (p Project) Collect(c *CollectorOpts) interface{} {
 		wlCollection, err := projectClient.Workload.ListAll(&nonRemoved)
 		if err != nil {
 			log.Errorf("Failed to get Workload for project %s err=%s", project.ID, err)
+			c.PartialFail("workload", err)
 		} else {
 			totalWl := len(wlCollection.Data)
 			p.Workload.Update(totalWl)
@@ -109,6 +120,7 @@ func (p Project) Collect(c *CollectorOpts) interface{} {
 		pipelineCollection, err := projectClient.Pipeline.ListAll(&nonRemoved)
 		if err != nil {
 			log.Errorf("Failed to get Pipelines for project %s err=%s", project.ID, err)
+			c.PartialFail("pipeline", err)
 		} else {
 			p.Pipeline.TotalPipelines += len(pipelineCollection.Data)
 			log.Debugf("    Found %d Pipelines", p.Pipeline.TotalPipelines)
@@ -119,6 +131,7 @@ func (p Project) Collect(c *CollectorOpts) interface{} {
 		sourceCollection, err := projectClient.SourceCodeProvider.ListAll(&nonRemoved)
 		if err != nil {
 			log.Errorf("Failed to get SourceCodeProvider for project %s err=%s", project.ID, err)
+			c.PartialFail("sourceCodeProvider", err)
 		} else {
 			p.Pipeline.Enabled = 1
 			for _, provider := range sourceCollection.Data {
@@ -132,6 +145,7 @@ func (p Project) Collect(c *CollectorOpts) interface{} {
 		hpaCollection, err := projectClient.HorizontalPodAutoscaler.ListAll(&nonRemoved)
 		if err != nil {
 			log.Errorf("Failed to get HPA for project %s err=%s", project.ID, err)
+			c.PartialFail("hpa", err)
 		} else {
 			totalHPAs := len(hpaCollection.Data)
 			p.HPA.Update(totalHPAs)
@@ -144,6 +158,7 @@ func (p Project) Collect(c *CollectorOpts) interface{} {
 		poCollection, err := projectClient.Pod.ListAll(&nonRemoved)
 		if err != nil {
 			log.Errorf("Failed to get Pod for project %s err=%s", project.ID, err)
+			c.PartialFail("pod", err)
 		} else {
 			totalPo := len(poCollection.Data)
 			p.Pod.Update(totalPo)
@@ -159,6 +174,7 @@ func (p Project) Collect(c *CollectorOpts) interface{} {
 				appsCollection, err := projectClient.App.ListAll(&nonRemoved)
 				if err != nil {
 					log.Errorf("Failed to get Apps for project %s err=%s", project.ID, err)
+					c.PartialFail("app", err)
 				} else {
 					for _, app := range appsCollection.Data {
 						catalog, catalogType, template, err := SplitExternalID(app.ExternalID)
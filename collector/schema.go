@@ -0,0 +1,35 @@
+package collector
+
+import (
+	"github.com/rancher/telemetry/record"
+)
+
+// RecordSchema describes a whole record of the current version, with one section per registered collector
+func RecordSchema() *record.Schema {
+	s := &record.Schema{
+		Type: "object",
+		Properties: map[string]*record.Schema{
+			"r":  {Type: "integer"},
+			"ts": {Type: "string"},
+		},
+		Required: []string{"r", "install"},
+	}
+
+	for _, c := range registered {
+		section := record.SchemaFor(c)
+		// Collectors that fail leave their section empty
+		section.Nullable = true
+		s.Properties[c.RecordKey()] = section
+	}
+
+	s.Properties[MetaRecordKey] = record.SchemaFor(map[string]*Meta{})
+
+	// The server keys everything on the install uid
+	if install, ok := s.Properties[Installation{}.RecordKey()]; ok {
+		install.Nullable = false
+		install.Required = []string{"uid"}
+		install.Properties["uid"].MinLength = 1
+	}
+
+	return s
+}
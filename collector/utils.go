@@ -25,7 +25,7 @@ type CpuInfo struct {
 
 func (c *CpuInfo) Update(total, util int) {
 	c.CoresMin = MinButNotZero(c.CoresMin, total)
-	c.CoresMax = Max(c.CoresMin, total)
+	c.CoresMax = Max(c.CoresMax, total)
 	c.CoresTotal += total
 	c.UtilMin = MinButNotZero(c.UtilMin, util)
 	c.UtilMax = Max(c.UtilMax, util)
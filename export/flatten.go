@@ -0,0 +1,147 @@
+package export
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+)
+
+const (
+	TypeNumber = "number"
+	TypeBool   = "bool"
+	TypeString = "string"
+)
+
+// Flatten turns a record or result into one level of dotted paths like cluster.cpu.cores_total,
+// with list items numbered like node.0.name. Empty maps and lists are left out.
+func Flatten(v interface{}) map[string]interface{} {
+	out := map[string]interface{}{}
+	flatten("", v, out)
+	return out
+}
+
+func flatten(prefix string, v interface{}, out map[string]interface{}) {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for k, child := range value {
+			flatten(join(prefix, k), child, out)
+		}
+	case []interface{}:
+		for i, child := range value {
+			flatten(join(prefix, strconv.Itoa(i)), child, out)
+		}
+	case nil, string, bool, float64:
+		if prefix != "" {
+			out[prefix] = value
+		}
+	default:
+		// Structs, typed maps and other numbers are walked in their JSON form
+		b, err := json.Marshal(value)
+		if err != nil {
+			return
+		}
+		var plain interface{}
+		if err = json.Unmarshal(b, &plain); err != nil {
+			return
+		}
+		flatten(prefix, plain, out)
+	}
+}
+
+func join(prefix string, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
+
+// Column is a flattened path and the type of its values; paths holding values of several types
+// are strings
+type Column struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// Columns collects the columns of flattened rows in a stable order: the leading ones given, then
+// the others sorted by name
+type Columns struct {
+	leading []string
+	types   map[string]string
+}
+
+func NewColumns(leading ...string) *Columns {
+	return &Columns{leading: leading, types: map[string]string{}}
+}
+
+func (c *Columns) Add(row map[string]interface{}) {
+	for name, v := range row {
+		typ := valueType(v)
+		cur, ok := c.types[name]
+		switch {
+		case !ok || cur == "":
+			c.types[name] = typ
+		case typ != "" && typ != cur:
+			c.types[name] = TypeString
+		}
+	}
+}
+
+func (c *Columns) List() []Column {
+	out := []Column{}
+	seen := map[string]bool{}
+	for _, name := range c.leading {
+		out = append(out, Column{Name: name, Type: columnType(c.types[name])})
+		seen[name] = true
+	}
+
+	names := []string{}
+	for name := range c.types {
+		if !seen[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		out = append(out, Column{Name: name, Type: columnType(c.types[name])})
+	}
+	return out
+}
+
+// valueType returns the type of a flattened value, or "" for null
+func valueType(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return ""
+	case float64:
+		return TypeNumber
+	case bool:
+		return TypeBool
+	}
+	return TypeString
+}
+
+// columnType is a string for columns that only held nulls
+func columnType(typ string) string {
+	if typ == "" {
+		return TypeString
+	}
+	return typ
+}
+
+// text returns a flattened value as it is written to CSV and string columns
+func text(v interface{}) string {
+	switch value := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(value)
+	}
+
+	b, _ := json.Marshal(v)
+	return string(b)
+}
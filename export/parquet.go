@@ -0,0 +1,413 @@
+package export
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// Rows are buffered by column and written as a row group every this many rows
+const ParquetRowGroupRows = 10000
+
+// Parquet types, encodings and other values from parquet.thrift
+const (
+	parquetBoolean   = 0
+	parquetDouble    = 5
+	parquetByteArray = 6
+
+	parquetUTF8     = 0
+	parquetRequired = 0
+	parquetOptional = 1
+	parquetPlain    = 0
+	parquetRLE      = 3
+	parquetDataPage = 0
+)
+
+var parquetMagic = []byte("PAR1")
+
+// parquetWriter writes an uncompressed Parquet file with a flat schema of optional columns, one
+// data page per column in each row group
+type parquetWriter struct {
+	w         *countingWriter
+	columns   []*parquetColumn
+	rows      int
+	rowGroups []parquetRowGroup
+	total     int64
+	err       error
+}
+
+type parquetColumn struct {
+	Column
+	typ    int32
+	defs   []bool
+	bools  []bool
+	values bytes.Buffer
+}
+
+type parquetRowGroup struct {
+	rows    int64
+	size    int64
+	columns []parquetChunk
+}
+
+type parquetChunk struct {
+	offset int64
+	size   int64
+	values int64
+}
+
+func newParquetWriter(w io.Writer, columns []Column) *parquetWriter {
+	p := &parquetWriter{w: &countingWriter{w: w}}
+	for _, col := range columns {
+		c := &parquetColumn{Column: col, typ: parquetByteArray}
+		switch col.Type {
+		case TypeNumber:
+			c.typ = parquetDouble
+		case TypeBool:
+			c.typ = parquetBoolean
+		}
+		p.columns = append(p.columns, c)
+	}
+
+	_, p.err = p.w.Write(parquetMagic)
+	return p
+}
+
+func (p *parquetWriter) Write(row map[string]interface{}) error {
+	if p.err != nil {
+		return p.err
+	}
+
+	for _, c := range p.columns {
+		c.add(row[c.Name])
+	}
+	p.rows++
+
+	if p.rows >= ParquetRowGroupRows {
+		p.err = p.flush()
+	}
+	return p.err
+}
+
+// add appends a value, or a null when it doesn't fit the column's type
+func (c *parquetColumn) add(v interface{}) {
+	switch c.typ {
+	case parquetDouble:
+		n, ok := v.(float64)
+		c.defs = append(c.defs, ok)
+		if ok {
+			binary.Write(&c.values, binary.LittleEndian, math.Float64bits(n))
+		}
+	case parquetBoolean:
+		b, ok := v.(bool)
+		c.defs = append(c.defs, ok)
+		if ok {
+			c.bools = append(c.bools, b)
+		}
+	default:
+		c.defs = append(c.defs, v != nil)
+		if v != nil {
+			s := text(v)
+			binary.Write(&c.values, binary.LittleEndian, uint32(len(s)))
+			c.values.WriteString(s)
+		}
+	}
+}
+
+// flush writes the buffered rows as a row group
+func (p *parquetWriter) flush() error {
+	if p.rows == 0 {
+		return nil
+	}
+
+	group := parquetRowGroup{rows: int64(p.rows)}
+	for _, c := range p.columns {
+		data := c.page()
+		header := parquetPageHeader(len(c.defs), len(data))
+
+		chunk := parquetChunk{offset: p.w.n, size: int64(len(header) + len(data)), values: int64(len(c.defs))}
+		if _, err := p.w.Write(header); err != nil {
+			return err
+		}
+		if _, err := p.w.Write(data); err != nil {
+			return err
+		}
+
+		group.size += chunk.size
+		group.columns = append(group.columns, chunk)
+
+		c.defs = c.defs[:0]
+		c.bools = c.bools[:0]
+		c.values.Reset()
+	}
+
+	p.rowGroups = append(p.rowGroups, group)
+	p.total += int64(p.rows)
+	p.rows = 0
+	return nil
+}
+
+// page returns the data of a page: the definition levels, then the values that aren't null
+func (c *parquetColumn) page() []byte {
+	var out bytes.Buffer
+
+	// Definition levels are 0 for null and 1 for a value, in runs of the RLE/bit-packing hybrid
+	levels := []byte{}
+	for i := 0; i < len(c.defs); {
+		j := i
+		for j < len(c.defs) && c.defs[j] == c.defs[i] {
+			j++
+		}
+		levels = appendUvarint(levels, uint64(j-i)<<1)
+		if c.defs[i] {
+			levels = append(levels, 1)
+		} else {
+			levels = append(levels, 0)
+		}
+		i = j
+	}
+	binary.Write(&out, binary.LittleEndian, uint32(len(levels)))
+	out.Write(levels)
+
+	if c.typ == parquetBoolean {
+		packed := make([]byte, (len(c.bools)+7)/8)
+		for i, b := range c.bools {
+			if b {
+				packed[i/8] |= 1 << uint(i%8)
+			}
+		}
+		out.Write(packed)
+	} else {
+		out.Write(c.values.Bytes())
+	}
+
+	return out.Bytes()
+}
+
+func (p *parquetWriter) Close() error {
+	if p.err != nil {
+		return p.err
+	}
+	if err := p.flush(); err != nil {
+		return err
+	}
+
+	footer := p.footer()
+	if _, err := p.w.Write(footer); err != nil {
+		return err
+	}
+	if err := binary.Write(p.w, binary.LittleEndian, uint32(len(footer))); err != nil {
+		return err
+	}
+	_, err := p.w.Write(parquetMagic)
+	return err
+}
+
+// footer returns the FileMetaData of the file, with the fields Apache Arrow's writer sets
+func (p *parquetWriter) footer() []byte {
+	t := newThrift()
+	t.i32(1, 1)
+
+	t.list(2, thriftStruct, len(p.columns)+1)
+	t.elem()
+	t.i32(3, parquetRequired)
+	t.binary(4, "schema")
+	t.i32(5, int32(len(p.columns)))
+	t.end()
+	for _, c := range p.columns {
+		t.elem()
+		t.i32(1, c.typ)
+		t.i32(3, parquetOptional)
+		t.binary(4, c.Name)
+		if c.typ == parquetByteArray {
+			t.i32(6, parquetUTF8)
+			// The STRING logical type
+			t.begin(10)
+			t.begin(1)
+			t.end()
+			t.end()
+		}
+		t.end()
+	}
+
+	t.i64(3, p.total)
+
+	t.list(4, thriftStruct, len(p.rowGroups))
+	for g, group := range p.rowGroups {
+		t.elem()
+		t.list(1, thriftStruct, len(group.columns))
+		for i, chunk := range group.columns {
+			c := p.columns[i]
+			t.elem()
+			t.i64(2, 0)
+			t.begin(3)
+			t.i32(1, c.typ)
+			t.list(2, thriftI32, 2)
+			t.varint(zigzag(parquetPlain))
+			t.varint(zigzag(parquetRLE))
+			t.list(3, thriftBinary, 1)
+			t.string(c.Name)
+			t.i32(4, 0) // uncompressed
+			t.i64(5, chunk.values)
+			t.i64(6, chunk.size)
+			t.i64(7, chunk.size)
+			t.i64(9, chunk.offset)
+			// One plain data page
+			t.list(13, thriftStruct, 1)
+			t.elem()
+			t.i32(1, parquetDataPage)
+			t.i32(2, parquetPlain)
+			t.i32(3, 1)
+			t.end()
+			t.end()
+			t.end()
+		}
+		t.i64(2, group.size)
+		t.i64(3, group.rows)
+		t.i64(5, group.columns[0].offset)
+		t.i64(6, group.size)
+		t.i16(7, int16(g))
+		t.end()
+	}
+
+	t.binary(6, "telemetry")
+
+	// Columns sort by their type
+	t.list(7, thriftStruct, len(p.columns))
+	for range p.columns {
+		t.elem()
+		t.begin(1)
+		t.end()
+		t.end()
+	}
+	t.end()
+	return t.buf.Bytes()
+}
+
+// parquetPageHeader returns the PageHeader of an uncompressed data page
+func parquetPageHeader(values int, size int) []byte {
+	t := newThrift()
+	t.i32(1, parquetDataPage)
+	t.i32(2, int32(size))
+	t.i32(3, int32(size))
+	t.begin(5)
+	t.i32(1, int32(values))
+	t.i32(2, parquetPlain)
+	t.i32(3, parquetRLE)
+	t.i32(4, parquetRLE)
+	// No statistics
+	t.begin(5)
+	t.end()
+	t.end()
+	t.end()
+	return t.buf.Bytes()
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// Thrift compact protocol types
+const (
+	thriftI16    = 4
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thrift writes structs in the Thrift compact protocol, which Parquet metadata is encoded with.
+// Fields must be written in the order of their ids within each struct.
+type thrift struct {
+	buf  bytes.Buffer
+	last []int16
+}
+
+func newThrift() *thrift {
+	return &thrift{last: []int16{0}}
+}
+
+func (t *thrift) field(id int16, typ byte) {
+	last := &t.last[len(t.last)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		t.buf.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		t.buf.WriteByte(typ)
+		t.varint(zigzag(int64(id)))
+	}
+	*last = id
+}
+
+func (t *thrift) i16(id int16, v int16) {
+	t.field(id, thriftI16)
+	t.varint(zigzag(int64(v)))
+}
+
+func (t *thrift) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.varint(zigzag(int64(v)))
+}
+
+func (t *thrift) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.varint(zigzag(v))
+}
+
+func (t *thrift) binary(id int16, s string) {
+	t.field(id, thriftBinary)
+	t.string(s)
+}
+
+func (t *thrift) string(s string) {
+	t.varint(uint64(len(s)))
+	t.buf.WriteString(s)
+}
+
+// list starts a list field; its elements follow, structs each between elem and end
+func (t *thrift) list(id int16, typ byte, n int) {
+	t.field(id, thriftList)
+	if n < 15 {
+		t.buf.WriteByte(byte(n)<<4 | typ)
+	} else {
+		t.buf.WriteByte(0xf0 | typ)
+		t.varint(uint64(n))
+	}
+}
+
+// begin starts a struct field, ended by end
+func (t *thrift) begin(id int16) {
+	t.field(id, thriftStruct)
+	t.elem()
+}
+
+func (t *thrift) elem() {
+	t.last = append(t.last, 0)
+}
+
+func (t *thrift) end() {
+	t.buf.WriteByte(0)
+	t.last = t.last[:len(t.last)-1]
+}
+
+func (t *thrift) varint(v uint64) {
+	t.buf.Write(appendUvarint(nil, v))
+}
+
+func zigzag(v int64) uint64 {
+	return uint64(v<<1) ^ uint64(v>>63)
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(b, tmp[:n]...)
+}
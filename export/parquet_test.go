@@ -0,0 +1,548 @@
+package export
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestParquetRoundTrip writes rows and reads them back with parquetFile, a reader following the
+// format specification rather than the writer: a generic Thrift compact decoder for the metadata,
+// and the RLE/bit-packing hybrid and plain encodings for the pages.
+func TestParquetRoundTrip(t *testing.T) {
+	columns := []Column{
+		{Name: "install.uid", Type: TypeString},
+		{Name: "cluster.total", Type: TypeNumber},
+		{Name: "flags.ha", Type: TypeBool},
+		{Name: "node.os.ubuntu 20.04", Type: TypeNumber},
+		{Name: "never", Type: TypeString},
+	}
+
+	// Enough rows for three row groups, the last one short
+	n := 2*ParquetRowGroupRows + 3
+	rows := make([]map[string]interface{}, n)
+	for i := range rows {
+		row := map[string]interface{}{
+			"install.uid":   fmt.Sprintf("uid-%d-é", i),
+			"cluster.total": float64(i) / 4,
+			"flags.ha":      i%3 == 0,
+		}
+		switch {
+		case i%7 == 0:
+			delete(row, "cluster.total")
+		case i%11 == 0:
+			// A value not of the column's type is a null
+			row["cluster.total"] = "many"
+		}
+		if i%5 == 0 {
+			row["flags.ha"] = nil
+		}
+		if i%2 == 0 {
+			row["node.os.ubuntu 20.04"] = -float64(i)
+		}
+		rows[i] = row
+	}
+
+	var buf bytes.Buffer
+	w, err := NewWriter(FormatParquet, &buf, columns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range rows {
+		if err = w.Write(row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := readParquet(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{}
+	for _, c := range columns {
+		names = append(names, c.Name)
+	}
+	if !reflect.DeepEqual(f.names, names) {
+		t.Errorf("Columns: got %q, want %q", f.names, names)
+	}
+	if f.groups != 3 {
+		t.Errorf("Row groups: got %d, want 3", f.groups)
+	}
+	if len(f.rows) != n {
+		t.Fatalf("Rows: got %d, want %d", len(f.rows), n)
+	}
+
+	for i, row := range rows {
+		want := map[string]interface{}{}
+		for _, c := range columns {
+			v := row[c.Name]
+			if v == nil || valueType(v) != c.Type {
+				continue
+			}
+			want[c.Name] = v
+		}
+		if !reflect.DeepEqual(f.rows[i], want) {
+			t.Fatalf("Row %d: got %v, want %v", i, f.rows[i], want)
+		}
+	}
+}
+
+func TestParquetEmpty(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(FormatParquet, &buf, []Column{{Name: "install.uid", Type: TypeString}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := readParquet(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.groups != 0 || len(f.rows) != 0 {
+		t.Errorf("Empty file: got %d row groups and %d rows", f.groups, len(f.rows))
+	}
+}
+
+// TestParquetReference writes the rows of testdata/reference.parquet, which Apache Arrow's writer
+// wrote from them with testdata/reference, and expects the same bytes. The reader used by the
+// other tests must read the same rows from it.
+func TestParquetReference(t *testing.T) {
+	ref, err := ioutil.ReadFile(filepath.Join("testdata", "reference.parquet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	columns := []Column{
+		{Name: "install.uid", Type: TypeString},
+		{Name: "cluster.total", Type: TypeNumber},
+		{Name: "flags.ha", Type: TypeBool},
+	}
+	rows := make([]map[string]interface{}, 24)
+	for i := range rows {
+		rows[i] = map[string]interface{}{}
+		if i < 8 || i >= 16 {
+			rows[i]["install.uid"] = fmt.Sprintf("uid-%d-é", i)
+		}
+		if i >= 8 {
+			rows[i]["cluster.total"] = float64(i)/4 - float64(i%2)*1e10
+		}
+		if i < 16 {
+			rows[i]["flags.ha"] = i%3 == 0
+		}
+	}
+
+	var buf bytes.Buffer
+	w, err := NewWriter(FormatParquet, &buf, columns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range rows {
+		if err = w.Write(row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := buf.Bytes(); !bytes.Equal(got, ref) {
+		for i := range got {
+			if i >= len(ref) || got[i] != ref[i] {
+				t.Errorf("Got %d bytes, reference %d, first difference at %d", len(got), len(ref), i)
+				break
+			}
+		}
+	}
+
+	f, err := readParquet(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(f.rows, rows) {
+		t.Errorf("Reference rows: got %v, want %v", f.rows, rows)
+	}
+}
+
+type parquetFile struct {
+	names  []string
+	groups int
+	rows   []map[string]interface{}
+}
+
+// readParquet reads a file of optional flat columns of uncompressed data pages, checking its
+// metadata agrees with its contents
+func readParquet(b []byte) (*parquetFile, error) {
+	if len(b) < 12 || string(b[:4]) != "PAR1" || string(b[len(b)-4:]) != "PAR1" {
+		return nil, fmt.Errorf("Missing magic")
+	}
+	size := int(binary.LittleEndian.Uint32(b[len(b)-8:]))
+	if size > len(b)-12 {
+		return nil, fmt.Errorf("Footer of %d bytes in a file of %d", size, len(b))
+	}
+	footerAt := len(b) - 8 - size
+	r := &thriftReader{b: b[footerAt : len(b)-8]}
+	meta := r.readStruct()
+	if r.err != nil {
+		return nil, fmt.Errorf("Footer: %s", r.err)
+	}
+	if r.pos != size {
+		return nil, fmt.Errorf("Footer is %d bytes, read %d", size, r.pos)
+	}
+
+	// Schema: the root, then a leaf per column
+	schema := meta.list(2)
+	if len(schema) == 0 || schema[0].(thriftFields).int(5) != int64(len(schema)-1) {
+		return nil, fmt.Errorf("Root has the wrong number of children")
+	}
+	out := &parquetFile{}
+	types := []int64{}
+	for _, e := range schema[1:] {
+		el := e.(thriftFields)
+		if el.int(3) != parquetOptional {
+			return nil, fmt.Errorf("Column %s is not optional", el.str(4))
+		}
+		typ := el.int(1)
+		if _, ok := el[6]; ok != (typ == parquetByteArray) || (ok && el.int(6) != parquetUTF8) {
+			return nil, fmt.Errorf("Column %s of type %d has converted type %v", el.str(4), typ, el[6])
+		}
+		out.names = append(out.names, el.str(4))
+		types = append(types, typ)
+	}
+
+	groups := meta.list(4)
+	out.groups = len(groups)
+	offset := int64(4)
+	for g, group := range groups {
+		rg := group.(thriftFields)
+		n := int(rg.int(3))
+		rows := make([]map[string]interface{}, n)
+		for i := range rows {
+			rows[i] = map[string]interface{}{}
+		}
+
+		chunks := rg.list(1)
+		if len(chunks) != len(out.names) {
+			return nil, fmt.Errorf("Row group %d has %d columns", g, len(chunks))
+		}
+		var total int64
+		for c, chunk := range chunks {
+			md := chunk.(thriftFields).strct(3)
+			name := out.names[c]
+			path := md.list(3)
+			if len(path) != 1 || path[0] != name || md.int(1) != types[c] || md.int(4) != 0 {
+				return nil, fmt.Errorf("Row group %d: column %d metadata %v", g, c, md)
+			}
+			if md.int(9) != offset || md.int(6) != md.int(7) || md.int(5) != int64(n) {
+				return nil, fmt.Errorf("Row group %d: column %s at %d of %d bytes and %d values, expected at %d",
+					g, name, md.int(9), md.int(7), md.int(5), offset)
+			}
+
+			pr := &thriftReader{b: b[offset:footerAt]}
+			header := pr.readStruct()
+			if pr.err != nil {
+				return nil, fmt.Errorf("Row group %d: column %s page header: %s", g, name, pr.err)
+			}
+			dp := header.strct(5)
+			if header.int(1) != parquetDataPage || header.int(2) != header.int(3) || dp.int(1) != int64(n) ||
+				dp.int(2) != parquetPlain || dp.int(3) != parquetRLE {
+				return nil, fmt.Errorf("Row group %d: column %s page header %v", g, name, header)
+			}
+			start := offset + int64(pr.pos)
+			end := start + header.int(2)
+			if end-offset != md.int(7) {
+				return nil, fmt.Errorf("Row group %d: column %s page ends at %d, chunk at %d", g, name, end, offset+md.int(7))
+			}
+
+			values, err := readPage(b[start:end], types[c], n)
+			if err != nil {
+				return nil, fmt.Errorf("Row group %d: column %s: %s", g, name, err)
+			}
+			for i, v := range values {
+				if v != nil {
+					rows[i][name] = v
+				}
+			}
+
+			offset = end
+			total += md.int(7)
+		}
+		if rg.int(2) != total {
+			return nil, fmt.Errorf("Row group %d is %d bytes, columns are %d", g, rg.int(2), total)
+		}
+		out.rows = append(out.rows, rows...)
+	}
+
+	if offset != int64(footerAt) {
+		return nil, fmt.Errorf("Pages end at %d, footer starts at %d", offset, footerAt)
+	}
+	if meta.int(3) != int64(len(out.rows)) {
+		return nil, fmt.Errorf("Footer has %d rows, row groups %d", meta.int(3), len(out.rows))
+	}
+	return out, nil
+}
+
+// readPage decodes a data page of n values: the definition levels, then the values that are set
+func readPage(b []byte, typ int64, n int) ([]interface{}, error) {
+	if len(b) < 4 {
+		return nil, fmt.Errorf("Short page")
+	}
+	size := int(binary.LittleEndian.Uint32(b))
+	if 4+size > len(b) {
+		return nil, fmt.Errorf("Definition levels overrun the page")
+	}
+	levels, err := readHybrid(b[4:4+size], 1, n)
+	if err != nil {
+		return nil, err
+	}
+	b = b[4+size:]
+
+	set := 0
+	for _, l := range levels {
+		set += l
+	}
+
+	values := []interface{}{}
+	switch typ {
+	case parquetDouble:
+		if len(b) != 8*set {
+			return nil, fmt.Errorf("%d bytes for %d doubles", len(b), set)
+		}
+		for i := 0; i < set; i++ {
+			values = append(values, math.Float64frombits(binary.LittleEndian.Uint64(b[8*i:])))
+		}
+	case parquetBoolean:
+		if len(b) != (set+7)/8 {
+			return nil, fmt.Errorf("%d bytes for %d booleans", len(b), set)
+		}
+		for i := 0; i < set; i++ {
+			values = append(values, b[i/8]&(1<<uint(i%8)) != 0)
+		}
+	case parquetByteArray:
+		for len(b) > 0 {
+			if len(b) < 4 {
+				return nil, fmt.Errorf("Short byte array length")
+			}
+			l := int(binary.LittleEndian.Uint32(b))
+			if 4+l > len(b) {
+				return nil, fmt.Errorf("Byte array overruns the page")
+			}
+			values = append(values, string(b[4:4+l]))
+			b = b[4+l:]
+		}
+		if len(values) != set {
+			return nil, fmt.Errorf("%d byte arrays for %d values", len(values), set)
+		}
+	default:
+		return nil, fmt.Errorf("Unexpected type %d", typ)
+	}
+
+	out := make([]interface{}, n)
+	for i, l := range levels {
+		if l == 1 {
+			out[i] = values[0]
+			values = values[1:]
+		}
+	}
+	return out, nil
+}
+
+// readHybrid decodes n values of the RLE/bit-packing hybrid encoding
+func readHybrid(b []byte, width uint, n int) ([]int, error) {
+	out := []int{}
+	bytesPerValue := int(width+7) / 8
+	for len(out) < n {
+		header, l := binary.Uvarint(b)
+		if l <= 0 {
+			return nil, fmt.Errorf("Bad run header")
+		}
+		b = b[l:]
+
+		if header&1 == 0 {
+			// A run of one value
+			if len(b) < bytesPerValue {
+				return nil, fmt.Errorf("Short run")
+			}
+			v := 0
+			for i := 0; i < bytesPerValue; i++ {
+				v |= int(b[i]) << uint(8*i)
+			}
+			b = b[bytesPerValue:]
+			for i := uint64(0); i < header>>1; i++ {
+				out = append(out, v)
+			}
+			continue
+		}
+
+		// Groups of 8 bit-packed values
+		count := int(header>>1) * 8
+		size := count * int(width) / 8
+		if len(b) < size {
+			return nil, fmt.Errorf("Short bit-packed run")
+		}
+		for i := 0; i < count; i++ {
+			v := 0
+			for j := uint(0); j < width; j++ {
+				bit := uint(i)*width + j
+				if b[bit/8]&(1<<(bit%8)) != 0 {
+					v |= 1 << j
+				}
+			}
+			out = append(out, v)
+		}
+		b = b[size:]
+	}
+
+	if len(out) < n || len(b) != 0 {
+		return nil, fmt.Errorf("%d levels and %d bytes left for %d values", len(out), len(b), n)
+	}
+	return out[:n], nil
+}
+
+// thriftFields is a decoded struct, by field id
+type thriftFields map[int16]interface{}
+
+func (s thriftFields) int(id int16) int64 {
+	v, _ := s[id].(int64)
+	return v
+}
+
+func (s thriftFields) str(id int16) string {
+	v, _ := s[id].(string)
+	return v
+}
+
+func (s thriftFields) list(id int16) []interface{} {
+	v, _ := s[id].([]interface{})
+	return v
+}
+
+func (s thriftFields) strct(id int16) thriftFields {
+	v, _ := s[id].(thriftFields)
+	return v
+}
+
+// thriftReader decodes the Thrift compact protocol, any field of any type
+type thriftReader struct {
+	b   []byte
+	pos int
+	err error
+}
+
+func (r *thriftReader) byte() byte {
+	if r.pos >= len(r.b) {
+		if r.err == nil {
+			r.err = fmt.Errorf("Unexpected end at %d", r.pos)
+		}
+		return 0
+	}
+	r.pos++
+	return r.b[r.pos-1]
+}
+
+func (r *thriftReader) uvarint() uint64 {
+	var v uint64
+	for shift := uint(0); shift < 64; shift += 7 {
+		c := r.byte()
+		v |= uint64(c&0x7f) << shift
+		if c < 0x80 {
+			return v
+		}
+	}
+	r.err = fmt.Errorf("Bad varint at %d", r.pos)
+	return 0
+}
+
+func (r *thriftReader) varint() int64 {
+	v := r.uvarint()
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+func (r *thriftReader) readStruct() thriftFields {
+	out := thriftFields{}
+	var id int16
+	for r.err == nil {
+		c := r.byte()
+		if c == 0 {
+			return out
+		}
+		if delta := int16(c >> 4); delta != 0 {
+			id += delta
+		} else {
+			id = int16(r.varint())
+		}
+
+		typ := c & 0x0f
+		switch typ {
+		case 1, 2:
+			// Booleans are in the field type
+			out[id] = typ == 1
+		default:
+			out[id] = r.read(typ)
+		}
+	}
+	return out
+}
+
+func (r *thriftReader) read(typ byte) interface{} {
+	switch typ {
+	case 1:
+		return r.byte() == 1
+	case 3:
+		return int64(int8(r.byte()))
+	case 4, 5, 6:
+		return r.varint()
+	case 7:
+		var v uint64
+		for i := uint(0); i < 8; i++ {
+			v |= uint64(r.byte()) << (8 * i)
+		}
+		return math.Float64frombits(v)
+	case 8:
+		n := int(r.uvarint())
+		if r.err != nil || n > len(r.b)-r.pos {
+			r.err = fmt.Errorf("Binary overruns at %d", r.pos)
+			return ""
+		}
+		r.pos += n
+		return string(r.b[r.pos-n : r.pos])
+	case 9, 10:
+		c := r.byte()
+		n := int(c >> 4)
+		if n == 15 {
+			n = int(r.uvarint())
+		}
+		out := []interface{}{}
+		for i := 0; i < n && r.err == nil; i++ {
+			out = append(out, r.read(c&0x0f))
+		}
+		return out
+	case 11:
+		n := int(r.uvarint())
+		out := map[interface{}]interface{}{}
+		if n == 0 {
+			return out
+		}
+		kv := r.byte()
+		for i := 0; i < n && r.err == nil; i++ {
+			k := r.read(kv >> 4)
+			out[k] = r.read(kv & 0x0f)
+		}
+		return out
+	case 12:
+		return r.readStruct()
+	}
+	r.err = fmt.Errorf("Unknown type %d at %d", typ, r.pos)
+	return nil
+}
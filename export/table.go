@@ -0,0 +1,90 @@
+package export
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// KeyColumn holds the key of each row of a result that is a map of maps, like a day of the history
+const KeyColumn = "key"
+
+// Table turns an API result into flattened rows with their columns. A list, or the list a result
+// wraps like the rows of a query, gives a row per item; list names the one to use when there are
+// several, otherwise the first by name is. Maps of maps like the history give a row per key, and
+// anything else a single row.
+func Table(v interface{}, list string) ([]map[string]interface{}, []Column, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, nil, err
+	}
+	var plain interface{}
+	if err = json.Unmarshal(b, &plain); err != nil {
+		return nil, nil, err
+	}
+
+	if obj, ok := plain.(map[string]interface{}); ok {
+		keys := make([]string, 0, len(obj))
+		for k := range obj {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		if list != "" {
+			if _, ok := obj[list].([]interface{}); !ok {
+				return nil, nil, fmt.Errorf("The result has no list %s", list)
+			}
+			plain = obj[list]
+		} else {
+			for _, k := range keys {
+				if items, ok := obj[k].([]interface{}); ok {
+					plain = items
+					break
+				}
+			}
+		}
+	}
+
+	rows := []map[string]interface{}{}
+	columns := NewColumns()
+
+	switch value := plain.(type) {
+	case []interface{}:
+		for _, item := range value {
+			if _, ok := item.(map[string]interface{}); ok {
+				rows = append(rows, Flatten(item))
+			} else {
+				rows = append(rows, map[string]interface{}{"value": item})
+			}
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(value))
+		nested := len(value) > 0
+		for k, child := range value {
+			keys = append(keys, k)
+			if _, ok := child.(map[string]interface{}); !ok {
+				nested = false
+			}
+		}
+		sort.Strings(keys)
+
+		if !nested {
+			rows = append(rows, Flatten(value))
+			break
+		}
+
+		columns = NewColumns(KeyColumn)
+		for _, k := range keys {
+			row := Flatten(value[k])
+			row[KeyColumn] = k
+			rows = append(rows, row)
+		}
+	default:
+		rows = append(rows, map[string]interface{}{"value": value})
+	}
+
+	for _, row := range rows {
+		columns.Add(row)
+	}
+	return rows, columns.List(), nil
+}
@@ -0,0 +1,104 @@
+// Command reference writes ../reference.parquet with Apache Arrow's Parquet writer, set up like
+// the export writer: plain encoding, no dictionary, compression or statistics, and version 1 data
+// pages. TestParquetReference checks the export writer gives the same bytes for the same rows.
+//
+//	go run . ../reference.parquet
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/apache/arrow-go/v18/parquet"
+	"github.com/apache/arrow-go/v18/parquet/compress"
+	"github.com/apache/arrow-go/v18/parquet/file"
+	"github.com/apache/arrow-go/v18/parquet/schema"
+)
+
+// Rows is the number of rows, in which each column is null for a run of 8 rows
+const rows = 24
+
+func main() {
+	if len(os.Args) != 2 {
+		log.Fatal("usage: reference FILE")
+	}
+
+	uid, err := schema.NewPrimitiveNodeLogical("install.uid", parquet.Repetitions.Optional, schema.StringLogicalType{}, parquet.Types.ByteArray, 0, -1)
+	if err != nil {
+		log.Fatal(err)
+	}
+	total := schema.NewFloat64Node("cluster.total", parquet.Repetitions.Optional, -1)
+	ha := schema.NewBooleanNode("flags.ha", parquet.Repetitions.Optional, -1)
+	root, err := schema.NewGroupNode("schema", parquet.Repetitions.Required, schema.FieldList{uid, total, ha}, -1)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	props := parquet.NewWriterProperties(
+		parquet.WithDictionaryDefault(false),
+		parquet.WithEncoding(parquet.Encodings.Plain),
+		parquet.WithCompression(compress.Codecs.Uncompressed),
+		parquet.WithStats(false),
+		parquet.WithDataPageVersion(parquet.DataPageV1),
+		parquet.WithVersion(parquet.V1_0),
+		parquet.WithCreatedBy("telemetry"),
+	)
+
+	out, err := os.Create(os.Args[1])
+	if err != nil {
+		log.Fatal(err)
+	}
+	w := file.NewParquetWriter(out, root, file.WithWriterProps(props))
+	rg := w.AppendRowGroup()
+
+	// install.uid is null in the middle rows, cluster.total in the first and flags.ha in the last
+	uids, uidDefs := []parquet.ByteArray{}, levels(8, 16)
+	totals, totalDefs := []float64{}, levels(0, 8)
+	bools, boolDefs := []bool{}, levels(16, 24)
+	for i := 0; i < rows; i++ {
+		if uidDefs[i] == 1 {
+			uids = append(uids, parquet.ByteArray(fmt.Sprintf("uid-%d-é", i)))
+		}
+		if totalDefs[i] == 1 {
+			totals = append(totals, float64(i)/4-float64(i%2)*1e10)
+		}
+		if boolDefs[i] == 1 {
+			bools = append(bools, i%3 == 0)
+		}
+	}
+
+	cw, _ := rg.NextColumn()
+	if _, err = cw.(*file.ByteArrayColumnChunkWriter).WriteBatch(uids, uidDefs, nil); err != nil {
+		log.Fatal(err)
+	}
+	cw.Close()
+	cw, _ = rg.NextColumn()
+	if _, err = cw.(*file.Float64ColumnChunkWriter).WriteBatch(totals, totalDefs, nil); err != nil {
+		log.Fatal(err)
+	}
+	cw.Close()
+	cw, _ = rg.NextColumn()
+	if _, err = cw.(*file.BooleanColumnChunkWriter).WriteBatch(bools, boolDefs, nil); err != nil {
+		log.Fatal(err)
+	}
+	cw.Close()
+
+	if err = rg.Close(); err != nil {
+		log.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// levels returns the definition levels of a column that is null from row from up to row to
+func levels(from int, to int) []int16 {
+	out := make([]int16, rows)
+	for i := range out {
+		if i < from || i >= to {
+			out[i] = 1
+		}
+	}
+	return out
+}
@@ -0,0 +1,89 @@
+package export
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+const (
+	FormatCSV     = "csv"
+	FormatNDJSON  = "ndjson"
+	FormatParquet = "parquet"
+)
+
+var contentTypes = map[string]string{
+	FormatCSV:     "text/csv",
+	FormatNDJSON:  "application/x-ndjson",
+	FormatParquet: "application/vnd.apache.parquet",
+}
+
+// Writer writes flattened rows in one of the export formats
+type Writer interface {
+	Write(row map[string]interface{}) error
+	// Close writes anything buffered, without closing the underlying writer
+	Close() error
+}
+
+// NewWriter starts writing rows to w. CSV and Parquet only write the columns given, so they need
+// every column up front; NDJSON writes each row as it is.
+func NewWriter(format string, w io.Writer, columns []Column) (Writer, error) {
+	switch format {
+	case FormatCSV:
+		return newCSVWriter(w, columns)
+	case FormatNDJSON:
+		return &ndjsonWriter{enc: json.NewEncoder(w)}, nil
+	case FormatParquet:
+		return newParquetWriter(w, columns), nil
+	}
+	return nil, fmt.Errorf("Unknown format %s, known: csv, ndjson, parquet", format)
+}
+
+// ContentType returns the MIME type of a format, or "" for an unknown one
+func ContentType(format string) string {
+	return contentTypes[format]
+}
+
+// NeedsColumns says whether the writer of a format needs the columns before the first row
+func NeedsColumns(format string) bool {
+	return format != FormatNDJSON
+}
+
+type csvWriter struct {
+	w       *csv.Writer
+	columns []Column
+	line    []string
+}
+
+func newCSVWriter(w io.Writer, columns []Column) (*csvWriter, error) {
+	c := &csvWriter{w: csv.NewWriter(w), columns: columns, line: make([]string, len(columns))}
+	for i, col := range columns {
+		c.line[i] = col.Name
+	}
+	return c, c.w.Write(c.line)
+}
+
+func (c *csvWriter) Write(row map[string]interface{}) error {
+	for i, col := range c.columns {
+		c.line[i] = text(row[col.Name])
+	}
+	return c.w.Write(c.line)
+}
+
+func (c *csvWriter) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+type ndjsonWriter struct {
+	enc *json.Encoder
+}
+
+func (n *ndjsonWriter) Write(row map[string]interface{}) error {
+	return n.enc.Encode(row)
+}
+
+func (n *ndjsonWriter) Close() error {
+	return nil
+}
@@ -7,11 +7,13 @@ require (
 	github.com/gorilla/handlers v1.3.0
 	github.com/gorilla/mux v1.7.3
 	github.com/lib/pq v1.2.0
+	github.com/prometheus/client_golang v1.4.0
 	github.com/rancher/norman v0.0.0-20200930000340-693d65aaffe3
 	github.com/rancher/rancher/pkg/client v0.0.0-20201006004413-65f3525cdc11
 	github.com/satori/go.uuid v1.2.1-0.20181028125025-b2ce2384e17b
 	github.com/sirupsen/logrus v1.6.0
 	github.com/urfave/cli v1.20.0
 	github.com/urfave/negroni v1.0.0
+	go.etcd.io/bbolt v1.3.5
 	golang.org/x/crypto v0.0.0-20200220183623-bac4c82f6975
 )
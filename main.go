@@ -53,6 +53,12 @@ func main() {
 	app.Commands = []cli.Command{
 		cmd.ClientCommand(),
 		cmd.ServerCommand(),
+		cmd.ImportCommand(),
+		cmd.ExportCommand(),
+		cmd.MigrateCommand(),
+		cmd.AccountCommand(),
+		cmd.PruneCommand(),
+		cmd.ReplayCommand(),
 	}
 
 	app.Run(os.Args)
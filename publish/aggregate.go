@@ -0,0 +1,88 @@
+package publish
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The stores that don't speak SQL answer the aggregate queries by walking decoded records with
+// these, matching what the Postgres queries return.
+
+// fieldValue looks up a field like cluster.cpu.cores in a decoded record
+func fieldValue(data interface{}, field string) (interface{}, bool) {
+	cur := data
+	for _, part := range strings.Split(field, ".") {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+
+		cur, ok = m[part]
+		if !ok {
+			return nil, false
+		}
+	}
+
+	return cur, cur != nil
+}
+
+func numberValue(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	case int64:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	}
+
+	return 0, false
+}
+
+// textValue returns a value as Postgres' #>> would, strings as they are and anything else as JSON
+func textValue(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
+
+// groupRecordsByDay keeps the record with the highest id of each install on each day
+func groupRecordsByDay(records []ApiRecord) RecordsByDateByUid {
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Id > records[j].Id
+	})
+
+	out := make(RecordsByDateByUid)
+	for _, rec := range records {
+		day := rec.Ts.Format("2006-01-02")
+		byDate, ok := out[day]
+		if !ok {
+			byDate = make(RecordsByUid)
+			out[day] = byDate
+		}
+
+		if _, exists := byDate[rec.Uid]; !exists {
+			byDate[rec.Uid] = rec
+		}
+	}
+
+	return out
+}
+
+// daysAgo returns the start of the day the given number of days before today
+func daysAgo(days int) time.Time {
+	y, m, d := time.Now().Date()
+	return time.Date(y, m, d-days, 0, 0, 0, 0, time.Local)
+}
@@ -0,0 +1,330 @@
+package publish
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultCohortPeriods = 12
+	MaxCohortPeriods     = 104
+	CohortUnknown        = "unknown"
+)
+
+var (
+	cohortIntervals = map[string]bool{"week": true, "month": true}
+	cohortSplits    = map[string]bool{"": true, "version": true, "driver": true}
+)
+
+// CohortQuery groups installs by the week or month they were first seen in, and counts how many of
+// each group sent a record in each period after it
+type CohortQuery struct {
+	From     string `json:"from"`            // first day of the first cohort, defaults to Periods before To
+	To       string `json:"to"`              // last day of the last cohort, defaults to today
+	Interval string `json:"interval"`        // week or month, defaults to week
+	Periods  int    `json:"periods"`         // periods to follow each cohort for, defaults to 12
+	Split    string `json:"split,omitempty"` // version or driver of the first record, to split cohorts by
+
+	from  time.Time
+	to    time.Time
+	today time.Time
+}
+
+// Cohort is the installs first seen in a period. Active[n] counts those that sent a record n periods
+// later, the first being the cohort's own; periods still to come are left out.
+type Cohort struct {
+	Start     string    `json:"start"`
+	Split     string    `json:"split,omitempty"`
+	Size      int64     `json:"size"`
+	Active    []int64   `json:"active"`
+	Retention []float64 `json:"retention"`
+}
+
+type CohortResult struct {
+	Query   CohortQuery `json:"query"`
+	Cohorts []Cohort    `json:"cohorts"`
+}
+
+// Validate checks the query and fills in its defaults
+func (q *CohortQuery) Validate() error {
+	var err error
+
+	if q.Interval == "" {
+		q.Interval = "week"
+	}
+	if !cohortIntervals[q.Interval] {
+		return fmt.Errorf("Invalid interval %q, known: week, month", q.Interval)
+	}
+
+	if q.Periods == 0 {
+		q.Periods = DefaultCohortPeriods
+	}
+	if q.Periods < 1 || q.Periods > MaxCohortPeriods {
+		return fmt.Errorf("Periods must be between 1 and %d", MaxCohortPeriods)
+	}
+
+	if !cohortSplits[q.Split] {
+		return fmt.Errorf("Invalid split %q, known: version, driver", q.Split)
+	}
+
+	q.today = daysAgo(0)
+	q.to = q.today
+	if q.To != "" {
+		if q.to, err = time.ParseInLocation("2006-01-02", q.To, time.Local); err != nil {
+			return fmt.Errorf("Invalid to %q", q.To)
+		}
+	}
+
+	q.from = periodStart(q.Interval, q.to)
+	if q.Interval == "week" {
+		q.from = q.from.AddDate(0, 0, -7*q.Periods)
+	} else {
+		q.from = q.from.AddDate(0, -q.Periods, 0)
+	}
+	if q.From != "" {
+		if q.from, err = time.ParseInLocation("2006-01-02", q.From, time.Local); err != nil {
+			return fmt.Errorf("Invalid from %q", q.From)
+		}
+	}
+	// Cohorts are whole periods
+	q.from = periodStart(q.Interval, q.from)
+	if q.from.After(q.to) {
+		return fmt.Errorf("from is after to")
+	}
+	q.From = q.from.Format("2006-01-02")
+	q.To = q.to.Format("2006-01-02")
+
+	return nil
+}
+
+func (p *Postgres) Cohorts(q *CohortQuery) (*CohortResult, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+
+	offset := "(date_trunc('week', b.day)::date - c.start) / 7"
+	if q.Interval == "month" {
+		offset = "(EXTRACT(YEAR FROM b.day)::int - EXTRACT(YEAR FROM c.start)::int) * 12 + EXTRACT(MONTH FROM b.day)::int - EXTRACT(MONTH FROM c.start)::int"
+	}
+
+	first := ""
+	split := "''"
+	join := ""
+	if q.Split != "" {
+		splitSql := fieldText("r", "install.version")
+		if q.Split == "driver" {
+			// The driver most of the install's clusters use, counting anything but a number as none
+			// and breaking ties by name, as splitValue does
+			splitSql = `(SELECT jet.key
+		FROM jsonb_each(CASE WHEN jsonb_typeof(r.data #> '{cluster,driver}') = 'object' THEN r.data #> '{cluster,driver}' ELSE '{}'::jsonb END) AS jet
+		ORDER BY CASE WHEN jsonb_typeof(jet.value) = 'number' THEN (jet.value #>> '{}')::numeric ELSE 0 END DESC, jet.key COLLATE "C"
+		LIMIT 1)`
+		}
+
+		first = fmt.Sprintf(`,
+first AS (
+	SELECT DISTINCT ON (b.uid) b.uid, %s AS split
+	FROM cohort c
+		JOIN byday b ON (b.uid = c.uid)
+		JOIN record r ON (r.id = b.record_id)
+	ORDER BY b.uid, b.day
+)`, splitSql)
+		split = "COALESCE(f.split, '" + CohortUnknown + "')"
+		join = "\n\tLEFT JOIN first f ON (f.uid = c.uid)"
+	}
+
+	// Sizes come back as period -1
+	sql := `WITH cohort AS (
+	SELECT i.uid, date_trunc('%s', i.first_seen)::date AS start
+	FROM installation i
+	WHERE i.first_seen >= $1 AND i.first_seen < $2::date + 1
+)%s
+SELECT c.start, %s, -1, count(*)
+FROM cohort c%s
+GROUP BY 1, 2
+UNION ALL
+SELECT c.start, %s, %s, count(DISTINCT b.uid)
+FROM cohort c%s
+	JOIN byday b ON (b.uid = c.uid)
+WHERE b.day >= c.start AND b.day <= $3
+	AND b.day < c.start + ($4 + 1) * INTERVAL '1 %s'
+GROUP BY 1, 2, 3
+ORDER BY 1, 2, 3`
+
+	sql = fmt.Sprintf(sql, q.Interval, first, split, join, split, offset, join, q.Interval)
+	log.Debugf("Query: %s", sql)
+	rows, err := p.Conn.Query(sql, q.From, q.To, q.today.Format("2006-01-02"), q.Periods)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type group struct {
+		start  time.Time
+		split  string
+		size   int64
+		active map[int]int64
+	}
+
+	groups := []*group{}
+	for rows.Next() {
+		var start time.Time
+		var split string
+		var period int
+		var count int64
+
+		if err = rows.Scan(&start, &split, &period, &count); err != nil {
+			return nil, err
+		}
+
+		if period < 0 {
+			groups = append(groups, &group{start: start, split: split, size: count, active: map[int]int64{}})
+			continue
+		}
+		if len(groups) > 0 {
+			groups[len(groups)-1].active[period] = count
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	out := &CohortResult{Query: *q, Cohorts: []Cohort{}}
+	for _, g := range groups {
+		out.Cohorts = append(out.Cohorts, newCohort(q, g.start, g.split, g.size, g.active))
+	}
+	return out, nil
+}
+
+func newCohort(q *CohortQuery, start time.Time, split string, size int64, active map[int]int64) Cohort {
+	n := periodsBetween(q.Interval, start, periodStart(q.Interval, q.today)) + 1
+	if n > q.Periods+1 {
+		n = q.Periods + 1
+	}
+	if n < 0 {
+		n = 0
+	}
+
+	c := Cohort{
+		Start:     start.Format("2006-01-02"),
+		Split:     split,
+		Size:      size,
+		Active:    make([]int64, n),
+		Retention: make([]float64, n),
+	}
+	for i := range c.Active {
+		c.Active[i] = active[i]
+		if size > 0 {
+			c.Retention[i] = float64(active[i]) / float64(size)
+		}
+	}
+	return c
+}
+
+// periodsBetween counts the weeks or months from one period start to another
+func periodsBetween(interval string, from time.Time, to time.Time) int {
+	if interval == "month" {
+		return (to.Year()-from.Year())*12 + int(to.Month()) - int(from.Month())
+	}
+	return int(math.Round(to.Sub(from).Hours()/24)) / 7
+}
+
+// cohortInstall is an install of a cohort query with the days it sent records on, for the stores
+// that run queries in Go
+type cohortInstall struct {
+	start time.Time
+	days  []time.Time
+	first time.Time
+	data  interface{}
+}
+
+// add counts the install active on a day, keeping the data of its earliest record for the split
+func (c *cohortInstall) add(day time.Time, data interface{}) {
+	c.days = append(c.days, day)
+	if c.first.IsZero() || day.Before(c.first) {
+		c.first = day
+		c.data = data
+	}
+}
+
+// splitValue returns what a cohort is split by from the first record of an install, as the SQL does
+func (q *CohortQuery) splitValue(data interface{}) string {
+	switch q.Split {
+	case "":
+		return ""
+	case "version":
+		if v, ok := fieldValue(data, "install.version"); ok {
+			return textValue(v)
+		}
+	case "driver":
+		v, _ := fieldValue(data, "cluster.driver")
+		drivers, _ := v.(map[string]interface{})
+
+		best := ""
+		var most float64
+		for k, v := range drivers {
+			n, _ := numberValue(v)
+			if best == "" || n > most || (n == most && k < best) {
+				best = k
+				most = n
+			}
+		}
+		if best != "" {
+			return best
+		}
+	}
+	return CohortUnknown
+}
+
+// runCohorts answers a validated query from the installs first seen in its range, as
+// Postgres.Cohorts would
+func runCohorts(q *CohortQuery, installs map[string]*cohortInstall) *CohortResult {
+	type key struct {
+		start time.Time
+		split string
+	}
+
+	sizes := map[key]int64{}
+	actives := map[key]map[int]int64{}
+	for _, c := range installs {
+		k := key{periodStart(q.Interval, c.start), q.splitValue(c.data)}
+		sizes[k]++
+		if actives[k] == nil {
+			actives[k] = map[int]int64{}
+		}
+
+		periods := map[int]bool{}
+		for _, day := range c.days {
+			if day.Before(k.start) || day.After(q.today) {
+				continue
+			}
+			if n := periodsBetween(q.Interval, k.start, periodStart(q.Interval, day)); n <= q.Periods {
+				periods[n] = true
+			}
+		}
+		for n := range periods {
+			actives[k][n]++
+		}
+	}
+
+	keys := make([]key, 0, len(sizes))
+	for k := range sizes {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].start.Equal(keys[j].start) {
+			return keys[i].start.Before(keys[j].start)
+		}
+		return keys[i].split < keys[j].split
+	})
+
+	out := &CohortResult{Query: *q, Cohorts: []Cohort{}}
+	for _, k := range keys {
+		out.Cohorts = append(out.Cohorts, newCohort(q, k.start, k.split, sizes[k], actives[k]))
+	}
+	return out
+}
@@ -0,0 +1,103 @@
+package publish
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	record "github.com/rancher/telemetry/record"
+)
+
+func TestCohortValidate(t *testing.T) {
+	for _, q := range []CohortQuery{
+		{Interval: "day"},
+		{Periods: -1},
+		{Periods: MaxCohortPeriods + 1},
+		{Split: "os"},
+		{To: "10/05/2020"},
+		{From: "2020-10-13", To: "2020-10-05"},
+	} {
+		if err := q.Validate(); err == nil {
+			t.Errorf("%+v: got no error", q)
+		}
+	}
+
+	q := CohortQuery{Interval: "month", From: "2020-03-15", To: "2020-10-05"}
+	if err := q.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if q.From != "2020-03-01" || q.Periods != DefaultCohortPeriods {
+		t.Errorf("Defaults: got from %s and %d periods, want 2020-03-01 and %d", q.From, q.Periods, DefaultCohortPeriods)
+	}
+}
+
+func driverRecord(uid string, version string, drivers interface{}) record.Record {
+	return record.Record{
+		"r":       float64(record.VERSION),
+		"install": map[string]interface{}{"uid": uid, "version": version},
+		"cluster": map[string]interface{}{"driver": drivers},
+	}
+}
+
+// TestCohorts follows two weekly cohorts over the weeks up to now
+func TestCohorts(t *testing.T) {
+	// Monday three weeks ago, at noon so days don't move with the time zone
+	week := periodStart("week", daysAgo(0)).AddDate(0, 0, -21).Add(12 * time.Hour)
+	at := func(days int) time.Time { return week.AddDate(0, 0, days) }
+
+	reports := []struct {
+		rec record.Record
+		ts  time.Time
+	}{
+		// First week: a comes back for two weeks, b doesn't
+		{driverRecord("a", "v2.4.8", map[string]interface{}{"rke": float64(2), "imported": float64(1)}), at(1)},
+		{driverRecord("a", "v2.4.8", map[string]interface{}{"imported": float64(5)}), at(8)},
+		{driverRecord("a", "v2.5.1", nil), at(15)},
+		{driverRecord("b", "v2.5.1", map[string]interface{}{"imported": float64(1), "eks": "many"}), at(2)},
+		// Second week: c comes back this week, d doesn't
+		{driverRecord("c", "v2.5.1", "rke"), at(7)},
+		{driverRecord("c", "v2.5.1", "rke"), time.Now()},
+		{driverRecord("d", "v2.5.1", map[string]interface{}{"gke": "some", "aks": "some"}), at(10)},
+	}
+
+	tests := []struct {
+		split string
+		want  []Cohort
+	}{
+		{
+			split: "",
+			want: []Cohort{
+				{Start: at(0).Format("2006-01-02"), Size: 2, Active: []int64{2, 1, 1, 0}, Retention: []float64{1, 0.5, 0.5, 0}},
+				{Start: at(7).Format("2006-01-02"), Size: 2, Active: []int64{2, 0, 1}, Retention: []float64{1, 0, 0.5}},
+			},
+		},
+		{
+			split: "driver",
+			want: []Cohort{
+				{Start: at(0).Format("2006-01-02"), Split: "imported", Size: 1, Active: []int64{1, 0, 0, 0}, Retention: []float64{1, 0, 0, 0}},
+				{Start: at(0).Format("2006-01-02"), Split: "rke", Size: 1, Active: []int64{1, 1, 1, 0}, Retention: []float64{1, 1, 1, 0}},
+				// Ties and values that aren't counts go to the first name, no map to unknown
+				{Start: at(7).Format("2006-01-02"), Split: "aks", Size: 1, Active: []int64{1, 0, 0}, Retention: []float64{1, 0, 0}},
+				{Start: at(7).Format("2006-01-02"), Split: CohortUnknown, Size: 1, Active: []int64{1, 0, 1}, Retention: []float64{1, 0, 1}},
+			},
+		},
+	}
+
+	for name, s := range testStores(t) {
+		for _, r := range reports {
+			if err := s.ReportAt(r.rec, "127.0.0.1", r.ts); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for _, test := range tests {
+			res, err := s.Cohorts(&CohortQuery{From: at(0).Format("2006-01-02"), Periods: 4, Split: test.split})
+			if err != nil {
+				t.Fatalf("%s: %s", name, err)
+			}
+			if !reflect.DeepEqual(res.Cohorts, test.want) {
+				t.Errorf("%s split by %q: got %+v, want %+v", name, test.split, res.Cohorts, test.want)
+			}
+		}
+	}
+}
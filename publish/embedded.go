@@ -0,0 +1,779 @@
+package publish
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+
+	record "github.com/rancher/telemetry/record"
+)
+
+var (
+	bucketRecord     = []byte("record")
+	bucketRecordTs   = []byte("record_ts")
+	bucketRecordUid  = []byte("record_uid")
+	bucketInstall    = []byte("installation")
+	bucketByDay      = []byte("byday")
+	bucketAccount    = []byte("account")
+	bucketInstallKey = []byte("install_key")
+	bucketNonce      = []byte("nonce")
+	bucketNonceTs    = []byte("nonce_ts")
+)
+
+// Embedded keeps everything in a single local file, for running the server without Postgres. It is
+// meant for small deployments, tests and CI: records are indexed by time, by install and by day,
+// but install queries go through every install and aggregations decode the records they cover.
+type Embedded struct {
+	db *bolt.DB
+}
+
+type storedRecord struct {
+	Id   int64           `json:"id"`
+	Uid  string          `json:"uid"`
+	Ts   time.Time       `json:"ts"`
+	Data json.RawMessage `json:"data"`
+}
+
+type storedInstall struct {
+	Id         int64     `json:"id"`
+	Uid        string    `json:"uid"`
+	FirstSeen  time.Time `json:"first_seen"`
+	LastSeen   time.Time `json:"last_seen"`
+	LastIp     string    `json:"last_ip"`
+	LastRecord int64     `json:"last_record"`
+}
+
+func NewEmbedded(path string) (*Embedded, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		indexNonces := tx.Bucket(bucketNonceTs) == nil
+		indexRecords := tx.Bucket(bucketRecordTs) == nil
+		for _, name := range [][]byte{bucketRecord, bucketRecordTs, bucketRecordUid, bucketInstall, bucketByDay, bucketAccount, bucketInstallKey, bucketNonce, bucketNonceTs} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+
+		// Files from before the indexes have their nonces and records indexed once
+		if indexNonces {
+			index := tx.Bucket(bucketNonceTs)
+			err := tx.Bucket(bucketNonce).ForEach(func(k, v []byte) error {
+				return index.Put(append(append([]byte{}, v...), k...), []byte{})
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if indexRecords {
+			return tx.Bucket(bucketRecord).ForEach(func(k, v []byte) error {
+				var rec storedRecord
+				if err := json.Unmarshal(v, &rec); err != nil {
+					return err
+				}
+				return indexRecord(tx, rec)
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	log.Infof("Using embedded storage at %s", path)
+	return &Embedded{db: db}, nil
+}
+
+func idKey(id int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(id))
+	return b
+}
+
+// byDayKey sorts by day, so a range of days is a range of keys
+func byDayKey(day string, uid string) []byte {
+	return []byte(day + "/" + uid)
+}
+
+// recordTsKey sorts by time then id, so the records since a time are a range of keys
+func recordTsKey(ts time.Time, id int64) []byte {
+	return append(idKey(ts.UnixNano()), idKey(id)...)
+}
+
+// recordUidKey sorts by install, then as recordTsKey
+func recordUidKey(uid string, ts time.Time, id int64) []byte {
+	return append([]byte(uid+"/"), recordTsKey(ts, id)...)
+}
+
+// indexRecord adds a record to the time and install indexes, which point at its id
+func indexRecord(tx *bolt.Tx, rec storedRecord) error {
+	if err := tx.Bucket(bucketRecordTs).Put(recordTsKey(rec.Ts, rec.Id), idKey(rec.Id)); err != nil {
+		return err
+	}
+	return tx.Bucket(bucketRecordUid).Put(recordUidKey(rec.Uid, rec.Ts, rec.Id), idKey(rec.Id))
+}
+
+func (e *Embedded) Close() error {
+	return e.db.Close()
+}
+
+func (e *Embedded) Report(r record.Record, clientIp string) error {
+	return e.ReportAt(r, clientIp, time.Now())
+}
+
+// ReportAt stores a record as received at ts, with the same rules as Postgres.ReportAt: the install
+// keeps the newest record and each day the newest record of that day
+func (e *Embedded) ReportAt(r record.Record, clientIp string, ts time.Time) error {
+	install, _ := r["install"].(map[string]interface{})
+	uid, _ := install["uid"].(string)
+	if uid == "" {
+		return errors.New("Record has no install uid")
+	}
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	return e.db.Update(func(tx *bolt.Tx) error {
+		records := tx.Bucket(bucketRecord)
+		seq, err := records.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		rec := storedRecord{Id: int64(seq), Uid: uid, Ts: ts, Data: data}
+		if err = putJSON(records, idKey(rec.Id), rec); err != nil {
+			return err
+		}
+		if err = indexRecord(tx, rec); err != nil {
+			return err
+		}
+
+		installs := tx.Bucket(bucketInstall)
+		var i storedInstall
+		found, err := getJSON(installs, []byte(uid), &i)
+		if err != nil {
+			return err
+		}
+
+		if !found {
+			seq, err := installs.NextSequence()
+			if err != nil {
+				return err
+			}
+			i = storedInstall{Id: int64(seq), Uid: uid, FirstSeen: ts, LastSeen: ts, LastIp: clientIp, LastRecord: rec.Id}
+		} else {
+			if ts.Before(i.FirstSeen) {
+				i.FirstSeen = ts
+			}
+			if !ts.Before(i.LastSeen) {
+				i.LastSeen = ts
+				i.LastIp = clientIp
+				i.LastRecord = rec.Id
+			}
+		}
+
+		if err = putJSON(installs, []byte(uid), i); err != nil {
+			return err
+		}
+
+		byDay := tx.Bucket(bucketByDay)
+		key := byDayKey(ts.Local().Format("2006-01-02"), uid)
+		if cur := byDay.Get(key); cur != nil {
+			var prev storedRecord
+			found, err := getJSON(records, cur, &prev)
+			if err != nil {
+				return err
+			}
+			if found && prev.Ts.After(ts) {
+				return nil
+			}
+		}
+
+		return byDay.Put(key, idKey(rec.Id))
+	})
+}
+
+func putJSON(b *bolt.Bucket, key []byte, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, data)
+}
+
+func getJSON(b *bolt.Bucket, key []byte, v interface{}) (bool, error) {
+	data := b.Get(key)
+	if data == nil {
+		return false, nil
+	}
+	return true, json.Unmarshal(data, v)
+}
+
+func (e *Embedded) Ping() error {
+	return e.db.View(func(tx *bolt.Tx) error {
+		return nil
+	})
+}
+
+func (e *Embedded) installs() ([]storedInstall, error) {
+	out := []storedInstall{}
+	err := e.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketInstall).ForEach(func(k, v []byte) error {
+			var i storedInstall
+			if err := json.Unmarshal(v, &i); err != nil {
+				return err
+			}
+			out = append(out, i)
+			return nil
+		})
+	})
+	return out, err
+}
+
+// activeRecords returns the installs seen within the last hours whose last records match the
+// filters, with their last records
+func (e *Embedded) activeRecords(hours int, filters []Filter) ([]ApiInstallation, error) {
+	installs, err := e.installs()
+	if err != nil {
+		return nil, err
+	}
+
+	since := time.Now().Add(-time.Duration(hours) * time.Hour)
+	out := []ApiInstallation{}
+
+	err = e.db.View(func(tx *bolt.Tx) error {
+		records := tx.Bucket(bucketRecord)
+		for _, i := range installs {
+			if i.LastSeen.Before(since) {
+				continue
+			}
+
+			var rec storedRecord
+			found, err := getJSON(records, idKey(i.LastRecord), &rec)
+			if err != nil {
+				return err
+			}
+			if !found {
+				continue
+			}
+
+			api := ApiInstallation{Id: i.Id, Uid: i.Uid, FirstSeen: i.FirstSeen, LastSeen: i.LastSeen, LastIp: i.LastIp}
+			if err = json.Unmarshal(rec.Data, &api.Record); err != nil {
+				return err
+			}
+			if !matchFilters(api.Record, filters) {
+				continue
+			}
+			out = append(out, api)
+		}
+		return nil
+	})
+
+	return out, err
+}
+
+func (e *Embedded) GetAllInstalls(filters []Filter) ([]ApiInstallation, error) {
+	installs, err := e.installs()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(filters) > 0 {
+		installs, err = e.matchLastRecords(installs, filters)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Slice(installs, func(i, j int) bool {
+		return installs[i].FirstSeen.Before(installs[j].FirstSeen)
+	})
+
+	out := []ApiInstallation{}
+	for _, i := range installs {
+		out = append(out, ApiInstallation{Id: i.Id, Uid: i.Uid, FirstSeen: i.FirstSeen, LastSeen: i.LastSeen, LastIp: i.LastIp})
+	}
+
+	return out, nil
+}
+
+// matchLastRecords keeps the installs whose last records match the filters
+func (e *Embedded) matchLastRecords(installs []storedInstall, filters []Filter) ([]storedInstall, error) {
+	out := []storedInstall{}
+	err := e.db.View(func(tx *bolt.Tx) error {
+		records := tx.Bucket(bucketRecord)
+		for _, i := range installs {
+			var rec storedRecord
+			found, err := getJSON(records, idKey(i.LastRecord), &rec)
+			if err != nil {
+				return err
+			}
+			if !found {
+				continue
+			}
+
+			var data interface{}
+			if err = json.Unmarshal(rec.Data, &data); err != nil {
+				return err
+			}
+			if matchFilters(data, filters) {
+				out = append(out, i)
+			}
+		}
+		return nil
+	})
+
+	return out, err
+}
+
+func (e *Embedded) GetActiveInstalls(hours int, filters []Filter) ([]ApiInstallation, error) {
+	return e.activeRecords(hours, filters)
+}
+
+func (e *Embedded) CountActiveInstalls(hours int) (int64, error) {
+	installs, err := e.installs()
+	if err != nil {
+		return 0, err
+	}
+
+	since := time.Now().Add(-time.Duration(hours) * time.Hour)
+	var count int64
+	for _, i := range installs {
+		if !i.LastSeen.Before(since) {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+func (e *Embedded) GetActiveCountByDay(filters []Filter) (AggregatedFields, error) {
+	out := make(AggregatedFields)
+	err := e.db.View(func(tx *bolt.Tx) error {
+		records := tx.Bucket(bucketRecord)
+		return tx.Bucket(bucketByDay).ForEach(func(k, v []byte) error {
+			day := strings.SplitN(string(k), "/", 2)[0]
+			if len(filters) == 0 {
+				out[day]++
+				return nil
+			}
+
+			var rec storedRecord
+			found, err := getJSON(records, v, &rec)
+			if err != nil || !found {
+				return err
+			}
+
+			var data interface{}
+			if err = json.Unmarshal(rec.Data, &data); err != nil {
+				return err
+			}
+			if matchFilters(data, filters) {
+				out[day]++
+			}
+			return nil
+		})
+	})
+	return out, err
+}
+
+// records returns the records received since the start of the day the given days ago that match the
+// filters, for one install or all of them
+func (e *Embedded) records(days int, uid string, filters []Filter) ([]ApiRecord, error) {
+	since := daysAgo(days)
+	out := []ApiRecord{}
+
+	// Either index holds the record ids in time order, from a prefix on
+	index, prefix := bucketRecordTs, []byte{}
+	if uid != "" {
+		index, prefix = bucketRecordUid, []byte(uid+"/")
+	}
+
+	err := e.db.View(func(tx *bolt.Tx) error {
+		records := tx.Bucket(bucketRecord)
+		c := tx.Bucket(index).Cursor()
+		for k, v := c.Seek(append(prefix, idKey(since.UnixNano())...)); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var rec storedRecord
+			found, err := getJSON(records, v, &rec)
+			if err != nil {
+				return err
+			}
+			if !found {
+				continue
+			}
+
+			api := ApiRecord{Id: rec.Id, Uid: rec.Uid, Ts: rec.Ts}
+			if err := json.Unmarshal(rec.Data, &api.Record); err != nil {
+				return err
+			}
+			if matchFilters(api.Record, filters) {
+				out = append(out, api)
+			}
+		}
+		return nil
+	})
+
+	return out, err
+}
+
+func (e *Embedded) GetRecordsGroupedByDay(days int, filters []Filter) (RecordsByDateByUid, error) {
+	records, err := e.records(days, "", filters)
+	if err != nil {
+		return nil, err
+	}
+
+	return groupRecordsByDay(records), nil
+}
+
+func (e *Embedded) GetRecordsByUid(uid string, days int) ([]ApiRecord, error) {
+	records, err := e.records(days, uid, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Id > records[j].Id
+	})
+
+	return records, nil
+}
+
+func (e *Embedded) GetRecordById(id string) (ApiRecord, error) {
+	var out ApiRecord
+
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return out, err
+	}
+
+	err = e.db.View(func(tx *bolt.Tx) error {
+		var rec storedRecord
+		found, err := getJSON(tx.Bucket(bucketRecord), idKey(n), &rec)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return ErrNotFound
+		}
+
+		out = ApiRecord{Id: rec.Id, Uid: rec.Uid, Ts: rec.Ts}
+		return json.Unmarshal(rec.Data, &out.Record)
+	})
+
+	return out, err
+}
+
+// eachRecordBatch is how many records EachRecordByDay reads in each transaction. fn is called
+// between transactions, so a slow caller doesn't hold one open, which would stop the file growing.
+const eachRecordBatch = 500
+
+func (e *Embedded) EachRecordByDay(days int, filters []Filter, fn func(day string, rec ApiRecord) error) error {
+	type dayApiRecord struct {
+		day string
+		rec ApiRecord
+	}
+
+	from := byDayKey(daysAgo(days).Format("2006-01-02"), "")
+	for from != nil {
+		batch := []dayApiRecord{}
+		err := e.db.View(func(tx *bolt.Tx) error {
+			records := tx.Bucket(bucketRecord)
+			c := tx.Bucket(bucketByDay).Cursor()
+			k, v := c.Seek(from)
+			for n := 0; k != nil && n < eachRecordBatch; k, v = c.Next() {
+				n++
+
+				var rec storedRecord
+				found, err := getJSON(records, v, &rec)
+				if err != nil {
+					return err
+				}
+				if !found {
+					continue
+				}
+
+				api := ApiRecord{Id: rec.Id, Uid: rec.Uid, Ts: rec.Ts}
+				if err = json.Unmarshal(rec.Data, &api.Record); err != nil {
+					return err
+				}
+				if !matchFilters(api.Record, filters) {
+					continue
+				}
+
+				batch = append(batch, dayApiRecord{day: strings.SplitN(string(k), "/", 2)[0], rec: api})
+			}
+
+			// Keys are only valid in the transaction
+			from = nil
+			if k != nil {
+				from = append([]byte{}, k...)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, r := range batch {
+			if err = fn(r.day, r.rec); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (e *Embedded) Query(q *Query) (*QueryResult, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+
+	records := []dayRecord{}
+	err := e.db.View(func(tx *bolt.Tx) error {
+		recs := tx.Bucket(bucketRecord)
+		c := tx.Bucket(bucketByDay).Cursor()
+		for k, v := c.Seek(byDayKey(q.From, "")); k != nil; k, v = c.Next() {
+			parts := strings.SplitN(string(k), "/", 2)
+			if parts[0] > q.To {
+				break
+			}
+
+			day, err := time.ParseInLocation("2006-01-02", parts[0], time.Local)
+			if err != nil {
+				return err
+			}
+
+			var rec storedRecord
+			found, err := getJSON(recs, v, &rec)
+			if err != nil {
+				return err
+			}
+			if !found {
+				continue
+			}
+
+			var data interface{}
+			if err = json.Unmarshal(rec.Data, &data); err != nil {
+				return err
+			}
+			records = append(records, dayRecord{Day: day, Uid: parts[1], Ts: rec.Ts, Data: data})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return runQuery(q, records), nil
+}
+
+func (e *Embedded) Cohorts(q *CohortQuery) (*CohortResult, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+
+	all, err := e.installs()
+	if err != nil {
+		return nil, err
+	}
+
+	installs := map[string]*cohortInstall{}
+	for _, i := range all {
+		day := i.FirstSeen.Format("2006-01-02")
+		if day < q.From || day > q.To {
+			continue
+		}
+
+		t, err := time.ParseInLocation("2006-01-02", day, time.Local)
+		if err != nil {
+			return nil, err
+		}
+		installs[i.Uid] = &cohortInstall{start: t}
+	}
+
+	err = e.db.View(func(tx *bolt.Tx) error {
+		recs := tx.Bucket(bucketRecord)
+		c := tx.Bucket(bucketByDay).Cursor()
+		for k, v := c.Seek(byDayKey(q.From, "")); k != nil; k, v = c.Next() {
+			parts := strings.SplitN(string(k), "/", 2)
+			install, ok := installs[parts[1]]
+			if !ok {
+				continue
+			}
+
+			day, err := time.ParseInLocation("2006-01-02", parts[0], time.Local)
+			if err != nil {
+				return err
+			}
+
+			// Days come in order, so only the first record of each install is needed for the split
+			var data interface{}
+			if q.Split != "" && len(install.days) == 0 {
+				var rec storedRecord
+				found, err := getJSON(recs, v, &rec)
+				if err != nil {
+					return err
+				}
+				if found {
+					if err = json.Unmarshal(rec.Data, &data); err != nil {
+						return err
+					}
+				}
+			}
+			install.add(day, data)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return runCohorts(q, installs), nil
+}
+
+func (e *Embedded) Upgrades(q *UpgradeQuery) (*UpgradeResult, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+
+	installs := map[string][]versionDay{}
+	err := e.db.View(func(tx *bolt.Tx) error {
+		recs := tx.Bucket(bucketRecord)
+		c := tx.Bucket(bucketByDay).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			parts := strings.SplitN(string(k), "/", 2)
+			if parts[0] > q.To {
+				break
+			}
+
+			day, err := time.ParseInLocation("2006-01-02", parts[0], time.Local)
+			if err != nil {
+				return err
+			}
+
+			var rec storedRecord
+			found, err := getJSON(recs, v, &rec)
+			if err != nil {
+				return err
+			}
+			if !found {
+				continue
+			}
+
+			var data interface{}
+			if err = json.Unmarshal(rec.Data, &data); err != nil {
+				return err
+			}
+			if version, ok := recordVersion(data); ok {
+				installs[parts[1]] = append(installs[parts[1]], versionDay{Day: day, Version: version})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return runUpgrades(q, installs), nil
+}
+
+func (e *Embedded) GetAccountHash(user string) (string, error) {
+	var hash string
+	err := e.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketAccount).Get([]byte(user))
+		if v == nil {
+			return ErrNotFound
+		}
+		hash = string(v)
+		return nil
+	})
+	return hash, err
+}
+
+func (e *Embedded) GetInstallKey(uid string) (string, error) {
+	var key string
+	err := e.db.View(func(tx *bolt.Tx) error {
+		key = string(tx.Bucket(bucketInstallKey).Get([]byte(uid)))
+		return nil
+	})
+	return key, err
+}
+
+func (e *Embedded) RegisterInstallKey(uid string, key string) (string, error) {
+	out := key
+	err := e.db.Update(func(tx *bolt.Tx) error {
+		keys := tx.Bucket(bucketInstallKey)
+		if cur := keys.Get([]byte(uid)); cur != nil {
+			out = string(cur)
+			return nil
+		}
+		return keys.Put([]byte(uid), []byte(key))
+	})
+	return out, err
+}
+
+func (e *Embedded) ResetInstallKey(uid string) error {
+	return e.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketInstallKey).Delete([]byte(uid))
+	})
+}
+
+func (e *Embedded) SetAccount(name string, hash string) error {
+	return e.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketAccount).Put([]byte(name), []byte(hash))
+	})
+}
+
+// UseNonce records a nonce under uid/nonce, with the time it was used. The nonce_ts bucket indexes
+// them by that time, so expired nonces are found without going through the others.
+func (e *Embedded) UseNonce(uid string, nonce string, window time.Duration) (bool, error) {
+	fresh := false
+	err := e.db.Update(func(tx *bolt.Tx) error {
+		nonces := tx.Bucket(bucketNonce)
+		index := tx.Bucket(bucketNonceTs)
+
+		expired := idKey(time.Now().Add(-2 * window).UnixNano())
+		old := [][]byte{}
+		c := index.Cursor()
+		for k, _ := c.First(); k != nil && bytes.Compare(k[:8], expired) < 0; k, _ = c.Next() {
+			old = append(old, append([]byte{}, k...))
+		}
+
+		for _, k := range old {
+			if err := index.Delete(k); err != nil {
+				return err
+			}
+			if err := nonces.Delete(k[8:]); err != nil {
+				return err
+			}
+		}
+
+		key := []byte(uid + "/" + nonce)
+		if nonces.Get(key) != nil {
+			return nil
+		}
+
+		fresh = true
+		ts := idKey(time.Now().UnixNano())
+		if err := nonces.Put(key, ts); err != nil {
+			return err
+		}
+		return index.Put(append(append([]byte{}, ts...), key...), []byte{})
+	})
+	return fresh, err
+}
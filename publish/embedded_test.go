@@ -0,0 +1,133 @@
+package publish
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	record "github.com/rancher/telemetry/record"
+)
+
+// TestEmbeddedEachRecordByDay reads more records than fit in one batch, over two days
+func TestEmbeddedEachRecordByDay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "telemetry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	e, err := NewEmbedded(filepath.Join(dir, "telemetry.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	n := eachRecordBatch + eachRecordBatch/2
+	now := time.Now()
+	for _, ts := range []time.Time{now.AddDate(0, 0, -1), now} {
+		for i := 0; i < n; i++ {
+			r := record.Record{
+				"r":       float64(record.VERSION),
+				"install": map[string]interface{}{"uid": fmt.Sprintf("uid-%04d", i)},
+				"cluster": map[string]interface{}{"total": float64(i % 2)},
+			}
+			if err = e.ReportAt(r, "127.0.0.1", ts); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	filters := []Filter{{Field: "cluster.total", Op: "=", Value: float64(1)}}
+	seen := map[string]bool{}
+	last := ""
+	err = e.EachRecordByDay(2, filters, func(day string, rec ApiRecord) error {
+		key := day + "/" + rec.Uid
+		if key <= last {
+			return fmt.Errorf("%s after %s", key, last)
+		}
+		last = key
+		seen[key] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 2*(n/2) {
+		t.Errorf("Records: got %d, want %d", len(seen), 2*(n/2))
+	}
+}
+
+// TestEmbeddedRecordIndexes reads records by time and install from the indexes, including those
+// built when opening a file from before them
+func TestEmbeddedRecordIndexes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "telemetry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "telemetry.db")
+
+	e, err := NewEmbedded(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	for _, uid := range []string{"a", "b"} {
+		for _, days := range []int{10, 1, 0} {
+			r := record.Record{"r": float64(record.VERSION), "install": map[string]interface{}{"uid": uid}}
+			if err = e.ReportAt(r, "127.0.0.1", now.AddDate(0, 0, -days)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	check := func(e *Embedded) {
+		t.Helper()
+		recs, err := e.GetRecordsByUid("a", 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(recs) != 2 || recs[0].Uid != "a" || recs[1].Uid != "a" || !recs[0].Ts.After(recs[1].Ts) {
+			t.Errorf("Records of a for 2 days: got %v", recs)
+		}
+
+		byDay, err := e.GetRecordsGroupedByDay(2, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for _, byUid := range byDay {
+			n += len(byUid)
+		}
+		if n != 4 {
+			t.Errorf("Records for 2 days: got %d, want 4", n)
+		}
+	}
+	check(e)
+
+	// Drop the indexes, as in a file written before them
+	err = e.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketRecordTs, bucketRecordUid} {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Close()
+
+	if e, err = NewEmbedded(path); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	check(e)
+}
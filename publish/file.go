@@ -0,0 +1,242 @@
+package publish
+
+import (
+	"encoding/json"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+
+	record "github.com/rancher/telemetry/record"
+)
+
+const rotatedFormat = "20060102-150405.000"
+
+// Writer publishes each record as a line of JSON
+type Writer struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func NewWriter(out io.Writer) *Writer {
+	return &Writer{out: out}
+}
+
+func (p *Writer) Report(r record.Record, clientIp string) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	_, err = p.out.Write(append(b, '\n'))
+	return err
+}
+
+// RotatingFile is a file that is renamed aside once it gets too big or its period is over, keeping
+// the rotated files for a limited time or number. Periods are windows of maxAge, e.g. days for 24h,
+// and a write in a later one than the file's last write rotates it, which the modification time
+// tells across restarts. Writes are never split across files.
+type RotatingFile struct {
+	path    string
+	maxSize int64
+	maxAge  time.Duration
+	keep    int
+	retain  time.Duration
+
+	f        *os.File
+	size     int64
+	modified time.Time
+}
+
+// NewRotatingFile opens path for appending, removing the rotated files past keep or retain. Zero
+// maxSize, maxAge, keep or retain disable that limit.
+func NewRotatingFile(path string, maxSize int64, maxAge time.Duration, keep int, retain time.Duration) (*RotatingFile, error) {
+	out := &RotatingFile{
+		path:    path,
+		maxSize: maxSize,
+		maxAge:  maxAge,
+		keep:    keep,
+		retain:  retain,
+	}
+
+	if err := out.open(); err != nil {
+		return nil, err
+	}
+	if err := out.cleanup(); err != nil {
+		log.Errorf("Error removing old rotated files of %s: %s", path, err)
+	}
+
+	return out, nil
+}
+
+func (f *RotatingFile) Write(b []byte) (int, error) {
+	now := time.Now()
+	if f.size > 0 {
+		oversize := f.maxSize > 0 && f.size+int64(len(b)) > f.maxSize
+		expired := f.maxAge > 0 && f.modified.Truncate(f.maxAge).Before(now.Truncate(f.maxAge))
+		if oversize || expired {
+			if err := f.rotate(); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	n, err := f.f.Write(b)
+	f.size += int64(n)
+	f.modified = now
+	return n, err
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.f = file
+	f.size = info.Size()
+	f.modified = info.ModTime()
+	return nil
+}
+
+func (f *RotatingFile) rotate() error {
+	if err := f.f.Close(); err != nil {
+		return err
+	}
+
+	rotated := f.path + "." + time.Now().UTC().Format(rotatedFormat)
+	if err := os.Rename(f.path, rotated); err != nil {
+		return err
+	}
+	log.Infof("Rotated %s to %s", f.path, rotated)
+
+	if err := f.cleanup(); err != nil {
+		log.Errorf("Error removing old rotated files of %s: %s", f.path, err)
+	}
+
+	return f.open()
+}
+
+// cleanup removes the rotated files last written before the retention window, and the oldest
+// beyond the number to keep
+func (f *RotatingFile) cleanup() error {
+	if f.keep <= 0 && f.retain <= 0 {
+		return nil
+	}
+
+	matches, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return err
+	}
+
+	rotated := []string{}
+	for _, match := range matches {
+		if _, err := time.Parse(rotatedFormat, strings.TrimPrefix(match, f.path+".")); err == nil {
+			rotated = append(rotated, match)
+		}
+	}
+
+	// The timestamp suffix sorts in time order
+	sort.Strings(rotated)
+
+	for f.retain > 0 && len(rotated) > 0 {
+		info, err := os.Stat(rotated[0])
+		if err != nil {
+			return err
+		}
+		if time.Since(info.ModTime()) <= f.retain {
+			break
+		}
+		if err := os.Remove(rotated[0]); err != nil {
+			return err
+		}
+		log.Infof("Removed rotated file %s past the retention", rotated[0])
+		rotated = rotated[1:]
+	}
+
+	for f.keep > 0 && len(rotated) > f.keep {
+		if err := os.Remove(rotated[0]); err != nil {
+			return err
+		}
+		log.Infof("Removed old rotated file %s", rotated[0])
+		rotated = rotated[1:]
+	}
+
+	return nil
+}
+
+// NewFile appends records to the file at path, rotating per the target's max-size (MB) and max-age
+// query parameters and removing rotated files per keep and retain, e.g.
+// file:///var/lib/telemetry/records.jsonl?max-size=10&max-age=24h&retain=720h
+func NewFile(target *url.URL) (*Writer, error) {
+	q := target.Query()
+
+	var maxSize int64
+	if str := q.Get("max-size"); str != "" {
+		mb, err := strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		maxSize = mb * 1024 * 1024
+	}
+
+	var maxAge time.Duration
+	if str := q.Get("max-age"); str != "" {
+		var err error
+		maxAge, err = time.ParseDuration(str)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var keep int
+	if str := q.Get("keep"); str != "" {
+		var err error
+		keep, err = strconv.Atoi(str)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var retain time.Duration
+	if str := q.Get("retain"); str != "" {
+		var err error
+		retain, err = time.ParseDuration(str)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := NewRotatingFile(target.Path, maxSize, maxAge, keep, retain)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewWriter(f), nil
+}
+
+func init() {
+	Register("file", func(c *cli.Context, target *url.URL) (Publisher, error) {
+		return NewFile(target)
+	})
+	Register("stdout", func(c *cli.Context, target *url.URL) (Publisher, error) {
+		return NewWriter(os.Stdout), nil
+	})
+}
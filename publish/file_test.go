@@ -0,0 +1,146 @@
+package publish
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testRotatingDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "rotating")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// rotatedFiles returns the contents of the files rotated from path, oldest first
+func rotatedFiles(t *testing.T, path string) []string {
+	t.Helper()
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(matches)
+
+	out := []string{}
+	for _, match := range matches {
+		if _, err := time.Parse(rotatedFormat, strings.TrimPrefix(match, path+".")); err != nil {
+			continue
+		}
+		b, err := ioutil.ReadFile(match)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, string(b))
+	}
+	return out
+}
+
+func writeLines(t *testing.T, f *RotatingFile, lines ...string) {
+	t.Helper()
+	for _, line := range lines {
+		if _, err := f.Write([]byte(line + "\n")); err != nil {
+			t.Fatal(err)
+		}
+		// Rotated files are named by the time they are rotated
+		time.Sleep(2 * time.Millisecond)
+	}
+}
+
+func TestRotatingFileSize(t *testing.T) {
+	path := filepath.Join(testRotatingDir(t), "records.jsonl")
+	f, err := NewRotatingFile(path, 10, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A write bigger than the limit still goes to one file
+	writeLines(t, f, "1234", "5678", "9", "123456789012")
+
+	if got, want := strings.Join(rotatedFiles(t, path), "|"), "1234\n5678\n|9\n"; got != want {
+		t.Errorf("Rotated: got %q, want %q", got, want)
+	}
+	if b, _ := ioutil.ReadFile(path); string(b) != "123456789012\n" {
+		t.Errorf("Current: got %q", b)
+	}
+}
+
+// TestRotatingFileAge rotates a file last written in an earlier period, as after a restart
+func TestRotatingFileAge(t *testing.T) {
+	path := filepath.Join(testRotatingDir(t), "records.jsonl")
+	if err := ioutil.WriteFile(path, []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := NewRotatingFile(path, 0, time.Hour, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Written within the hour, so kept
+	writeLines(t, f, "new")
+	if rotated := rotatedFiles(t, path); len(rotated) != 0 {
+		t.Fatalf("Rotated within the period: %q", rotated)
+	}
+
+	lastHour := time.Now().Add(-time.Hour)
+	if err = os.Chtimes(path, lastHour, lastHour); err != nil {
+		t.Fatal(err)
+	}
+	if f, err = NewRotatingFile(path, 0, time.Hour, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	writeLines(t, f, "next")
+
+	if got, want := strings.Join(rotatedFiles(t, path), "|"), "old\nnew\n"; got != want {
+		t.Errorf("Rotated: got %q, want %q", got, want)
+	}
+	if b, _ := ioutil.ReadFile(path); string(b) != "next\n" {
+		t.Errorf("Current: got %q", b)
+	}
+}
+
+func TestRotatingFilePrune(t *testing.T) {
+	path := filepath.Join(testRotatingDir(t), "records.jsonl")
+
+	// Rotated files written 3, 2 and 1 days ago, and one that isn't rotated
+	for days := 3; days > 0; days-- {
+		ts := time.Now().AddDate(0, 0, -days)
+		rotated := path + "." + ts.UTC().Format(rotatedFormat)
+		if err := ioutil.WriteFile(rotated, []byte(ts.Format("Jan 2\n")), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(rotated, ts, ts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	other := path + ".bak"
+	if err := ioutil.WriteFile(other, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Opening removes the files past the retention
+	f, err := NewRotatingFile(path, 5, 0, 0, 60*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated := rotatedFiles(t, path); len(rotated) != 2 {
+		t.Errorf("Within 60h: got %q", rotated)
+	}
+
+	// Rotating keeps the newest
+	f.keep = 2
+	writeLines(t, f, "1234", "5678")
+	want := []string{time.Now().AddDate(0, 0, -1).Format("Jan 2\n"), "1234\n"}
+	if got := rotatedFiles(t, path); strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("Keeping 2: got %q, want %q", got, want)
+	}
+
+	if _, err = os.Stat(other); err != nil {
+		t.Errorf("Other file: %s", err)
+	}
+}
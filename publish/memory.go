@@ -0,0 +1,427 @@
+package publish
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	record "github.com/rancher/telemetry/record"
+)
+
+// Memory keeps everything in memory, with the same semantics as Postgres. It is meant for tests and
+// trying the server out; nothing survives a restart.
+type Memory struct {
+	mu sync.Mutex
+
+	records  []ApiRecord
+	installs map[string]*storedInstall
+	byDay    map[string]map[string]int64
+	accounts map[string]string
+	keys     map[string]string
+	nonces   map[string]time.Time
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		installs: map[string]*storedInstall{},
+		byDay:    map[string]map[string]int64{},
+		accounts: map[string]string{},
+		keys:     map[string]string{},
+		nonces:   map[string]time.Time{},
+	}
+}
+
+func (m *Memory) Report(r record.Record, clientIp string) error {
+	return m.ReportAt(r, clientIp, time.Now())
+}
+
+// ReportAt follows Postgres.ReportAt: the install keeps the newest record and each day the newest
+// record of that day
+func (m *Memory) ReportAt(r record.Record, clientIp string, ts time.Time) error {
+	install, _ := r["install"].(map[string]interface{})
+	uid, _ := install["uid"].(string)
+	if uid == "" {
+		return errors.New("Record has no install uid")
+	}
+
+	// Round trip through JSON so the stored copy looks like one read back from a database
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	var data interface{}
+	if err = json.Unmarshal(b, &data); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rec := ApiRecord{Id: int64(len(m.records) + 1), Uid: uid, Ts: ts, Record: data}
+	m.records = append(m.records, rec)
+
+	i, ok := m.installs[uid]
+	if !ok {
+		m.installs[uid] = &storedInstall{
+			Id:         int64(len(m.installs) + 1),
+			Uid:        uid,
+			FirstSeen:  ts,
+			LastSeen:   ts,
+			LastIp:     clientIp,
+			LastRecord: rec.Id,
+		}
+	} else {
+		if ts.Before(i.FirstSeen) {
+			i.FirstSeen = ts
+		}
+		if !ts.Before(i.LastSeen) {
+			i.LastSeen = ts
+			i.LastIp = clientIp
+			i.LastRecord = rec.Id
+		}
+	}
+
+	day := ts.Local().Format("2006-01-02")
+	uids, ok := m.byDay[day]
+	if !ok {
+		uids = map[string]int64{}
+		m.byDay[day] = uids
+	}
+	if cur, ok := uids[uid]; !ok || !m.record(cur).Ts.After(ts) {
+		uids[uid] = rec.Id
+	}
+
+	return nil
+}
+
+func (m *Memory) record(id int64) ApiRecord {
+	return m.records[id-1]
+}
+
+func (m *Memory) Ping() error {
+	return nil
+}
+
+func (m *Memory) GetAllInstalls(filters []Filter) ([]ApiInstallation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out := []ApiInstallation{}
+	for _, i := range m.installs {
+		if !matchFilters(m.record(i.LastRecord).Record, filters) {
+			continue
+		}
+		out = append(out, ApiInstallation{Id: i.Id, Uid: i.Uid, FirstSeen: i.FirstSeen, LastSeen: i.LastSeen, LastIp: i.LastIp})
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].FirstSeen.Before(out[j].FirstSeen)
+	})
+
+	return out, nil
+}
+
+// active returns the installs seen within the last hours whose last records match the filters,
+// with their last records
+func (m *Memory) active(hours int, filters []Filter) []ApiInstallation {
+	since := time.Now().Add(-time.Duration(hours) * time.Hour)
+
+	out := []ApiInstallation{}
+	for _, i := range m.installs {
+		rec := m.record(i.LastRecord).Record
+		if i.LastSeen.Before(since) || !matchFilters(rec, filters) {
+			continue
+		}
+
+		out = append(out, ApiInstallation{
+			Id:        i.Id,
+			Uid:       i.Uid,
+			FirstSeen: i.FirstSeen,
+			LastSeen:  i.LastSeen,
+			LastIp:    i.LastIp,
+			Record:    rec,
+		})
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Id < out[j].Id
+	})
+
+	return out
+}
+
+func (m *Memory) GetActiveInstalls(hours int, filters []Filter) ([]ApiInstallation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.active(hours, filters), nil
+}
+
+func (m *Memory) CountActiveInstalls(hours int) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return int64(len(m.active(hours, nil))), nil
+}
+
+func (m *Memory) GetActiveCountByDay(filters []Filter) (AggregatedFields, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out := make(AggregatedFields)
+	for day, uids := range m.byDay {
+		for _, id := range uids {
+			if matchFilters(m.record(id).Record, filters) {
+				out[day]++
+			}
+		}
+	}
+	return out, nil
+}
+
+// since returns the records received since the start of the day the given days ago that match the
+// filters, for one install or all of them
+func (m *Memory) since(days int, uid string, filters []Filter) []ApiRecord {
+	from := daysAgo(days)
+
+	out := []ApiRecord{}
+	for _, rec := range m.records {
+		if rec.Ts.Before(from) || (uid != "" && rec.Uid != uid) || !matchFilters(rec.Record, filters) {
+			continue
+		}
+		out = append(out, rec)
+	}
+	return out
+}
+
+func (m *Memory) GetRecordsGroupedByDay(days int, filters []Filter) (RecordsByDateByUid, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return groupRecordsByDay(m.since(days, "", filters)), nil
+}
+
+func (m *Memory) GetRecordsByUid(uid string, days int) ([]ApiRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out := m.since(days, uid, nil)
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Id > out[j].Id
+	})
+	return out, nil
+}
+
+func (m *Memory) GetRecordById(id string) (ApiRecord, error) {
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return ApiRecord{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if n < 1 || n > int64(len(m.records)) {
+		return ApiRecord{}, ErrNotFound
+	}
+	return m.record(n), nil
+}
+
+func (m *Memory) EachRecordByDay(days int, filters []Filter, fn func(day string, rec ApiRecord) error) error {
+	type entry struct {
+		day string
+		rec ApiRecord
+	}
+
+	m.mu.Lock()
+	from := daysAgo(days).Format("2006-01-02")
+	records := []entry{}
+	for day, uids := range m.byDay {
+		if day < from {
+			continue
+		}
+		for _, id := range uids {
+			if rec := m.record(id); matchFilters(rec.Record, filters) {
+				records = append(records, entry{day, rec})
+			}
+		}
+	}
+	m.mu.Unlock()
+
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].day != records[j].day {
+			return records[i].day < records[j].day
+		}
+		return records[i].rec.Uid < records[j].rec.Uid
+	})
+
+	for _, r := range records {
+		if err := fn(r.day, r.rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Memory) Query(q *Query) (*QueryResult, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	records := []dayRecord{}
+	for day, uids := range m.byDay {
+		if day < q.From || day > q.To {
+			continue
+		}
+
+		t, err := time.ParseInLocation("2006-01-02", day, time.Local)
+		if err != nil {
+			return nil, err
+		}
+		for uid, id := range uids {
+			rec := m.record(id)
+			records = append(records, dayRecord{Day: t, Uid: uid, Ts: rec.Ts, Data: rec.Record})
+		}
+	}
+
+	return runQuery(q, records), nil
+}
+
+func (m *Memory) Cohorts(q *CohortQuery) (*CohortResult, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	installs := map[string]*cohortInstall{}
+	for uid, i := range m.installs {
+		day := i.FirstSeen.Format("2006-01-02")
+		if day < q.From || day > q.To {
+			continue
+		}
+
+		t, err := time.ParseInLocation("2006-01-02", day, time.Local)
+		if err != nil {
+			return nil, err
+		}
+		installs[uid] = &cohortInstall{start: t}
+	}
+
+	for day, uids := range m.byDay {
+		if day < q.From {
+			continue
+		}
+
+		t, err := time.ParseInLocation("2006-01-02", day, time.Local)
+		if err != nil {
+			return nil, err
+		}
+		for uid, id := range uids {
+			if c, ok := installs[uid]; ok {
+				c.add(t, m.record(id).Record)
+			}
+		}
+	}
+
+	return runCohorts(q, installs), nil
+}
+
+func (m *Memory) Upgrades(q *UpgradeQuery) (*UpgradeResult, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	installs := map[string][]versionDay{}
+	for day, uids := range m.byDay {
+		if day > q.To {
+			continue
+		}
+
+		t, err := time.ParseInLocation("2006-01-02", day, time.Local)
+		if err != nil {
+			return nil, err
+		}
+		for uid, id := range uids {
+			if version, ok := recordVersion(m.record(id).Record); ok {
+				installs[uid] = append(installs[uid], versionDay{Day: t, Version: version})
+			}
+		}
+	}
+
+	for _, days := range installs {
+		sort.Slice(days, func(i, j int) bool {
+			return days[i].Day.Before(days[j].Day)
+		})
+	}
+
+	return runUpgrades(q, installs), nil
+}
+
+func (m *Memory) GetAccountHash(user string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	hash, ok := m.accounts[user]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return hash, nil
+}
+
+func (m *Memory) SetAccount(name string, hash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.accounts[name] = hash
+	return nil
+}
+
+func (m *Memory) GetInstallKey(uid string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.keys[uid], nil
+}
+
+func (m *Memory) RegisterInstallKey(uid string, key string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.keys[uid]; !ok {
+		m.keys[uid] = key
+	}
+	return m.keys[uid], nil
+}
+
+func (m *Memory) ResetInstallKey(uid string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.keys, uid)
+	return nil
+}
+
+func (m *Memory) UseNonce(uid string, nonce string, window time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	expired := time.Now().Add(-2 * window)
+	for k, ts := range m.nonces {
+		if ts.Before(expired) {
+			delete(m.nonces, k)
+		}
+	}
+
+	key := uid + "/" + nonce
+	if _, ok := m.nonces[key]; ok {
+		return false, nil
+	}
+
+	m.nonces[key] = time.Now()
+	return true, nil
+}
@@ -0,0 +1,481 @@
+package publish
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// A SchemaMigration moves the database schema from Version-1 to Version and back
+type SchemaMigration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Migrations are applied in order, each in its own transaction. Never edit one that has been
+// released, add a new one instead.
+var Migrations = []SchemaMigration{
+	{
+		Version: 1,
+		Name:    "initial",
+		// IF NOT EXISTS adopts databases created by hand before migrations existed
+		Up: `
+			CREATE TABLE IF NOT EXISTS record (
+				id serial PRIMARY KEY,
+				uid varchar(255) NOT NULL,
+				ts timestamp,
+				data json
+			);
+
+			CREATE INDEX IF NOT EXISTS record_ts_uid ON record USING btree(ts,uid);
+
+			CREATE TABLE IF NOT EXISTS installation (
+				id serial PRIMARY KEY,
+				uid varchar(255) UNIQUE NOT NULL,
+				first_seen timestamp,
+				last_seen timestamp,
+				last_ip varchar(255),
+				last_record int REFERENCES record(id),
+				note text
+			);
+
+			CREATE INDEX IF NOT EXISTS installation_last_seen ON installation USING btree(last_seen);
+
+			CREATE TABLE IF NOT EXISTS byday (
+				id serial PRIMARY KEY,
+				uid varchar(255) NOT NULL,
+				day date NOT NULL,
+				record_id int REFERENCES record(id)
+			);
+
+			CREATE UNIQUE INDEX IF NOT EXISTS byday_day_uid ON byday USING btree(day,uid);
+
+			CREATE TABLE IF NOT EXISTS account (
+				id serial PRIMARY KEY,
+				name varchar(255) NOT NULL UNIQUE,
+				hash varchar(255)
+			);`,
+		Down: `
+			DROP TABLE account;
+			DROP TABLE byday;
+			DROP TABLE installation;
+			DROP TABLE record;`,
+	},
+	{
+		Version: 2,
+		Name:    "install signing keys",
+		Up: `
+			CREATE TABLE IF NOT EXISTS install_key (
+				uid varchar(255) PRIMARY KEY,
+				key varchar(255) NOT NULL,
+				created timestamp
+			);
+
+			CREATE TABLE IF NOT EXISTS nonce (
+				uid varchar(255) NOT NULL,
+				nonce varchar(255) NOT NULL,
+				ts timestamp NOT NULL,
+				PRIMARY KEY (uid, nonce)
+			);
+
+			CREATE INDEX IF NOT EXISTS nonce_ts ON nonce USING btree(ts);`,
+		Down: `
+			DROP TABLE nonce;
+			DROP TABLE install_key;`,
+	},
+	{
+		Version: 3,
+		Name:    "jsonb record data",
+		// Generated columns need Postgres 12
+		Up: `
+			ALTER TABLE record ALTER COLUMN data TYPE jsonb USING data::jsonb;
+
+			ALTER TABLE record
+				ADD COLUMN install_version varchar(255) GENERATED ALWAYS AS (data #>> '{install,version}') STORED,
+				ADD COLUMN cluster_active int GENERATED ALWAYS AS (` + jsonbInt("data", "cluster", "active") + `) STORED,
+				ADD COLUMN cluster_total int GENERATED ALWAYS AS (` + jsonbInt("data", "cluster", "total") + `) STORED,
+				ADD COLUMN node_active int GENERATED ALWAYS AS (` + jsonbInt("data", "node", "active") + `) STORED,
+				ADD COLUMN node_total int GENERATED ALWAYS AS (` + jsonbInt("data", "node", "total") + `) STORED;
+
+			CREATE INDEX record_data ON record USING gin(data jsonb_path_ops);
+			CREATE INDEX record_install_version ON record USING btree(install_version);
+			CREATE INDEX record_uid_ts ON record USING btree(uid,ts);
+			CREATE INDEX byday_uid_day ON byday USING btree(uid,day);`,
+		Down: `
+			DROP INDEX byday_uid_day;
+			DROP INDEX record_uid_ts;
+			DROP INDEX record_install_version;
+			DROP INDEX record_data;
+
+			ALTER TABLE record
+				DROP COLUMN install_version,
+				DROP COLUMN cluster_active,
+				DROP COLUMN cluster_total,
+				DROP COLUMN node_active,
+				DROP COLUMN node_total;
+
+			ALTER TABLE record ALTER COLUMN data TYPE json USING data::json;`,
+	},
+	{
+		Version: 4,
+		Name:    "monthly partitions",
+		// Partitioned tables can't be the target of a foreign key, so last_record and record_id lose
+		// theirs. Existing rows are copied into the new tables, which can take a while.
+		Up: `
+			CREATE FUNCTION telemetry_partition(tbl text, t timestamp) RETURNS void AS $$
+			DECLARE
+				m date := date_trunc('month', t);
+				name text := tbl || '_' || to_char(m, 'YYYYMM');
+			BEGIN
+				IF to_regclass(name) IS NULL THEN
+					EXECUTE format('CREATE TABLE IF NOT EXISTS %I PARTITION OF %I FOR VALUES FROM (%L) TO (%L)',
+						name, tbl, m, (m + INTERVAL '1 month')::date);
+				END IF;
+			END
+			$$ LANGUAGE plpgsql;
+
+			ALTER TABLE installation DROP CONSTRAINT IF EXISTS installation_last_record_fkey;
+			ALTER TABLE byday DROP CONSTRAINT IF EXISTS byday_record_id_fkey;
+
+			ALTER TABLE record RENAME TO record_old;
+			ALTER TABLE record_old RENAME CONSTRAINT record_pkey TO record_old_pkey;
+			ALTER TABLE byday RENAME TO byday_old;
+			ALTER TABLE byday_old RENAME CONSTRAINT byday_pkey TO byday_old_pkey;
+
+			CREATE TABLE record (
+				id int NOT NULL DEFAULT nextval('record_id_seq'),
+				uid varchar(255) NOT NULL,
+				ts timestamp NOT NULL,
+				data jsonb,
+				install_version varchar(255) GENERATED ALWAYS AS (data #>> '{install,version}') STORED,
+				cluster_active int GENERATED ALWAYS AS (` + jsonbInt("data", "cluster", "active") + `) STORED,
+				cluster_total int GENERATED ALWAYS AS (` + jsonbInt("data", "cluster", "total") + `) STORED,
+				node_active int GENERATED ALWAYS AS (` + jsonbInt("data", "node", "active") + `) STORED,
+				node_total int GENERATED ALWAYS AS (` + jsonbInt("data", "node", "total") + `) STORED,
+				PRIMARY KEY (id, ts)
+			) PARTITION BY RANGE (ts);
+			ALTER SEQUENCE record_id_seq OWNED BY record.id;
+
+			CREATE TABLE byday (
+				id int NOT NULL DEFAULT nextval('byday_id_seq'),
+				uid varchar(255) NOT NULL,
+				day date NOT NULL,
+				record_id int,
+				PRIMARY KEY (id, day)
+			) PARTITION BY RANGE (day);
+			ALTER SEQUENCE byday_id_seq OWNED BY byday.id;
+
+			SELECT telemetry_partition('record', m::timestamp)
+			FROM generate_series(
+				(SELECT date_trunc('month', COALESCE(MIN(ts), NOW())) FROM record_old),
+				date_trunc('month', NOW()) + INTERVAL '1 month',
+				INTERVAL '1 month') AS m;
+
+			SELECT telemetry_partition('byday', m::timestamp)
+			FROM generate_series(
+				(SELECT date_trunc('month', COALESCE(MIN(day), NOW())) FROM byday_old),
+				date_trunc('month', NOW()) + INTERVAL '1 month',
+				INTERVAL '1 month') AS m;
+
+			INSERT INTO record(id,uid,ts,data) SELECT id, uid, COALESCE(ts, NOW()), data FROM record_old;
+			INSERT INTO byday(id,uid,day,record_id) SELECT id, uid, day, record_id FROM byday_old;
+
+			DROP TABLE record_old;
+			DROP TABLE byday_old;
+
+			CREATE INDEX record_ts_uid ON record USING btree(ts,uid);
+			CREATE INDEX record_uid_ts ON record USING btree(uid,ts);
+			CREATE INDEX record_install_version ON record USING btree(install_version);
+			CREATE INDEX record_data ON record USING gin(data jsonb_path_ops);
+			CREATE UNIQUE INDEX byday_day_uid ON byday USING btree(day,uid);
+			CREATE INDEX byday_uid_day ON byday USING btree(uid,day);
+			CREATE INDEX byday_record_id ON byday USING btree(record_id);`,
+		Down: `
+			ALTER TABLE record RENAME TO record_parted;
+			ALTER TABLE record_parted RENAME CONSTRAINT record_pkey TO record_parted_pkey;
+			ALTER TABLE byday RENAME TO byday_parted;
+			ALTER TABLE byday_parted RENAME CONSTRAINT byday_pkey TO byday_parted_pkey;
+
+			CREATE TABLE record (
+				id int PRIMARY KEY DEFAULT nextval('record_id_seq'),
+				uid varchar(255) NOT NULL,
+				ts timestamp,
+				data jsonb,
+				install_version varchar(255) GENERATED ALWAYS AS (data #>> '{install,version}') STORED,
+				cluster_active int GENERATED ALWAYS AS (` + jsonbInt("data", "cluster", "active") + `) STORED,
+				cluster_total int GENERATED ALWAYS AS (` + jsonbInt("data", "cluster", "total") + `) STORED,
+				node_active int GENERATED ALWAYS AS (` + jsonbInt("data", "node", "active") + `) STORED,
+				node_total int GENERATED ALWAYS AS (` + jsonbInt("data", "node", "total") + `) STORED
+			);
+			ALTER SEQUENCE record_id_seq OWNED BY record.id;
+
+			CREATE TABLE byday (
+				id int PRIMARY KEY DEFAULT nextval('byday_id_seq'),
+				uid varchar(255) NOT NULL,
+				day date NOT NULL,
+				record_id int REFERENCES record(id)
+			);
+			ALTER SEQUENCE byday_id_seq OWNED BY byday.id;
+
+			INSERT INTO record(id,uid,ts,data) SELECT id, uid, ts, data FROM record_parted;
+			INSERT INTO byday(id,uid,day,record_id) SELECT id, uid, day, record_id FROM byday_parted;
+
+			DROP TABLE record_parted;
+			DROP TABLE byday_parted;
+			DROP FUNCTION telemetry_partition(text, timestamp);
+
+			ALTER TABLE installation ADD CONSTRAINT installation_last_record_fkey FOREIGN KEY (last_record) REFERENCES record(id);
+
+			CREATE INDEX record_ts_uid ON record USING btree(ts,uid);
+			CREATE INDEX record_uid_ts ON record USING btree(uid,ts);
+			CREATE INDEX record_install_version ON record USING btree(install_version);
+			CREATE INDEX record_data ON record USING gin(data jsonb_path_ops);
+			CREATE UNIQUE INDEX byday_day_uid ON byday USING btree(day,uid);
+			CREATE INDEX byday_uid_day ON byday USING btree(uid,day);`,
+	},
+	{
+		Version: 5,
+		Name:    "daily rollups",
+		// Every existing day is marked dirty so the server fills the rollups in the background
+		Up: `
+			CREATE TABLE rollup_number (
+				day date NOT NULL,
+				field varchar(255) NOT NULL,
+				key varchar(255) NOT NULL,
+				sum numeric NOT NULL,
+				count int NOT NULL,
+				min numeric NOT NULL,
+				max numeric NOT NULL,
+				PRIMARY KEY (day, field, key)
+			);
+
+			CREATE INDEX rollup_number_field_day ON rollup_number USING btree(field,day);
+
+			CREATE TABLE rollup_value (
+				day date NOT NULL,
+				field varchar(255) NOT NULL,
+				value text NOT NULL,
+				count int NOT NULL,
+				PRIMARY KEY (day, field, value)
+			);
+
+			CREATE INDEX rollup_value_field_day ON rollup_value USING btree(field,day);
+
+			CREATE TABLE rollup_dirty (
+				day date PRIMARY KEY
+			);
+
+			INSERT INTO rollup_dirty(day) SELECT DISTINCT day FROM byday;`,
+		Down: `
+			DROP TABLE rollup_dirty;
+			DROP TABLE rollup_value;
+			DROP TABLE rollup_number;`,
+	},
+	{
+		Version: 6,
+		Name:    "daily install counts",
+		// The rollups count the installs of each day themselves, so pruning byday leaves them whole
+		Up: `
+			CREATE TABLE rollup_install (
+				day date PRIMARY KEY,
+				installs int NOT NULL
+			);
+
+			INSERT INTO rollup_install(day,installs) SELECT day, count(*) FROM byday GROUP BY day;`,
+		Down: `
+			DROP TABLE rollup_install;`,
+	},
+}
+
+// jsonbInt extracts an integer at path from a jsonb column, null if the value is not a number
+func jsonbInt(column string, path ...string) string {
+	p := "'{" + strings.Join(path, ",") + "}'"
+	return "CASE WHEN jsonb_typeof(" + column + " #> " + p + ") = 'number' THEN (" + column + " #>> " + p + ")::numeric::int END"
+}
+
+// LatestSchemaVersion is the schema version this binary expects
+func LatestSchemaVersion() int {
+	return Migrations[len(Migrations)-1].Version
+}
+
+type AppliedMigration struct {
+	Version int       `json:"version"`
+	Name    string    `json:"name"`
+	Applied time.Time `json:"applied"`
+}
+
+func (p *Postgres) createSchemaVersion() error {
+	_, err := p.Conn.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_version (
+			version int PRIMARY KEY,
+			name varchar(255) NOT NULL,
+			applied timestamp NOT NULL
+		)`)
+	return err
+}
+
+// SchemaVersion returns the version of the last migration applied to the database, 0 if none
+func (p *Postgres) SchemaVersion() (int, error) {
+	if err := p.createSchemaVersion(); err != nil {
+		return 0, err
+	}
+
+	return schemaVersion(p.Conn)
+}
+
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func schemaVersion(q queryRower) (int, error) {
+	var version int
+	err := q.QueryRow(`SELECT COALESCE(MAX(version),0) FROM schema_version`).Scan(&version)
+	return version, err
+}
+
+// AppliedMigrations lists the migrations applied to the database, oldest first
+func (p *Postgres) AppliedMigrations() ([]AppliedMigration, error) {
+	if err := p.createSchemaVersion(); err != nil {
+		return nil, err
+	}
+
+	rows, err := p.Conn.Query(`SELECT version, name, applied FROM schema_version ORDER BY version`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []AppliedMigration{}
+	for rows.Next() {
+		var m AppliedMigration
+		err = rows.Scan(&m.Version, &m.Name, &m.Applied)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, m)
+	}
+
+	return out, rows.Err()
+}
+
+// MigrateUp applies the migrations after the current version, up to and including target
+func (p *Postgres) MigrateUp(target int) error {
+	if target > LatestSchemaVersion() {
+		return fmt.Errorf("Unknown schema version %d, latest is %d", target, LatestSchemaVersion())
+	}
+
+	if err := p.createSchemaVersion(); err != nil {
+		return err
+	}
+
+	for _, m := range Migrations {
+		if m.Version > target {
+			break
+		}
+
+		err := p.migrate(m, true)
+		if err != nil {
+			return fmt.Errorf("Migration %d (%s) failed: %s", m.Version, m.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// MigrateDown reverts the applied migrations after target
+func (p *Postgres) MigrateDown(target int) error {
+	if target < 0 {
+		return fmt.Errorf("Unknown schema version %d", target)
+	}
+
+	if err := p.createSchemaVersion(); err != nil {
+		return err
+	}
+
+	for i := len(Migrations) - 1; i >= 0; i-- {
+		m := Migrations[i]
+		if m.Version <= target {
+			break
+		}
+
+		err := p.migrate(m, false)
+		if err != nil {
+			return fmt.Errorf("Reverting migration %d (%s) failed: %s", m.Version, m.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// migrate applies or reverts one migration if the database is at the version before or at it.
+// The version table is locked so servers starting together don't race each other.
+func (p *Postgres) migrate(m SchemaMigration, up bool) error {
+	tx, err := p.Conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`LOCK TABLE schema_version IN EXCLUSIVE MODE`)
+	if err != nil {
+		return err
+	}
+
+	current, err := schemaVersion(tx)
+	if err != nil {
+		return err
+	}
+
+	if up {
+		if current != m.Version-1 {
+			return nil
+		}
+
+		log.Infof("Applying schema migration %d (%s)", m.Version, m.Name)
+		if _, err = tx.Exec(m.Up); err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT INTO schema_version(version,name,applied) VALUES ($1,$2,NOW())`, m.Version, m.Name)
+	} else {
+		if current != m.Version {
+			return nil
+		}
+
+		log.Infof("Reverting schema migration %d (%s)", m.Version, m.Name)
+		if _, err = tx.Exec(m.Down); err != nil {
+			return err
+		}
+		_, err = tx.Exec(`DELETE FROM schema_version WHERE version=$1`, m.Version)
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// CheckSchema makes sure the database schema matches this binary, applying any missing
+// migrations if apply is set. A schema newer than the binary is always an error.
+func (p *Postgres) CheckSchema(apply bool) error {
+	current, err := p.SchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	latest := LatestSchemaVersion()
+	switch {
+	case current > latest:
+		return fmt.Errorf("Database schema version %d is newer than %d supported by this version, upgrade telemetry", current, latest)
+	case current < latest && !apply:
+		return fmt.Errorf("Database schema version %d is older than %d, run `telemetry migrate up`", current, latest)
+	case current < latest:
+		return p.MigrateUp(latest)
+	}
+
+	return nil
+}
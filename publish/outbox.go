@@ -0,0 +1,243 @@
+package publish
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const outboxExt = ".json"
+
+// Outbox is a spool directory of records waiting to be sent, oldest first
+type Outbox struct {
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+
+	mu sync.Mutex
+}
+
+type outboxEntry struct {
+	name string
+	ts   time.Time
+	size int64
+}
+
+func NewOutbox(dir string, maxBytes int64, maxAge time.Duration) (*Outbox, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &Outbox{
+		dir:      dir,
+		maxBytes: maxBytes,
+		maxAge:   maxAge,
+	}, nil
+}
+
+// Add spools a payload, dropping the oldest entries if the outbox is over its caps
+func (o *Outbox) Add(b []byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	// Zero padded so lexical order is also time order
+	name := fmt.Sprintf("%020d%s", time.Now().UnixNano(), outboxExt)
+
+	tmp, err := ioutil.TempFile(o.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+
+	if _, err = tmp.Write(b); err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err = os.Rename(tmp.Name(), filepath.Join(o.dir, name)); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return o.prune()
+}
+
+// Len returns the number of spooled payloads
+func (o *Outbox) Len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	entries, err := o.entries()
+	if err != nil {
+		return 0
+	}
+	return len(entries)
+}
+
+// Drain sends spooled payloads in order, up to batch at a time, removing them once sent. It stops
+// at the first failure so that ordering is preserved for the next attempt.
+func (o *Outbox) Drain(batch int, send func([][]byte) error) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if batch < 1 {
+		batch = 1
+	}
+
+	if err := o.prune(); err != nil {
+		return err
+	}
+
+	entries, err := o.entries()
+	if err != nil {
+		return err
+	}
+
+	for len(entries) > 0 {
+		n := batch
+		if n > len(entries) {
+			n = len(entries)
+		}
+
+		payloads := make([][]byte, 0, n)
+		for _, entry := range entries[:n] {
+			b, err := ioutil.ReadFile(filepath.Join(o.dir, entry.name))
+			if err != nil {
+				return err
+			}
+			payloads = append(payloads, b)
+		}
+
+		if err = send(payloads); err != nil {
+			return err
+		}
+
+		for _, entry := range entries[:n] {
+			if err = os.Remove(filepath.Join(o.dir, entry.name)); err != nil {
+				return err
+			}
+			log.Debugf("Sent spooled record %s", entry.name)
+		}
+
+		entries = entries[n:]
+	}
+
+	return nil
+}
+
+func (o *Outbox) entries() ([]outboxEntry, error) {
+	files, err := ioutil.ReadDir(o.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	out := []outboxEntry{}
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasSuffix(name, outboxExt) {
+			continue
+		}
+
+		nanos, err := strconv.ParseInt(strings.TrimSuffix(name, outboxExt), 10, 64)
+		if err != nil {
+			log.Debugf("Ignoring unknown file in outbox: %s", name)
+			continue
+		}
+
+		out = append(out, outboxEntry{
+			name: name,
+			ts:   time.Unix(0, nanos),
+			size: f.Size(),
+		})
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].name < out[j].name
+	})
+
+	return out, nil
+}
+
+// prune drops entries older than maxAge, then the oldest entries until the outbox fits in maxBytes
+func (o *Outbox) prune() error {
+	entries, err := o.entries()
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	for _, entry := range entries {
+		total += entry.size
+	}
+
+	for _, entry := range entries {
+		expired := o.maxAge > 0 && time.Since(entry.ts) > o.maxAge
+		oversize := o.maxBytes > 0 && total > o.maxBytes
+		if !expired && !oversize {
+			break
+		}
+
+		log.Warnf("Dropping spooled record %s (expired=%t, oversize=%t)", entry.name, expired, oversize)
+		if err := os.Remove(filepath.Join(o.dir, entry.name)); err != nil {
+			return err
+		}
+		total -= entry.size
+	}
+
+	return nil
+}
+
+// MinBackoff is the shortest delay Backoff waits, whatever its Min
+const MinBackoff = time.Second
+
+// Backoff computes exponentially growing retry delays with jitter
+type Backoff struct {
+	Min time.Duration
+	Max time.Duration
+
+	attempt int
+}
+
+// Next returns the delay before the next attempt, somewhere between half and all of min*2^attempt
+func (b *Backoff) Next() time.Duration {
+	d := b.Min
+	if d < MinBackoff {
+		d = MinBackoff
+	}
+	max := b.Max
+	if max < d {
+		max = d
+	}
+
+	for i := 0; i < b.attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	b.attempt++
+
+	half := int64(d / 2)
+	if half <= 0 {
+		return d
+	}
+	return time.Duration(half + rand.Int63n(half))
+}
+
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}
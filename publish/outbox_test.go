@@ -0,0 +1,194 @@
+package publish
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testOutbox(t *testing.T, maxBytes int64, maxAge time.Duration) (*Outbox, string) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	o, err := NewOutbox(dir, maxBytes, maxAge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o, dir
+}
+
+func addPayloads(t *testing.T, o *Outbox, payloads ...string) {
+	for _, p := range payloads {
+		if err := o.Add([]byte(p)); err != nil {
+			t.Fatal(err)
+		}
+		// Entries are named by the time they are added
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// drain returns what the outbox sends in batches
+func drain(t *testing.T, o *Outbox, batch int) [][]string {
+	out := [][]string{}
+	err := o.Drain(batch, func(payloads [][]byte) error {
+		b := []string{}
+		for _, p := range payloads {
+			b = append(b, string(p))
+		}
+		out = append(out, b)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestOutboxReplay(t *testing.T) {
+	o, dir := testOutbox(t, 0, 0)
+	addPayloads(t, o, "1", "2", "3")
+
+	// A new run finds what the last one left, in order
+	o, err := NewOutbox(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Len() != 3 {
+		t.Fatalf("Spooled: got %d, want 3", o.Len())
+	}
+
+	if got, want := drain(t, o, 2), [][]string{{"1", "2"}, {"3"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Drained: got %v, want %v", got, want)
+	}
+	if o.Len() != 0 {
+		t.Errorf("Spooled after draining: got %d, want 0", o.Len())
+	}
+}
+
+func TestOutboxDrainStopsAtFailure(t *testing.T) {
+	o, _ := testOutbox(t, 0, 0)
+	addPayloads(t, o, "1", "2", "3")
+
+	sent := []string{}
+	err := o.Drain(1, func(payloads [][]byte) error {
+		if string(payloads[0]) == "2" {
+			return errors.New("down")
+		}
+		sent = append(sent, string(payloads[0]))
+		return nil
+	})
+	if err == nil {
+		t.Fatal("Drain: got no error, want the send's")
+	}
+	if !reflect.DeepEqual(sent, []string{"1"}) || o.Len() != 2 {
+		t.Errorf("Sent %v leaving %d, want 1 sent leaving 2", sent, o.Len())
+	}
+
+	if got, want := drain(t, o, 5), [][]string{{"2", "3"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Drained on retry: got %v, want %v", got, want)
+	}
+}
+
+func TestOutboxDrops(t *testing.T) {
+	// Over the size cap, the oldest go first
+	o, _ := testOutbox(t, 5, 0)
+	addPayloads(t, o, "111", "222", "333")
+	if got, want := drain(t, o, 5), [][]string{{"333"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Drained over the size cap: got %v, want %v", got, want)
+	}
+
+	// Past the age cap
+	o, dir := testOutbox(t, 0, time.Hour)
+	old := fmt.Sprintf("%020d%s", time.Now().Add(-2*time.Hour).UnixNano(), outboxExt)
+	if err := ioutil.WriteFile(filepath.Join(dir, old), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	addPayloads(t, o, "new")
+	if got, want := drain(t, o, 5), [][]string{{"new"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Drained past the age cap: got %v, want %v", got, want)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	b := Backoff{Min: time.Second, Max: 10 * time.Second}
+	for i, base := range []time.Duration{1, 2, 4, 8, 10, 10} {
+		base *= time.Second
+		d := b.Next()
+		if d < base/2 || d >= base {
+			t.Errorf("Attempt %d: got %s, want between %s and %s", i, d, base/2, base)
+		}
+	}
+
+	b.Reset()
+	if d := b.Next(); d >= time.Second {
+		t.Errorf("After a reset: got %s, want under 1s", d)
+	}
+
+	// Delays vary, so clients don't retry together
+	seen := map[time.Duration]bool{}
+	for i := 0; i < 20; i++ {
+		b := Backoff{Min: time.Minute, Max: time.Hour}
+		seen[b.Next()] = true
+	}
+	if len(seen) < 2 {
+		t.Errorf("Jitter: got %d different delays of 20", len(seen))
+	}
+
+	// A zero min still waits
+	b = Backoff{}
+	if d := b.Next(); d < MinBackoff/2 {
+		t.Errorf("Zero min: got %s, want at least %s", d, MinBackoff/2)
+	}
+}
+
+func TestStatusErrorPermanent(t *testing.T) {
+	for status, permanent := range map[int]bool{
+		400: true, 413: true, 422: true,
+		401: false, 403: false, 404: false, 408: false, 429: false, 500: false, 502: false, 503: false,
+	} {
+		if got := (&StatusError{StatusCode: status}).Permanent(); got != permanent {
+			t.Errorf("Status %d: got permanent %t, want %t", status, got, permanent)
+		}
+	}
+}
+
+// TestFlushKeepsRetryable sends spooled records to a server failing in different ways; only the
+// records it rejects as invalid are dropped
+func TestFlushKeepsRetryable(t *testing.T) {
+	status := http.StatusUnauthorized
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer s.Close()
+
+	o, _ := testOutbox(t, 0, 0)
+	p := &ToUrl{url: s.URL, outbox: o, batch: 1}
+	addPayloads(t, o, `{"install":{"uid":"a"}}`)
+
+	for _, status = range []int{http.StatusUnauthorized, http.StatusServiceUnavailable, http.StatusForbidden} {
+		if err := p.Flush(); err == nil {
+			t.Errorf("Flush with %d: got no error", status)
+		}
+		if o.Len() != 1 {
+			t.Errorf("Spooled after %d: got %d, want 1", status, o.Len())
+		}
+	}
+
+	status = http.StatusUnprocessableEntity
+	if err := p.Flush(); err != nil {
+		t.Errorf("Flush with 422: %s", err)
+	}
+	if o.Len() != 0 {
+		t.Errorf("Spooled after 422: got %d, want 0", o.Len())
+	}
+}
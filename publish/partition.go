@@ -0,0 +1,221 @@
+package publish
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Tables partitioned by month, named like record_202001
+var partitionedTables = []string{"record", "byday"}
+
+var partitionName = regexp.MustCompile(`^(record|byday)_([0-9]{6})$`)
+
+type PrunedPartition struct {
+	Name    string `json:"name"`
+	Records int64  `json:"records"`
+	Kept    int64  `json:"kept"`
+}
+
+// addPartitions makes sure the partitions a record received at ts goes into exist
+func addPartitions(tx *sql.Tx, ts time.Time, day string) error {
+	_, err := tx.Exec(`SELECT telemetry_partition('record', $1::timestamptz::timestamp)`, ts)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`SELECT telemetry_partition('byday', $1::date)`, day)
+	return err
+}
+
+// EnsurePartitions creates the partitions for the current and next month ahead of time
+func (p *Postgres) EnsurePartitions() error {
+	for _, table := range partitionedTables {
+		_, err := p.Conn.Exec(`
+			SELECT telemetry_partition($1, m::timestamp)
+			FROM generate_series(date_trunc('month', NOW()), date_trunc('month', NOW()) + INTERVAL '1 month', INTERVAL '1 month') AS m`, table)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Prune drops the days and raw records of months older than the retention. The daily rollups are
+// brought up to date first and keep the history of those days; only the records still used as an
+// install's last record are kept, so installs are not affected.
+func (p *Postgres) Prune(months int, dryRun bool) ([]PrunedPartition, error) {
+	if months < 1 {
+		return nil, fmt.Errorf("Retention must be at least 1 month")
+	}
+
+	var cutoff time.Time
+	err := p.Conn.QueryRow(`SELECT (date_trunc('month', NOW()) - $1 * INTERVAL '1 month')::date`, months).Scan(&cutoff)
+	if err != nil {
+		return nil, err
+	}
+
+	// Days waiting for a refresh are recomputed from byday, so that has to happen before it goes
+	if !dryRun {
+		if _, err = p.RefreshRollups(); err != nil {
+			return nil, err
+		}
+	}
+
+	out := []PrunedPartition{}
+	names, err := p.partitions("byday")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		month, err := time.Parse("200601", partitionName.FindStringSubmatch(name)[2])
+		if err != nil {
+			return out, err
+		}
+		if !month.Before(cutoff) {
+			continue
+		}
+
+		pruned, err := p.dropPartition("byday", name, dryRun)
+		if err != nil {
+			return out, fmt.Errorf("Pruning %s failed: %s", name, err)
+		}
+
+		if pruned.Records > 0 {
+			if !dryRun {
+				log.Infof("Pruned %s, dropped %d days of installs", name, pruned.Records)
+			}
+			out = append(out, pruned)
+		}
+	}
+
+	names, err = p.partitions("record")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		month, err := time.Parse("200601", partitionName.FindStringSubmatch(name)[2])
+		if err != nil {
+			return out, err
+		}
+		if !month.Before(cutoff) {
+			continue
+		}
+
+		pruned, err := p.prunePartition(name, month, dryRun)
+		if err != nil {
+			return out, fmt.Errorf("Pruning %s failed: %s", name, err)
+		}
+
+		if pruned.Records > pruned.Kept {
+			if !dryRun {
+				log.Infof("Pruned %s, kept %d of %d records", name, pruned.Kept, pruned.Records)
+			}
+			out = append(out, pruned)
+		}
+	}
+
+	return out, nil
+}
+
+// partitions lists the partitions of a table, oldest first
+func (p *Postgres) partitions(table string) ([]string, error) {
+	rows, err := p.Conn.Query(`
+		SELECT c.relname
+		FROM pg_inherits i
+			JOIN pg_class c ON (c.oid = i.inhrelid)
+		WHERE i.inhparent = $1::regclass
+		ORDER BY c.relname`, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []string{}
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+
+		if partitionName.MatchString(name) {
+			out = append(out, name)
+		}
+	}
+
+	return out, rows.Err()
+}
+
+// dropPartition drops a partition of table whole
+func (p *Postgres) dropPartition(table string, name string, dryRun bool) (PrunedPartition, error) {
+	out := PrunedPartition{Name: name}
+
+	tx, err := p.Conn.Begin()
+	if err != nil {
+		return out, err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(fmt.Sprintf(`SELECT count(*) FROM %s`, name)).Scan(&out.Records)
+	if err != nil || dryRun {
+		return out, err
+	}
+
+	sql := fmt.Sprintf(`
+		ALTER TABLE %[1]s DETACH PARTITION %[2]s;
+		DROP TABLE %[2]s;`, table, name)
+	log.Debugf("Query: %s", sql)
+	_, err = tx.Exec(sql)
+	if err != nil {
+		return out, err
+	}
+
+	return out, tx.Commit()
+}
+
+// prunePartition replaces a record partition by a copy holding only the last records of installs.
+// Copying the few kept rows and dropping the old table is much cheaper than deleting the rest.
+func (p *Postgres) prunePartition(name string, month time.Time, dryRun bool) (PrunedPartition, error) {
+	out := PrunedPartition{Name: name}
+
+	tx, err := p.Conn.Begin()
+	if err != nil {
+		return out, err
+	}
+	defer tx.Rollback()
+
+	referenced := `EXISTS (SELECT 1 FROM installation i WHERE i.last_record = r.id)`
+
+	sql := fmt.Sprintf(`SELECT count(*), count(*) FILTER (WHERE %s) FROM %s r`, referenced, name)
+	log.Debugf("Query: %s", sql)
+	err = tx.QueryRow(sql).Scan(&out.Records, &out.Kept)
+	if err != nil || dryRun || out.Records == out.Kept {
+		return out, err
+	}
+
+	from := month.Format("2006-01-02")
+	to := month.AddDate(0, 1, 0).Format("2006-01-02")
+
+	sql = fmt.Sprintf(`
+		CREATE TABLE %[1]s_kept (LIKE %[1]s INCLUDING ALL);
+		INSERT INTO %[1]s_kept(id,uid,ts,data) SELECT id, uid, ts, data FROM %[1]s r WHERE %[2]s;
+		ALTER TABLE record DETACH PARTITION %[1]s;
+		DROP TABLE %[1]s;
+		ALTER TABLE %[1]s_kept RENAME TO %[1]s;
+		ALTER TABLE record ATTACH PARTITION %[1]s FOR VALUES FROM ('%[3]s') TO ('%[4]s');`,
+		name, referenced, from, to)
+	log.Debugf("Query: %s", sql)
+	_, err = tx.Exec(sql)
+	if err != nil {
+		return out, err
+	}
+
+	return out, tx.Commit()
+}
@@ -64,10 +64,19 @@ func NewPostgres(c *cli.Context) *Postgres {
 }
 
 func (p *Postgres) Report(r record.Record, clientIp string) error {
+	return p.ReportAt(r, clientIp, time.Now())
+}
+
+// ReportAt stores a record as if it was received at ts, so archived records can be loaded in any
+// order without disturbing newer data
+func (p *Postgres) ReportAt(r record.Record, clientIp string, ts time.Time) error {
 	log.Debugf("Publishing to Postgres")
 
-	install := r["install"].(map[string]interface{})
-	uid := install["uid"].(string)
+	install, _ := r["install"].(map[string]interface{})
+	uid, _ := install["uid"].(string)
+	if uid == "" {
+		return errors.New("Record has no install uid")
+	}
 
 	tx, err := p.Conn.Begin()
 	if err != nil {
@@ -76,7 +85,16 @@ func (p *Postgres) Report(r record.Record, clientIp string) error {
 		return err
 	}
 
-	recordId, err := p.addRecord(tx, uid, r)
+	day := ts.Local().Format("2006-01-02")
+
+	err = addPartitions(tx, ts, day)
+	if err != nil {
+		log.Errorf("Error adding partitions: %s", err)
+		tx.Rollback()
+		return err
+	}
+
+	recordId, err := p.addRecord(tx, uid, r, ts)
 	log.Debugf("Add Record: %v, %s", recordId, err)
 	if err != nil {
 		log.Errorf("Error adding record: %s", err)
@@ -84,19 +102,29 @@ func (p *Postgres) Report(r record.Record, clientIp string) error {
 		return err
 	}
 
-	_, err = p.upsertInstall(tx, uid, clientIp, recordId)
+	_, err = p.upsertInstall(tx, uid, clientIp, recordId, ts)
 	if err != nil {
 		log.Errorf("Error updating install: %s", err)
+		tx.Rollback()
 		return err
 	}
 
-	_, err = p.upsertByDay(tx, uid, recordId)
+	dayId, replaced, err := p.upsertByDay(tx, uid, day, recordId, ts)
 	if err != nil {
 		log.Errorf("Error updating day: %s", err)
 		tx.Rollback()
 		return err
 	}
 
+	if dayId != 0 {
+		err = updateRollups(tx, day, replaced, recordId)
+		if err != nil {
+			log.Errorf("Error updating rollups: %s", err)
+			tx.Rollback()
+			return err
+		}
+	}
+
 	err = tx.Commit()
 	if err != nil {
 		log.Errorf("Error commiting transatcion: %s", err)
@@ -122,7 +150,7 @@ func (p *Postgres) testDb() error {
 	return nil
 }
 
-func (p *Postgres) addRecord(tx *sql.Tx, uid string, r record.Record) (int, error) {
+func (p *Postgres) addRecord(tx *sql.Tx, uid string, r record.Record, ts time.Time) (int, error) {
 	var id int
 
 	b, err := json.Marshal(r)
@@ -130,36 +158,45 @@ func (p *Postgres) addRecord(tx *sql.Tx, uid string, r record.Record) (int, erro
 		return 0, err
 	}
 
-	err = tx.QueryRow(`INSERT INTO record(uid,data,ts) VALUES ($1,$2,NOW()) RETURNING id`, uid, string(b)).Scan(&id)
+	err = tx.QueryRow(`INSERT INTO record(uid,data,ts) VALUES ($1,$2,$3::timestamptz) RETURNING id`, uid, string(b), ts).Scan(&id)
 	return id, err
 }
 
-func (p *Postgres) upsertInstall(tx *sql.Tx, uid string, clientIp string, recordId int) (int, error) {
+func (p *Postgres) upsertInstall(tx *sql.Tx, uid string, clientIp string, recordId int, ts time.Time) (int, error) {
 	var id int
 
+	// Only a record newer than the last one seen replaces it
 	err := tx.QueryRow(`
 		INSERT INTO installation(uid,last_ip,last_record,first_seen,last_seen)
-		VALUES ($1,$2,$3,NOW(),NOW()) 
+		VALUES ($1,$2,$3,$4::timestamptz,$4::timestamptz)
 		ON CONFLICT(uid) DO UPDATE SET 
-			last_seen=NOW(),
-			last_ip=$2,
-			last_record=$3
-		RETURNING id`, uid, clientIp, recordId).Scan(&id)
+			first_seen=LEAST(installation.first_seen,EXCLUDED.first_seen),
+			last_seen=GREATEST(installation.last_seen,EXCLUDED.last_seen),
+			last_ip=CASE WHEN EXCLUDED.last_seen >= installation.last_seen THEN $2 ELSE installation.last_ip END,
+			last_record=CASE WHEN EXCLUDED.last_seen >= installation.last_seen THEN $3 ELSE installation.last_record END
+		RETURNING id`, uid, clientIp, recordId, ts).Scan(&id)
 	return id, err
 }
 
-func (p *Postgres) upsertByDay(tx *sql.Tx, uid string, recordId int) (int, error) {
+// upsertByDay makes the record the install's record of the day unless the day has a newer one,
+// returning the id of the day, 0 if it kept its record, and the record it replaced if any
+func (p *Postgres) upsertByDay(tx *sql.Tx, uid string, day string, recordId int, ts time.Time) (int, sql.NullInt64, error) {
 	var id int
+	var replaced sql.NullInt64
 
-	today := time.Now().Format("2006-01-02")
-
+	// Each day keeps the latest record of that day
 	err := tx.QueryRow(`
+		WITH previous AS (SELECT record_id FROM byday WHERE uid=$1 AND day=$2)
 		INSERT INTO byday(uid,day,record_id)
 		VALUES ($1,$2,$3) 
 		ON CONFLICT(uid,day) DO UPDATE SET 
 			record_id=$3
-		RETURNING id`, uid, today, recordId).Scan(&id)
-	return id, err
+		WHERE (SELECT ts FROM record WHERE id=byday.record_id) <= $4::timestamptz
+		RETURNING id, (SELECT record_id FROM previous)`, uid, day, recordId, ts).Scan(&id, &replaced)
+	if err == sql.ErrNoRows {
+		return 0, replaced, nil
+	}
+	return id, replaced, err
 }
 
 func (p *Postgres) GetAccountHash(user string) (string, error) {
@@ -171,3 +208,64 @@ func (p *Postgres) GetAccountHash(user string) (string, error) {
 
 	return hash, nil
 }
+
+func (p *Postgres) SetAccount(name string, hash string) error {
+	_, err := p.Conn.Exec(`
+		INSERT INTO account(name,hash) VALUES ($1,$2)
+		ON CONFLICT(name) DO UPDATE SET hash=EXCLUDED.hash`, name, hash)
+	return err
+}
+
+// GetInstallKey returns the signing key registered for an install, or "" if there is none yet
+func (p *Postgres) GetInstallKey(uid string) (string, error) {
+	var key string
+	err := p.Conn.QueryRow(`SELECT key FROM install_key WHERE uid=$1`, uid).Scan(&key)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return key, nil
+}
+
+func (p *Postgres) RegisterInstallKey(uid string, key string) (string, error) {
+	_, err := p.Conn.Exec(`
+		INSERT INTO install_key(uid,key,created)
+		VALUES ($1,$2,NOW())
+		ON CONFLICT(uid) DO NOTHING`, uid, key)
+	if err != nil {
+		return "", err
+	}
+
+	return p.GetInstallKey(uid)
+}
+
+func (p *Postgres) ResetInstallKey(uid string) error {
+	_, err := p.Conn.Exec(`DELETE FROM install_key WHERE uid=$1`, uid)
+	return err
+}
+
+// UseNonce records a nonce for an install, returning false if it has been seen within the window
+func (p *Postgres) UseNonce(uid string, nonce string, window time.Duration) (bool, error) {
+	_, err := p.Conn.Exec(`DELETE FROM nonce WHERE ts < NOW() - $1 * INTERVAL '1 second'`, int64(2*window/time.Second))
+	if err != nil {
+		return false, err
+	}
+
+	res, err := p.Conn.Exec(`
+		INSERT INTO nonce(uid,nonce,ts)
+		VALUES ($1,$2,NOW())
+		ON CONFLICT(uid,nonce) DO NOTHING`, uid, nonce)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
@@ -0,0 +1,368 @@
+package publish
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	record "github.com/rancher/telemetry/record"
+)
+
+// testPostgres connects to the database in TELEMETRY_TEST_PG, a lib/pq connection string like
+// "host=localhost user=telemetry password=telemetry dbname=telemetry sslmode=disable", and works
+// in a schema of its own that is dropped afterwards. Tests using it are skipped without one.
+func testPostgres(t *testing.T) *Postgres {
+	dsn := os.Getenv("TELEMETRY_TEST_PG")
+	if dsn == "" {
+		t.Skip("TELEMETRY_TEST_PG is not set")
+	}
+
+	conn, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A single connection, so the search path set below holds for every query
+	conn.SetMaxOpenConns(1)
+
+	schema := fmt.Sprintf("telemetry_test_%d", time.Now().UnixNano())
+	if _, err = conn.Exec(`CREATE SCHEMA ` + schema); err != nil {
+		conn.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Exec(`DROP SCHEMA ` + schema + ` CASCADE`)
+		conn.Close()
+	})
+
+	if _, err = conn.Exec(`SET search_path TO ` + schema); err != nil {
+		t.Fatal(err)
+	}
+
+	return &Postgres{telemetryVersion: "test", Conn: conn}
+}
+
+func testRecord(uid string, clusters int) record.Record {
+	return record.Record{
+		"r":       float64(record.VERSION),
+		"install": map[string]interface{}{"uid": uid, "version": "v2.5.1"},
+		"cluster": map[string]interface{}{"active": float64(clusters), "total": float64(clusters)},
+	}
+}
+
+func countRows(t *testing.T, p *Postgres, table string) int {
+	var n int
+	if err := p.Conn.QueryRow(`SELECT COUNT(*) FROM ` + table).Scan(&n); err != nil {
+		t.Fatalf("Counting %s: %s", table, err)
+	}
+	return n
+}
+
+func TestMigrations(t *testing.T) {
+	p := testPostgres(t)
+	latest := LatestSchemaVersion()
+
+	if err := p.MigrateUp(latest); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.EnsurePartitions(); err != nil {
+		t.Fatalf("EnsurePartitions: %s", err)
+	}
+
+	// Records spread over months, so moving them into partitions has several to create. Mid
+	// month, so they stay in their month whatever the time zone.
+	now := time.Now()
+	month := func(ago int) time.Time {
+		return time.Date(now.Year(), now.Month(), 15, 12, 0, 0, 0, time.Local).AddDate(0, -ago, 0)
+	}
+	for i, ago := range []int{0, 2, 14} {
+		err := p.ReportAt(testRecord(fmt.Sprintf("uid-%d", i), i+1), "", month(ago))
+		if err != nil {
+			t.Fatalf("ReportAt %d months ago: %s", ago, err)
+		}
+	}
+
+	// Back to unpartitioned tables and up again, moving the records both ways
+	if err := p.MigrateDown(3); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRows(t, p, "record"); n != 3 {
+		t.Fatalf("Records after reverting to 3: got %d, want 3", n)
+	}
+
+	if err := p.MigrateUp(latest); err != nil {
+		t.Fatal(err)
+	}
+	version, err := p.SchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != latest {
+		t.Fatalf("Schema version: got %d, want %d", version, latest)
+	}
+
+	if n := countRows(t, p, "record"); n != 3 {
+		t.Fatalf("Records after migrating up: got %d, want 3", n)
+	}
+	if n := countRows(t, p, "byday"); n != 3 {
+		t.Fatalf("Days after migrating up: got %d, want 3", n)
+	}
+
+	// Every month from the oldest record to the next is partitioned
+	for _, table := range partitionedTables {
+		names, err := p.partitions(table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for ago := -1; ago <= 14; ago++ {
+			want := table + "_" + month(ago).Format("200601")
+			if !contains(names, want) {
+				t.Errorf("Partition %s missing from %v", want, names)
+			}
+		}
+	}
+
+	// New records still find their partition
+	if err = p.ReportAt(testRecord("uid-new", 1), "", now); err != nil {
+		t.Fatalf("ReportAt after migrating: %s", err)
+	}
+	if err = p.EnsurePartitions(); err != nil {
+		t.Fatalf("EnsurePartitions after migrating: %s", err)
+	}
+
+	// An older record of the install 14 months ago, on another day
+	if err = p.ReportAt(testRecord("uid-2", 9), "", month(14).AddDate(0, 0, -1)); err != nil {
+		t.Fatalf("ReportAt an older record: %s", err)
+	}
+
+	// A dry run over the months before the last 12 finds the two days 14 months ago, and the two
+	// records of which the install's last is kept
+	old := month(14).Format("200601")
+	want := []PrunedPartition{{Name: "byday_" + old, Records: 2}, {Name: "record_" + old, Records: 2, Kept: 1}}
+	pruned, err := p.Prune(12, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(pruned, want) {
+		t.Fatalf("Prune of 12 months: got %+v, want %+v", pruned, want)
+	}
+	if n := countRows(t, p, "record"); n != 5 {
+		t.Errorf("Records after a dry run: got %d, want 5", n)
+	}
+	if n := countRows(t, p, "byday"); n != 5 {
+		t.Errorf("Days after a dry run: got %d, want 5", n)
+	}
+
+	if pruned, err = p.Prune(12, false); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(pruned, want) {
+		t.Errorf("Prune of 12 months: got %+v, want %+v", pruned, want)
+	}
+	if n := countRows(t, p, "record"); n != 4 {
+		t.Errorf("Records after pruning: got %d, want 4", n)
+	}
+	if n := countRows(t, p, "byday"); n != 3 {
+		t.Errorf("Days after pruning: got %d, want 3", n)
+	}
+	names, err := p.partitions("byday")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contains(names, "byday_"+old) {
+		t.Errorf("Partition byday_%s still in %v after pruning", old, names)
+	}
+
+	// The rollups still hold the pruned days
+	var days int
+	err = p.Conn.QueryRow(`SELECT count(*) FROM rollup_install WHERE day < $1`, month(12).Format("2006-01-02")).Scan(&days)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if days != 2 {
+		t.Errorf("Rollups of pruned days: got %d, want 2", days)
+	}
+	result, err := p.Query(&Query{
+		From:       month(14).AddDate(0, 0, -1).Format("2006-01-02"),
+		To:         month(14).Format("2006-01-02"),
+		Interval:   "day",
+		Aggregates: []Aggregate{{Fn: "sum", Field: "cluster.total"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sums := []float64{}
+	for _, row := range result.Rows {
+		sums = append(sums, row.Values["sum(cluster.total)"])
+	}
+	if !reflect.DeepEqual(sums, []float64{9, 3}) {
+		t.Errorf("History of pruned days: got %+v, want sums 9 and 3", result.Rows)
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// rollupRows lists the rollups, for comparing those kept up to date by reports with recomputed ones
+func rollupRows(t *testing.T, p *Postgres) []string {
+	rows, err := p.Conn.Query(`
+		SELECT day::text || ' ' || field || ' ' || key || ' ' || sum::float8 || ' ' || count || ' ' || min::float8 || ' ' || max::float8
+		FROM rollup_number
+		UNION ALL
+		SELECT day::text || ' ' || field || ' = ' || value || ' ' || count
+		FROM rollup_value
+		UNION ALL
+		SELECT day::text || ' installs ' || installs
+		FROM rollup_install
+		ORDER BY 1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	out := []string{}
+	for rows.Next() {
+		var row string
+		if err = rows.Scan(&row); err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, row)
+	}
+	if err = rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+// checkRollups recomputes every day's rollups and compares them with the ones reports left
+func checkRollups(t *testing.T, p *Postgres, dirty int) {
+	var n int
+	if err := p.Conn.QueryRow(`SELECT COUNT(*) FROM rollup_dirty`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != dirty {
+		t.Errorf("Dirty days: got %d, want %d", n, dirty)
+	}
+	if _, err := p.RefreshRollups(); err != nil {
+		t.Fatal(err)
+	}
+	kept := rollupRows(t, p)
+
+	if _, err := p.Conn.Exec(`INSERT INTO rollup_dirty(day) SELECT DISTINCT day FROM byday`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.RefreshRollups(); err != nil {
+		t.Fatal(err)
+	}
+	recomputed := rollupRows(t, p)
+
+	if strings.Join(kept, "\n") != strings.Join(recomputed, "\n") {
+		t.Errorf("Rollups kept by reports:\n%s\nrecomputed:\n%s", strings.Join(kept, "\n"), strings.Join(recomputed, "\n"))
+	}
+}
+
+// TestCheckSchema migrates an older schema only when asked to, and refuses one written by a newer
+// version without touching it
+func TestCheckSchema(t *testing.T) {
+	p := testPostgres(t)
+	latest := LatestSchemaVersion()
+
+	if err := p.CheckSchema(false); err == nil || !strings.Contains(err.Error(), "older") {
+		t.Fatalf("Empty schema: got %v, want older", err)
+	}
+	if err := p.CheckSchema(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.CheckSchema(false); err != nil {
+		t.Fatalf("Latest schema: %s", err)
+	}
+
+	_, err := p.Conn.Exec(`INSERT INTO schema_version(version,name,applied) VALUES ($1,'from the future',NOW())`, latest+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, apply := range []bool{false, true} {
+		if err := p.CheckSchema(apply); err == nil || !strings.Contains(err.Error(), "newer") {
+			t.Errorf("Newer schema, applying %t: got %v, want newer", apply, err)
+		}
+	}
+	if version, err := p.SchemaVersion(); err != nil || version != latest+1 {
+		t.Errorf("Schema version after refusing it: got %d (%v), want %d", version, err, latest+1)
+	}
+}
+
+func TestRollups(t *testing.T) {
+	p := testPostgres(t)
+	if err := p.MigrateUp(LatestSchemaVersion()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Midday, so every report falls on the same day
+	now := time.Now()
+	now = time.Date(now.Year(), now.Month(), now.Day(), 12, 0, 0, 0, time.Local)
+	report := func(uid string, version string, total int, extra map[string]interface{}, ago time.Duration) {
+		r := testRecord(uid, total)
+		r["install"].(map[string]interface{})["version"] = version
+		for k, v := range extra {
+			r[k] = v
+		}
+		if err := p.ReportAt(r, "", now.Add(-ago)); err != nil {
+			t.Fatalf("ReportAt %s: %s", uid, err)
+		}
+	}
+
+	kubelet := map[string]interface{}{"kubelet": map[string]interface{}{"v1.18.3": float64(2)}}
+	report("a", "v2.4.8", 3, map[string]interface{}{"node": kubelet}, 3*time.Minute)
+	report("b", "v2.4.8", 5, nil, 3*time.Minute)
+	report("c", "v2.5.1", 2, nil, 3*time.Minute)
+
+	// a replaces its record with one between the min and max, dropping a field and adding others
+	report("a", "v2.5.1", 4, map[string]interface{}{"flags": map[string]interface{}{"ha": true}}, 2*time.Minute)
+	// An older record doesn't replace the day's
+	report("b", "v2.3.0", 9, nil, 4*time.Minute)
+	checkRollups(t, p, 0)
+
+	// c moves up from the min, which only a refresh can find again
+	report("c", "v2.5.1", 6, nil, time.Minute)
+	checkRollups(t, p, 1)
+
+	checkRollupQueries(t, p)
+}
+
+// checkRollupQueries compares the results of queries the rollups answer with those of the records,
+// which a filter matching every install makes them read from
+func checkRollupQueries(t *testing.T, p *Postgres) {
+	queries := []Query{
+		{Aggregates: []Aggregate{{Fn: "sum", Field: "cluster.total"}, {Fn: "min", Field: "cluster.total"}, {Fn: "avg", Field: "node.kubelet.v1.18.3"}}},
+		{GroupBy: []string{"node.kubelet.*"}, Aggregates: []Aggregate{{Fn: "sum", Field: "node.kubelet.*"}}},
+		{GroupBy: []string{"install.version"}, Aggregates: []Aggregate{{Fn: "count"}}},
+		{GroupBy: []string{"flags.ha"}, Aggregates: []Aggregate{{Fn: "count"}}},
+	}
+
+	for _, q := range queries {
+		q.Interval = "day"
+		rolled, err := p.Query(&q)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		q.Filters = []string{`install.uid="*"`}
+		read, err := p.Query(&q)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(rolled, read) {
+			t.Errorf("Query %+v: got %+v from the rollups, %+v from the records", q, rolled, read)
+		}
+	}
+}
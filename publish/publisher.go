@@ -0,0 +1,135 @@
+package publish
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+
+	record "github.com/rancher/telemetry/record"
+)
+
+type Publisher interface {
+	Report(r record.Record, clientIp string) error
+}
+
+// A Factory creates a publisher for a target such as https://host/publish or file:///path
+type Factory func(c *cli.Context, target *url.URL) (Publisher, error)
+
+var registered = map[string]Factory{}
+
+// Register makes a publisher available for targets with the given URL scheme
+func Register(scheme string, f Factory) {
+	registered[scheme] = f
+}
+
+// New creates the publisher registered for the target's scheme. A target without a scheme, like
+// "stdout", is looked up by name.
+func New(c *cli.Context, target string) (Publisher, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+
+	scheme := u.Scheme
+	if scheme == "" {
+		scheme = target
+	}
+
+	f, ok := registered[scheme]
+	if !ok {
+		return nil, fmt.Errorf("No publisher for %s, known: %s", target, strings.Join(schemes(), ", "))
+	}
+
+	return f(c, u)
+}
+
+func schemes() []string {
+	out := []string{}
+	for k := range registered {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Multi sends every record to several publishers, a failure in one not affecting the others
+type Multi struct {
+	targets    []string
+	publishers []Publisher
+}
+
+// NewMulti creates a publisher for each of the targets
+func NewMulti(c *cli.Context, targets []string) (*Multi, error) {
+	out := &Multi{}
+
+	for _, target := range targets {
+		if target == "" {
+			continue
+		}
+
+		p, err := New(c, target)
+		if err != nil {
+			return nil, err
+		}
+
+		log.Infof("Publishing to %s", target)
+		out.targets = append(out.targets, target)
+		out.publishers = append(out.publishers, p)
+	}
+
+	if len(out.publishers) == 0 {
+		log.Warn("No publishers configured, not publishing")
+	}
+
+	return out, nil
+}
+
+func (m *Multi) Report(r record.Record, clientIp string) error {
+	errs := make([]error, len(m.publishers))
+
+	var wg sync.WaitGroup
+	for i, p := range m.publishers {
+		wg.Add(1)
+		go func(i int, p Publisher) {
+			defer wg.Done()
+			defer func() {
+				if rec := recover(); rec != nil {
+					errs[i] = fmt.Errorf("panic: %v", rec)
+				}
+			}()
+
+			errs[i] = p.Report(r, clientIp)
+		}(i, p)
+	}
+	wg.Wait()
+
+	failed := []string{}
+	for i, err := range errs {
+		if err != nil {
+			log.Errorf("Error publishing to %s: %s", m.targets[i], err)
+			failed = append(failed, m.targets[i])
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("Failed publishing to %s", strings.Join(failed, ", "))
+	}
+
+	return nil
+}
+
+// Depth returns the number of records waiting to be sent across all publishers
+func (m *Multi) Depth() int {
+	depth := 0
+	for _, p := range m.publishers {
+		if d, ok := p.(interface{ Depth() int }); ok {
+			depth += d.Depth()
+		}
+	}
+	return depth
+}
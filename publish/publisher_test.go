@@ -0,0 +1,105 @@
+package publish
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/urfave/cli"
+
+	record "github.com/rancher/telemetry/record"
+)
+
+type funcPublisher func(r record.Record, clientIp string) error
+
+func (f funcPublisher) Report(r record.Record, clientIp string) error {
+	return f(r, clientIp)
+}
+
+// withPublishers registers a publisher for each scheme for the rest of a test
+func withPublishers(t *testing.T, publishers map[string]Publisher) {
+	for scheme, p := range publishers {
+		p := p
+		saved, ok := registered[scheme]
+		Register(scheme, func(c *cli.Context, target *url.URL) (Publisher, error) {
+			return p, nil
+		})
+		t.Cleanup(func() {
+			if ok {
+				registered[scheme] = saved
+			} else {
+				delete(registered, scheme)
+			}
+		})
+	}
+}
+
+// TestMulti sends a record to publishers that succeed, fail, panic and wait on another one, which
+// would never return if the others were sent to one after the other
+func TestMulti(t *testing.T) {
+	var mu sync.Mutex
+	got := map[string]string{}
+	receive := func(name string) func(r record.Record) {
+		return func(r record.Record) {
+			mu.Lock()
+			defer mu.Unlock()
+			uid, _ := fieldValue(map[string]interface{}(r), "install.uid")
+			got[name] = textValue(uid)
+		}
+	}
+
+	received := make(chan struct{})
+	withPublishers(t, map[string]Publisher{
+		"waiting": funcPublisher(func(r record.Record, clientIp string) error {
+			select {
+			case <-received:
+				receive("waiting")(r)
+				return nil
+			case <-time.After(5 * time.Second):
+				return errors.New("other publishers blocked")
+			}
+		}),
+		"failing": funcPublisher(func(r record.Record, clientIp string) error {
+			receive("failing")(r)
+			return errors.New("server is down")
+		}),
+		"panicking": funcPublisher(func(r record.Record, clientIp string) error {
+			receive("panicking")(r)
+			panic("oops")
+		}),
+		"working": funcPublisher(func(r record.Record, clientIp string) error {
+			receive("working")(r)
+			close(received)
+			return nil
+		}),
+	})
+
+	m, err := NewMulti(nil, []string{"waiting", "failing", "", "panicking", "working"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.Report(versionRecord("a", "v2.5.1"), "127.0.0.1")
+	if err == nil || err.Error() != "Failed publishing to failing, panicking" {
+		t.Errorf("Report: got %v, want failing and panicking to fail", err)
+	}
+
+	want := map[string]string{"waiting": "a", "failing": "a", "panicking": "a", "working": "a"}
+	if len(got) != len(want) {
+		t.Errorf("Received: got %v, want %v", got, want)
+	}
+	for name := range want {
+		if got[name] != want[name] {
+			t.Errorf("Received by %s: got %q, want %q", name, got[name], want[name])
+		}
+	}
+}
+
+func TestMultiUnknown(t *testing.T) {
+	if _, err := NewMulti(nil, []string{"stdout", "ftp://example.com"}); err == nil || !strings.Contains(err.Error(), "No publisher for ftp://example.com") {
+		t.Errorf("Unknown scheme: got %v", err)
+	}
+}
@@ -2,7 +2,6 @@ package publish
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
 	"regexp"
 	"strings"
@@ -43,10 +42,21 @@ func (p *Postgres) Ping() error {
 	return nil
 }
 
-func (p *Postgres) GetAllInstalls() ([]ApiInstallation, error) {
-	sql := `SELECT id, uid, first_seen, last_seen, i.last_ip FROM installation i ORDER BY first_seen`
+func (p *Postgres) GetAllInstalls(filters []Filter) ([]ApiInstallation, error) {
+	sql := `SELECT i.id, i.uid, i.first_seen, i.last_seen, i.last_ip FROM installation i ORDER BY i.first_seen`
+	args := []interface{}{}
+	if len(filters) > 0 {
+		var where string
+		where, args = filterWhere("r", filters, args)
+		sql = `SELECT i.id, i.uid, i.first_seen, i.last_seen, i.last_ip
+FROM installation i
+	JOIN record r ON (i.last_record = r.id)
+WHERE TRUE` + where + `
+ORDER BY i.first_seen`
+	}
+
 	log.Debugf("Query: %s", sql)
-	rows, err := p.Conn.Query(sql)
+	rows, err := p.Conn.Query(sql, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -67,15 +77,16 @@ func (p *Postgres) GetAllInstalls() ([]ApiInstallation, error) {
 	return out, nil
 }
 
-func (p *Postgres) GetActiveInstalls(hours int) ([]ApiInstallation, error) {
+func (p *Postgres) GetActiveInstalls(hours int, filters []Filter) ([]ApiInstallation, error) {
 	sql := `SELECT i.id, i.uid, i.first_seen, i.last_seen, i.last_ip, r.data
 FROM installation i
 	JOIN record r ON (i.last_record = r.id)
-WHERE i.last_seen >= NOW() - INTERVAL '%d hour'`
+WHERE i.last_seen >= NOW() - INTERVAL '%d hour'%s`
 
-	sql = fmt.Sprintf(sql, hours)
+	where, args := filterWhere("r", filters, nil)
+	sql = fmt.Sprintf(sql, hours, where)
 	log.Debugf("Query: %s", sql)
-	rows, err := p.Conn.Query(sql)
+	rows, err := p.Conn.Query(sql, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -102,10 +113,33 @@ WHERE i.last_seen >= NOW() - INTERVAL '%d hour'`
 	return out, nil
 }
 
-func (p *Postgres) GetActiveCountByDay() (AggregatedFields, error) {
-	sql := `SELECT date_trunc('day',ts) AS day, count(DISTINCT uid) FROM record GROUP BY day ORDER BY DAY`
+func (p *Postgres) CountActiveInstalls(hours int) (int64, error) {
+	sql := `SELECT count(*) FROM installation WHERE last_seen >= NOW() - INTERVAL '%d hour'`
+
+	sql = fmt.Sprintf(sql, hours)
+	log.Debugf("Query: %s", sql)
+
+	var count int64
+	err := p.Conn.QueryRow(sql).Scan(&count)
+	return count, err
+}
+
+func (p *Postgres) GetActiveCountByDay(filters []Filter) (AggregatedFields, error) {
+	sql := `SELECT day, count(*) FROM byday GROUP BY day ORDER BY day`
+	args := []interface{}{}
+	if len(filters) > 0 {
+		var where string
+		where, args = filterWhere("r", filters, args)
+		sql = `SELECT b.day, count(*)
+FROM byday b
+	JOIN record r ON (b.record_id = r.id)
+WHERE TRUE` + where + `
+GROUP BY b.day
+ORDER BY b.day`
+	}
+
 	log.Debugf("Query: %s", sql)
-	rows, err := p.Conn.Query(sql)
+	rows, err := p.Conn.Query(sql, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -129,15 +163,16 @@ func (p *Postgres) GetActiveCountByDay() (AggregatedFields, error) {
 	return out, nil
 }
 
-func (p *Postgres) GetRecordsGroupedByDay(days int) (RecordsByDateByUid, error) {
-	sql := `SELECT id, uid, ts, data
-FROM record
-WHERE date_trunc('day',ts) >= (date_trunc('day',now()) - INTERVAL '%d day')
-ORDER BY id DESC`
+func (p *Postgres) GetRecordsGroupedByDay(days int, filters []Filter) (RecordsByDateByUid, error) {
+	sql := `SELECT r.id, r.uid, r.ts, r.data
+FROM record r
+WHERE r.ts >= (date_trunc('day',now()) - INTERVAL '%d day')%s
+ORDER BY r.id DESC`
 
-	sql = fmt.Sprintf(sql, days)
+	where, args := filterWhere("r", filters, nil)
+	sql = fmt.Sprintf(sql, days, where)
 	log.Debugf("Query: %s", sql)
-	rows, err := p.Conn.Query(sql)
+	rows, err := p.Conn.Query(sql, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -179,7 +214,7 @@ func (p *Postgres) GetRecordsByUid(uid string, days int) ([]ApiRecord, error) {
 FROM record
 WHERE 
 	uid = $1
-	AND date_trunc('day',ts) >= (date_trunc('day',now()) - INTERVAL '%d day')
+	AND ts >= (date_trunc('day',now()) - INTERVAL '%d day')
 ORDER BY id DESC`
 
 	sql = fmt.Sprintf(sql, days)
@@ -234,313 +269,44 @@ WHERE
 	return rec, nil
 }
 
-func (p *Postgres) SumOfActiveInstalls(hours int, fields []string) (AggregatedFields, error) {
-	fieldSql, err := fieldQuery(fields, "r.data")
-	if err != nil {
-		return nil, err
-	}
-
-	sql := `SELECT
-	%s
-FROM installation i
-	JOIN record r ON (i.last_record = r.id)
-WHERE i.last_seen >= NOW() - INTERVAL '%d hour'`
-
-	sql = fmt.Sprintf(sql, fieldSql, hours)
-	log.Debugf("Query: %s", sql)
-	rows, err := p.Conn.Query(sql)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	cols, err := rows.Columns()
-	if err != nil {
-		return nil, err
-	}
-
-	out := make(AggregatedFields)
-	vals := make([]interface{}, len(cols))
-	for i := 0; i < len(cols); i++ {
-		vals[i] = new(interface{})
-	}
-
-	rows.Next()
-	err = rows.Scan(vals...)
-	if err != nil {
-		return nil, err
-	}
-
-	for i := 0; i < len(cols); i++ {
-		out[fields[i]] = (*(vals[i].(*interface{}))).(int64)
-	}
-
-	return out, nil
-}
-
-func (p *Postgres) SumOfActiveInstallsMap(hours int, field string) (AggregatedFields, error) {
-	if !fieldIsValid(field) {
-		return nil, errors.New("Invalid field")
-	}
-
-	parts := strings.Split(field, ".")
-	path := "'" + strings.Join(parts, "','") + "'"
-
-	sql := `SELECT jet.key, sum(jet.value::int)
-FROM installation i
-	JOIN record r ON (i.last_record = r.id),
-	json_each_text(json_extract_path(r.data,%s)) AS jet
-WHERE i.last_seen >= NOW() - INTERVAL '%d hour'
-GROUP BY jet.key
-ORDER BY jet.key`
-
-	sql = fmt.Sprintf(sql, path, hours)
-	log.Debugf("Query: %s", sql)
-	rows, err := p.Conn.Query(sql)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	out := make(AggregatedFields)
-
-	for rows.Next() {
-		var key string
-		var val int64
-
-		err = rows.Scan(&key, &val)
-		if err != nil {
-			return nil, err
-		}
-
-		out[key] = val
-	}
-
-	return out, nil
-}
-
-func (p *Postgres) SumOfActiveInstallsValue(hours int, field string) (AggregatedFields, error) {
-	if !fieldIsValid(field) {
-		return nil, errors.New("Invalid field")
-	}
-
-	parts := strings.Split(field, ".")
-	path := "'" + strings.Join(parts, "','") + "'"
-
-	sql := `SELECT key, count(*) AS value 
-FROM installation i
-	JOIN record r ON (i.last_record = r.id),
-	json_extract_path_text(r.data,%s) AS key
-WHERE i.last_seen >= NOW() - INTERVAL '%d hour'
-GROUP BY key
-ORDER BY value DESC`
-
-	sql = fmt.Sprintf(sql, path, hours)
-	log.Debugf("Query: %s", sql)
-	rows, err := p.Conn.Query(sql)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	out := make(AggregatedFields)
-
-	for rows.Next() {
-		var key string
-		var val int64
-
-		err = rows.Scan(&key, &val)
-		if err != nil {
-			return nil, err
-		}
-
-		out[key] = val
-	}
-
-	return out, nil
-}
-
-func (p *Postgres) SumByDay(days int, fields []string, uid string) (AggregatedFieldsByDate, error) {
-	sql := `SELECT
-	%s,
-	b.day
+func (p *Postgres) EachRecordByDay(days int, filters []Filter, fn func(day string, rec ApiRecord) error) error {
+	sql := `SELECT b.day, r.id, r.uid, r.ts, r.data
 FROM byday b
-	JOIN record r on (b.record_id=r.id)
-WHERE b.day >= (to_date('%s','YYYY-MM-DD') - INTERVAL '%d day')
-	AND b.uid %s $1
-GROUP BY day
-ORDER BY day`
-
-	today := time.Now().Format("2006-01-02")
-
-	fieldSql, err := fieldQuery(fields, "r.data")
-	if err != nil {
-		return nil, err
-	}
-
-	op := "="
-	if uid == "" {
-		op = "<>"
-	}
-
-	sql = fmt.Sprintf(sql, fieldSql, today, days, op)
-	log.Debugf("Query: %s", sql)
-	rows, err := p.Conn.Query(sql, uid)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	cols, err := rows.Columns()
-	if err != nil {
-		return nil, err
-	}
-
-	out := make(AggregatedFieldsByDate)
-
-	vals := make([]interface{}, len(cols))
-	for i := 0; i < len(cols); i++ {
-		vals[i] = new(interface{})
-	}
-
-	for rows.Next() {
-		err = rows.Scan(vals...)
-		if err != nil {
-			return nil, err
-		}
-
-		entry := make(AggregatedFields)
-
-		for i := 0; i < len(cols)-1; i++ {
-			switch val := (*(vals[i].(*interface{}))).(type) {
-			case int64:
-				entry[fields[i]] = val
-			}
-		}
-
-		day := (*(vals[len(cols)-1].(*interface{}))).(time.Time)
-		dayStr := day.Format("2006-01-02")
-
-		out[dayStr] = entry
-	}
-
-	return out, nil
-}
-
-func (p *Postgres) SumByDayMap(days int, field string, uid string) (AggregatedFieldsByDate, error) {
-	if !fieldIsValid(field) {
-		return nil, errors.New("Invalid field")
-	}
+	JOIN record r ON (b.record_id = r.id)
+WHERE b.day >= (to_date('%s','YYYY-MM-DD') - INTERVAL '%d day')%s
+ORDER BY b.day, b.uid`
 
 	today := time.Now().Format("2006-01-02")
 
-	parts := strings.Split(field, ".")
-	path := "'" + strings.Join(parts, "','") + "'"
-
-	sql := `SELECT b.day, jet.key, sum(jet.value::int)
-FROM byday b
-	JOIN record r ON (b.record_id = r.id),
-	json_each_text(json_extract_path(r.data,%s)) AS jet
-WHERE b.day >= (to_date('%s','YYYY-MM-DD') - INTERVAL '%d day')
-	AND b.uid %s $1
-GROUP BY b.day, jet.key
-ORDER BY b.day, jet.key`
-
-	op := "="
-	if uid == "" {
-		op = "<>"
-	}
-
-	sql = fmt.Sprintf(sql, path, today, days, op)
+	where, args := filterWhere("r", filters, nil)
+	sql = fmt.Sprintf(sql, today, days, where)
 	log.Debugf("Query: %s", sql)
-	rows, err := p.Conn.Query(sql, uid)
+	rows, err := p.Conn.Query(sql, args...)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer rows.Close()
 
-	out := make(AggregatedFieldsByDate)
-
 	for rows.Next() {
 		var day time.Time
-		var key string
-		var val int64
-
-		err = rows.Scan(&day, &key, &val)
-
+		var rec ApiRecord
+		var data []byte
+		err = rows.Scan(&day, &rec.Id, &rec.Uid, &rec.Ts, &data)
 		if err != nil {
-			return nil, err
-		}
-
-		dayStr := day.Format("2006-01-02")
-		byDate, ok := out[dayStr]
-		if !ok {
-			byDate = make(AggregatedFields)
-			out[dayStr] = byDate
+			return err
 		}
 
-		byDate[key] = val
-	}
-
-	return out, nil
-}
-
-func (p *Postgres) SumByDayValue(days int, field string, uid string) (AggregatedFieldsByDate, error) {
-	if !fieldIsValid(field) {
-		return nil, errors.New("Invalid field")
-	}
-
-	today := time.Now().Format("2006-01-02")
-
-	parts := strings.Split(field, ".")
-	path := "'" + strings.Join(parts, "','") + "'"
-
-	sql := `SELECT b.day, key, count(*) AS value 
-FROM byday b
-	JOIN record r ON (b.record_id = r.id),
-	json_extract_path_text(r.data,%s) AS key
-WHERE b.day >= (to_date('%s','YYYY-MM-DD') - INTERVAL '%d day')
-	AND b.uid %s $1
-GROUP BY b.day, key
-ORDER BY b.day, value DESC`
-
-	op := "="
-	if uid == "" {
-		op = "<>"
-	}
-
-	sql = fmt.Sprintf(sql, path, today, days, op)
-	log.Debugf("Query: %s", sql)
-	rows, err := p.Conn.Query(sql, uid)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	out := make(AggregatedFieldsByDate)
-
-	for rows.Next() {
-		var day time.Time
-		var key string
-		var val int64
-
-		err = rows.Scan(&day, &key, &val)
-
+		err = json.Unmarshal(data, &rec.Record)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		dayStr := day.Format("2006-01-02")
-		byDate, ok := out[dayStr]
-		if !ok {
-			byDate = make(AggregatedFields)
-			out[dayStr] = byDate
+		if err = fn(day.Format("2006-01-02"), rec); err != nil {
+			return err
 		}
-
-		byDate[key] = val
 	}
 
-	return out, nil
+	return rows.Err()
 }
 
 func fieldIsValid(field string) bool {
@@ -548,32 +314,24 @@ func fieldIsValid(field string) bool {
 	return field != "" && validField.MatchString(field)
 }
 
-func fieldQuery(fields []string, dataField string) (string, error) {
-	out := []string{}
-
-	for _, field := range fields {
-		if !fieldIsValid(field) {
-			return "", errors.New("Invalid field")
-		}
+// Record fields that are also stored in their own column, see the jsonb migration
+var generatedColumns = map[string]string{
+	"install.version": "install_version",
+	"cluster.active":  "cluster_active",
+	"cluster.total":   "cluster_total",
+	"node.active":     "node_active",
+	"node.total":      "node_total",
+}
 
-		parts := strings.Split(field, ".")
-		prefix := ""
-		fn := ""
-		suffix := ""
-		if strings.HasSuffix(field, "_min") {
-			fn = "min"
-		} else if strings.HasSuffix(field, "_avg") {
-			prefix = "round("
-			fn = "avg"
-			suffix = ")::int"
-		} else if strings.HasSuffix(field, "_max") {
-			fn = "max"
-		} else {
-			fn = "sum"
-		}
+// fieldPath returns a jsonb path literal for a field like "cluster.cpu.cores"
+func fieldPath(field string) string {
+	return "'{" + strings.Join(strings.Split(field, "."), ",") + "}'"
+}
 
-		out = append(out, "  "+prefix+fn+"(json_extract_path("+dataField+",'"+strings.Join(parts, "','")+"')::text::int)"+suffix+" AS \""+field+"\"")
+// fieldText returns the SQL for a field of the record in table alias as text
+func fieldText(alias string, field string) string {
+	if col, ok := generatedColumns[field]; ok {
+		return alias + "." + col + "::text"
 	}
-
-	return strings.Join(out, ",\n"), nil
+	return alias + ".data #>> " + fieldPath(field)
 }
@@ -0,0 +1,678 @@
+package publish
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultQueryDays  = 28
+	MaxQueryGroupBy   = 5
+	MaxQueryAggregate = 20
+)
+
+var (
+	queryIntervals  = map[string]bool{"": true, "day": true, "week": true, "month": true}
+	queryFunctions  = map[string]bool{"sum": true, "min": true, "max": true, "avg": true, "count": true, "percentile": true}
+	filterPattern   = regexp.MustCompile(`^\s*([a-zA-Z0-9._-]+)\s*(>=|<=|!=|=|>|<)\s*(.*?)\s*$`)
+	filterOperators = map[string]string{"=": "=", "!=": "<>", ">": ">", ">=": ">=", "<": "<", "<=": "<="}
+)
+
+// Query aggregates the records installs sent over a range of days. In each period every install
+// counts once, with the last record it sent in the period.
+//
+// A groupBy field ending in .*, like node.kubelet.*, groups by the keys of a map instead, counting
+// an install under each key its map has. Aggregates of the same field read the value under the key,
+// e.g. the sum of node.kubelet.* is the number of nodes running each kubelet version.
+type Query struct {
+	From       string      `json:"from,omitempty"`     // first day, YYYY-MM-DD, defaults to 28 days ago
+	To         string      `json:"to,omitempty"`       // last day, defaults to today
+	Since      *time.Time  `json:"since,omitempty"`    // installs whose last record in the period came at or after, From defaulting to its day
+	Interval   string      `json:"interval,omitempty"` // day, week or month, or empty for the whole range
+	GroupBy    []string    `json:"groupBy,omitempty"`  // record fields to group by, e.g. install.version
+	Filters    []string    `json:"filters,omitempty"`  // e.g. "cluster.driver.rke2 > 0"
+	Aggregates []Aggregate `json:"aggregates"`
+
+	from    time.Time
+	to      time.Time
+	filters []Filter
+}
+
+// Aggregate is a function over a record field, named fn(field) in results unless As is set
+type Aggregate struct {
+	Fn    string  `json:"fn"`
+	Field string  `json:"field,omitempty"`
+	P     float64 `json:"p,omitempty"` // for percentile, between 0 and 1
+	As    string  `json:"as,omitempty"`
+}
+
+type QueryRow struct {
+	Period string                 `json:"period"`
+	Group  map[string]interface{} `json:"group,omitempty"`
+	Values map[string]float64     `json:"values"`
+}
+
+type QueryResult struct {
+	Rows []QueryRow `json:"rows"`
+}
+
+// Filter compares a record field with a value. Strings compared with = or != may use * wildcards.
+type Filter struct {
+	Field string      `json:"field"`
+	Op    string      `json:"op"`
+	Value interface{} `json:"value"`
+}
+
+// ParseFilter reads a filter like cluster.total>=10, install.hasInternal=true or
+// install.version="v2.5.*"
+func ParseFilter(s string) (Filter, error) {
+	m := filterPattern.FindStringSubmatch(s)
+	if m == nil || !fieldIsValid(m[1]) {
+		return Filter{}, fmt.Errorf("Invalid filter %q", s)
+	}
+
+	f := Filter{Field: m[1], Op: m[2]}
+	raw := m[3]
+	switch {
+	case len(raw) >= 2 && raw[0] == '"' && raw[len(raw)-1] == '"':
+		f.Value = raw[1 : len(raw)-1]
+	case raw == "true" || raw == "false":
+		f.Value = raw == "true"
+	default:
+		if n, err := strconv.ParseFloat(raw, 64); err == nil {
+			f.Value = n
+		} else {
+			f.Value = raw
+		}
+	}
+
+	if _, ok := f.Value.(float64); !ok && f.Op != "=" && f.Op != "!=" {
+		return Filter{}, fmt.Errorf("Invalid filter %q: %s needs a number", s, f.Op)
+	}
+	return f, nil
+}
+
+// String returns the filter as ParseFilter reads it
+func (f Filter) String() string {
+	switch v := f.Value.(type) {
+	case float64:
+		return f.Field + f.Op + strconv.FormatFloat(v, 'g', -1, 64)
+	case bool:
+		return f.Field + f.Op + strconv.FormatBool(v)
+	}
+	return f.Field + f.Op + `"` + fmt.Sprint(f.Value) + `"`
+}
+
+// Validate checks the query and fills in its defaults
+func (q *Query) Validate() error {
+	var err error
+
+	q.to = daysAgo(0)
+	if q.To != "" {
+		if q.to, err = time.ParseInLocation("2006-01-02", q.To, time.Local); err != nil {
+			return fmt.Errorf("Invalid to %q", q.To)
+		}
+	}
+	q.from = q.to.AddDate(0, 0, -DefaultQueryDays)
+	if q.Since != nil {
+		since := q.Since.Local()
+		q.from = time.Date(since.Year(), since.Month(), since.Day(), 0, 0, 0, 0, time.Local)
+	}
+	if q.From != "" {
+		if q.from, err = time.ParseInLocation("2006-01-02", q.From, time.Local); err != nil {
+			return fmt.Errorf("Invalid from %q", q.From)
+		}
+	}
+	if q.from.After(q.to) {
+		return fmt.Errorf("from is after to")
+	}
+	q.From = q.from.Format("2006-01-02")
+	q.To = q.to.Format("2006-01-02")
+
+	if !queryIntervals[q.Interval] {
+		return fmt.Errorf("Invalid interval %q, known: day, week, month", q.Interval)
+	}
+
+	if len(q.GroupBy) > MaxQueryGroupBy {
+		return fmt.Errorf("At most %d groupBy fields are allowed", MaxQueryGroupBy)
+	}
+	maps := 0
+	for _, field := range q.GroupBy {
+		if strings.HasSuffix(field, ".*") {
+			maps++
+		}
+		if !fieldIsValid(strings.TrimSuffix(field, ".*")) {
+			return fmt.Errorf("Invalid groupBy field %q", field)
+		}
+	}
+	if maps > 1 {
+		return fmt.Errorf("At most one groupBy field may group by the keys of a map")
+	}
+	mapField, _ := q.mapGroup()
+
+	q.filters = nil
+	for _, s := range q.Filters {
+		f, err := ParseFilter(s)
+		if err != nil {
+			return err
+		}
+		q.filters = append(q.filters, f)
+	}
+
+	if len(q.Aggregates) == 0 || len(q.Aggregates) > MaxQueryAggregate {
+		return fmt.Errorf("Between 1 and %d aggregates are required", MaxQueryAggregate)
+	}
+	names := map[string]bool{}
+	for i := range q.Aggregates {
+		a := &q.Aggregates[i]
+		if !queryFunctions[a.Fn] {
+			return fmt.Errorf("Invalid aggregate %q, known: sum, min, max, avg, count, percentile", a.Fn)
+		}
+		if a.Field == "" && a.Fn != "count" {
+			return fmt.Errorf("Aggregate %s needs a field", a.Fn)
+		}
+		if a.Field != "" && a.Field != mapField && !fieldIsValid(a.Field) {
+			return fmt.Errorf("Invalid aggregate field %q", a.Field)
+		}
+		if a.Fn == "percentile" && (a.P <= 0 || a.P >= 1) {
+			return fmt.Errorf("Aggregate percentile needs a p between 0 and 1")
+		}
+		if names[a.Name()] {
+			return fmt.Errorf("Aggregate %s is repeated, name one with as", a.Name())
+		}
+		names[a.Name()] = true
+	}
+
+	return nil
+}
+
+// mapGroup returns the groupBy field that groups by the keys of a map, like node.kubelet.*
+func (q *Query) mapGroup() (string, bool) {
+	for _, field := range q.GroupBy {
+		if strings.HasSuffix(field, ".*") {
+			return field, true
+		}
+	}
+	return "", false
+}
+
+func (a Aggregate) Name() string {
+	switch {
+	case a.As != "":
+		return a.As
+	case a.Fn == "percentile":
+		return fmt.Sprintf("percentile(%s,%g)", a.Field, a.P)
+	case a.Field == "":
+		return a.Fn
+	}
+	return a.Fn + "(" + a.Field + ")"
+}
+
+// period returns the first day of the period of the query a day is in
+func (q *Query) period(day time.Time) time.Time {
+	if q.Interval == "" {
+		return q.from
+	}
+	return periodStart(q.Interval, day)
+}
+
+// periodStart returns the first day of the day, week or month a day is in
+func periodStart(interval string, day time.Time) time.Time {
+	switch interval {
+	case "week":
+		// Weeks start on Monday, like Postgres' date_trunc
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	case "month":
+		return time.Date(day.Year(), day.Month(), 1, 0, 0, 0, 0, day.Location())
+	}
+	return day
+}
+
+func (p *Postgres) Query(q *Query) (*QueryResult, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+
+	if out, ok, err := p.rollupQuery(q); ok || err != nil {
+		return out, err
+	}
+
+	sql, args := q.postgresSql()
+	log.Debugf("Query: %s", sql)
+	rows, err := p.Conn.Query(sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := &QueryResult{Rows: []QueryRow{}}
+
+	for rows.Next() {
+		var day time.Time
+		groups := make([]*string, len(q.GroupBy))
+		values := make([]*float64, len(q.Aggregates))
+
+		dest := []interface{}{&day}
+		for i := range groups {
+			dest = append(dest, &groups[i])
+		}
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+
+		if err = rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+
+		out.Rows = append(out.Rows, newQueryRow(q, day, groups, values))
+	}
+
+	return out, rows.Err()
+}
+
+// postgresSql returns the SQL answering a validated query from the records, and its arguments
+func (q *Query) postgresSql() (string, []interface{}) {
+	period := map[string]string{
+		"":      "$1::date",
+		"day":   "b.day",
+		"week":  "date_trunc('week', b.day)::date",
+		"month": "date_trunc('month', b.day)::date",
+	}[q.Interval]
+
+	// Grouping by the keys of a map joins each record with the map's entries, as m
+	mapField, byKeys := q.mapGroup()
+	join := ""
+	if byKeys {
+		path := fieldPath(strings.TrimSuffix(mapField, ".*"))
+		join = fmt.Sprintf("\n\tJOIN LATERAL jsonb_each(CASE WHEN jsonb_typeof(r.data #> %s) = 'object' THEN r.data #> %s ELSE '{}'::jsonb END) AS m ON TRUE", path, path)
+	}
+	number := func(field string) string {
+		if byKeys && field == mapField {
+			return "CASE WHEN jsonb_typeof(m.value) = 'number' THEN (m.value #>> '{}')::numeric END"
+		}
+		return fieldNumber("r", field)
+	}
+
+	cols := []string{"l.period"}
+	positions := []string{"1"}
+	for i, field := range q.GroupBy {
+		if field == mapField {
+			cols = append(cols, "m.key")
+		} else {
+			cols = append(cols, fieldText("r", field))
+		}
+		positions = append(positions, strconv.Itoa(i+2))
+	}
+
+	for _, a := range q.Aggregates {
+		var agg string
+		switch {
+		case a.Fn == "count" && a.Field == "":
+			agg = "count(*)"
+		case a.Fn == "count" && a.Field == mapField:
+			agg = "count(NULLIF(m.value, 'null'::jsonb))"
+		case a.Fn == "count":
+			// JSON nulls count as missing, as in the stores running queries in Go
+			agg = "count(NULLIF(r.data #> " + fieldPath(a.Field) + ", 'null'::jsonb))"
+		case a.Fn == "percentile":
+			agg = fmt.Sprintf("percentile_cont(%g) WITHIN GROUP (ORDER BY %s)", a.P, number(a.Field))
+		default:
+			agg = a.Fn + "(" + number(a.Field) + ")"
+		}
+		cols = append(cols, "("+agg+")::float8")
+	}
+
+	where, args := filterWhere("r", q.filters, []interface{}{q.From, q.To})
+	// The last record of an install in a period is its newest, so only that one needs checking
+	if q.Since != nil {
+		args = append(args, *q.Since)
+		where += fmt.Sprintf("\n\tAND r.ts >= $%d::timestamptz", len(args))
+	}
+
+	sql := `WITH latest AS (
+	SELECT DISTINCT ON (b.uid, %s) %s AS period, b.record_id
+	FROM byday b
+	WHERE b.day >= $1 AND b.day <= $2
+	ORDER BY b.uid, %s, b.day DESC
+)
+SELECT %s
+FROM latest l
+	JOIN record r ON (r.id = l.record_id)%s
+WHERE TRUE%s
+GROUP BY %s
+ORDER BY %s`
+
+	sql = fmt.Sprintf(sql, period, period, period, strings.Join(cols, ",\n\t"),
+		join, where, strings.Join(positions, ", "), strings.Join(positions, ", "))
+	return sql, args
+}
+
+// fieldNumber returns the SQL for a numeric field of the record in table alias, null when the
+// field is missing or not a number
+func fieldNumber(alias string, field string) string {
+	if col, ok := generatedColumns[field]; ok && field != "install.version" {
+		return alias + "." + col
+	}
+
+	path := fieldPath(field)
+	return fmt.Sprintf("CASE WHEN jsonb_typeof(%s.data #> %s) = 'number' THEN (%s.data #>> %s)::numeric END", alias, path, alias, path)
+}
+
+// filterWhere returns the conditions for filters on the record in table alias, each starting with
+// AND, and the arguments with the filter values appended
+func filterWhere(alias string, filters []Filter, args []interface{}) (string, []interface{}) {
+	where := ""
+	for _, f := range filters {
+		args = append(args, nil)
+		where += "\n\tAND " + filterSql(alias, f, len(args), args)
+	}
+	return where, args
+}
+
+// filterSql returns the condition for a filter, setting its value as argument n
+func filterSql(alias string, f Filter, n int, args []interface{}) string {
+	op := filterOperators[f.Op]
+
+	switch v := f.Value.(type) {
+	case float64:
+		args[n-1] = v
+		return fmt.Sprintf("%s %s $%d", fieldNumber(alias, f.Field), op, n)
+	case bool:
+		args[n-1] = strconv.FormatBool(v)
+		return fmt.Sprintf("%s %s $%d", fieldText(alias, f.Field), op, n)
+	}
+
+	s := fmt.Sprint(f.Value)
+	if strings.Contains(s, "*") {
+		like := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`, `*`, `%`).Replace(s)
+		args[n-1] = like
+		if f.Op == "!=" {
+			return fmt.Sprintf("%s NOT LIKE $%d", fieldText(alias, f.Field), n)
+		}
+		return fmt.Sprintf("%s LIKE $%d", fieldText(alias, f.Field), n)
+	}
+
+	args[n-1] = s
+	return fmt.Sprintf("%s %s $%d", fieldText(alias, f.Field), op, n)
+}
+
+func newQueryRow(q *Query, day time.Time, groups []*string, values []*float64) QueryRow {
+	row := QueryRow{
+		Period: day.Format("2006-01-02"),
+		Values: map[string]float64{},
+	}
+
+	if len(q.GroupBy) > 0 {
+		row.Group = map[string]interface{}{}
+		for i, field := range q.GroupBy {
+			if groups[i] == nil {
+				row.Group[field] = nil
+			} else {
+				row.Group[field] = *groups[i]
+			}
+		}
+	}
+
+	for i, a := range q.Aggregates {
+		if values[i] != nil {
+			row.Values[a.Name()] = *values[i]
+		}
+	}
+
+	return row
+}
+
+// dayRecord is the record an install counts with on a day, for the stores that run queries in Go
+type dayRecord struct {
+	Day  time.Time
+	Uid  string
+	Ts   time.Time
+	Data interface{}
+}
+
+// runQuery answers a validated query from the day records in its range, as Postgres.Query would
+func runQuery(q *Query, records []dayRecord) *QueryResult {
+	type periodUid struct {
+		period time.Time
+		uid    string
+	}
+
+	latest := map[periodUid]dayRecord{}
+	for _, rec := range records {
+		k := periodUid{q.period(rec.Day), rec.Uid}
+		if cur, ok := latest[k]; !ok || rec.Day.After(cur.Day) {
+			latest[k] = rec
+		}
+	}
+
+	type group struct {
+		period time.Time
+		keys   []*string
+		count  float64
+		values [][]float64
+	}
+
+	groups := map[string]*group{}
+	for k, rec := range latest {
+		if !matchFilters(rec.Data, q.filters) || (q.Since != nil && rec.Ts.Before(*q.Since)) {
+			continue
+		}
+
+		for _, r := range q.split(rec.Data) {
+			keys := make([]*string, len(q.GroupBy))
+			for i, field := range q.GroupBy {
+				if s, ok := r.group(field); ok {
+					keys[i] = &s
+				}
+			}
+
+			id, _ := json.Marshal([]interface{}{k.period, keys})
+			g, ok := groups[string(id)]
+			if !ok {
+				g = &group{period: k.period, keys: keys, values: make([][]float64, len(q.Aggregates))}
+				groups[string(id)] = g
+			}
+
+			g.count++
+			for i, a := range q.Aggregates {
+				if a.Field == "" {
+					continue
+				}
+				v, ok := r.value(a.Field)
+				if !ok {
+					continue
+				}
+				if a.Fn == "count" {
+					g.values[i] = append(g.values[i], 0)
+				} else if n, ok := numberValue(v); ok {
+					g.values[i] = append(g.values[i], n)
+				}
+			}
+		}
+	}
+
+	sorted := make([]*group, 0, len(groups))
+	for _, g := range groups {
+		sorted = append(sorted, g)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if !a.period.Equal(b.period) {
+			return a.period.Before(b.period)
+		}
+		for k := range a.keys {
+			switch {
+			case a.keys[k] == nil && b.keys[k] == nil:
+				continue
+			case a.keys[k] == nil || b.keys[k] == nil:
+				// Nulls sort last, as in Postgres
+				return b.keys[k] == nil
+			case *a.keys[k] != *b.keys[k]:
+				return *a.keys[k] < *b.keys[k]
+			}
+		}
+		return false
+	})
+
+	out := &QueryResult{Rows: []QueryRow{}}
+	for _, g := range sorted {
+		values := make([]*float64, len(q.Aggregates))
+		for i, a := range q.Aggregates {
+			if a.Fn == "count" && a.Field == "" {
+				count := g.count
+				values[i] = &count
+				continue
+			}
+			values[i] = aggregateNumbers(a, g.values[i])
+		}
+		out.Rows = append(out.Rows, newQueryRow(q, g.period, g.keys, values))
+	}
+
+	return out
+}
+
+// splitRecord is a record as a query groups it. Grouping by the keys of a map splits a record into
+// one per key, in which the map field holds the value under the key.
+type splitRecord struct {
+	data  interface{}
+	field string
+	key   string
+	val   interface{}
+}
+
+// split returns the records a query groups a record as
+func (q *Query) split(data interface{}) []splitRecord {
+	field, ok := q.mapGroup()
+	if !ok {
+		return []splitRecord{{data: data}}
+	}
+
+	v, _ := fieldValue(data, strings.TrimSuffix(field, ".*"))
+	m, _ := v.(map[string]interface{})
+	out := make([]splitRecord, 0, len(m))
+	for key, value := range m {
+		out = append(out, splitRecord{data: data, field: field, key: key, val: value})
+	}
+	return out
+}
+
+// group returns the text of a field grouped by
+func (r splitRecord) group(field string) (string, bool) {
+	if r.field != "" && field == r.field {
+		return r.key, true
+	}
+	v, ok := fieldValue(r.data, field)
+	if !ok {
+		return "", false
+	}
+	return textValue(v), true
+}
+
+// value returns a field aggregated
+func (r splitRecord) value(field string) (interface{}, bool) {
+	if r.field != "" && field == r.field {
+		return r.val, r.val != nil
+	}
+	return fieldValue(r.data, field)
+}
+
+// aggregateNumbers applies an aggregate function, returning nil like SQL when there is nothing to
+// aggregate
+func aggregateNumbers(a Aggregate, ns []float64) *float64 {
+	var out float64
+	if a.Fn == "count" {
+		out = float64(len(ns))
+		return &out
+	}
+	if len(ns) == 0 {
+		return nil
+	}
+
+	switch a.Fn {
+	case "sum", "avg":
+		for _, n := range ns {
+			out += n
+		}
+		if a.Fn == "avg" {
+			out /= float64(len(ns))
+		}
+	case "min", "max":
+		out = ns[0]
+		for _, n := range ns[1:] {
+			if (a.Fn == "min" && n < out) || (a.Fn == "max" && n > out) {
+				out = n
+			}
+		}
+	case "percentile":
+		// Interpolated between the closest values, like percentile_cont
+		sort.Float64s(ns)
+		pos := a.P * float64(len(ns)-1)
+		i := int(pos)
+		out = ns[i]
+		if i+1 < len(ns) {
+			out += (ns[i+1] - ns[i]) * (pos - float64(i))
+		}
+	}
+	return &out
+}
+
+func matchFilters(data interface{}, filters []Filter) bool {
+	for _, f := range filters {
+		if !f.Match(data) {
+			return false
+		}
+	}
+	return true
+}
+
+// Match checks a decoded record against the filter; a missing field matches nothing, as in SQL
+func (f Filter) Match(data interface{}) bool {
+	v, ok := fieldValue(data, f.Field)
+	if !ok {
+		return false
+	}
+
+	switch want := f.Value.(type) {
+	case float64:
+		n, ok := numberValue(v)
+		if !ok {
+			return false
+		}
+		switch f.Op {
+		case "=":
+			return n == want
+		case "!=":
+			return n != want
+		case ">":
+			return n > want
+		case ">=":
+			return n >= want
+		case "<":
+			return n < want
+		case "<=":
+			return n <= want
+		}
+		return false
+	case bool:
+		return (textValue(v) == strconv.FormatBool(want)) == (f.Op == "=")
+	}
+
+	s := fmt.Sprint(f.Value)
+	text := textValue(v)
+	match := text == s
+	if strings.Contains(s, "*") {
+		parts := strings.Split(s, "*")
+		for i := range parts {
+			parts[i] = regexp.QuoteMeta(parts[i])
+		}
+		match = regexp.MustCompile("^" + strings.Join(parts, ".*") + "$").MatchString(text)
+	}
+	return match == (f.Op == "=")
+}
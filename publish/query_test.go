@@ -0,0 +1,242 @@
+package publish
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestQuerySql checks the SQL the Postgres store answers queries with, which the tests running on
+// Postgres compare with the Go stores
+func TestQuerySql(t *testing.T) {
+	since := time.Date(2020, 10, 5, 9, 30, 0, 0, time.Local)
+
+	tests := []struct {
+		name  string
+		q     Query
+		parts []string
+		args  []interface{}
+	}{
+		{
+			name: "totals over the range",
+			q:    Query{From: "2020-10-01", To: "2020-10-07", Aggregates: []Aggregate{{Fn: "count"}, {Fn: "sum", Field: "cluster.total"}}},
+			parts: []string{
+				"SELECT DISTINCT ON (b.uid, $1::date) $1::date AS period, b.record_id",
+				"WHERE b.day >= $1 AND b.day <= $2",
+				"ORDER BY b.uid, $1::date, b.day DESC",
+				"(count(*))::float8",
+				"(sum(r.cluster_total))::float8",
+				"GROUP BY 1\nORDER BY 1",
+			},
+			args: []interface{}{"2020-10-01", "2020-10-07"},
+		},
+		{
+			name: "by week and version",
+			q: Query{From: "2020-10-01", To: "2020-10-31", Interval: "week", GroupBy: []string{"install.version"},
+				Aggregates: []Aggregate{{Fn: "count", Field: "node.os"}, {Fn: "percentile", Field: "node.total", P: 0.9}}},
+			parts: []string{
+				"date_trunc('week', b.day)::date AS period",
+				"r.install_version::text",
+				"(count(NULLIF(r.data #> '{node,os}', 'null'::jsonb)))::float8",
+				"(percentile_cont(0.9) WITHIN GROUP (ORDER BY r.node_total))::float8",
+				"GROUP BY 1, 2\nORDER BY 1, 2",
+			},
+			args: []interface{}{"2020-10-01", "2020-10-31"},
+		},
+		{
+			name: "by map keys",
+			q: Query{From: "2020-10-01", To: "2020-10-01", Interval: "day", GroupBy: []string{"node.kubelet.*"},
+				Aggregates: []Aggregate{{Fn: "sum", Field: "node.kubelet.*"}, {Fn: "count", Field: "node.kubelet.*"}}},
+			parts: []string{
+				"JOIN LATERAL jsonb_each(CASE WHEN jsonb_typeof(r.data #> '{node,kubelet}') = 'object' THEN r.data #> '{node,kubelet}' ELSE '{}'::jsonb END) AS m ON TRUE",
+				"\tm.key",
+				"(sum(CASE WHEN jsonb_typeof(m.value) = 'number' THEN (m.value #>> '{}')::numeric END))::float8",
+				"(count(NULLIF(m.value, 'null'::jsonb)))::float8",
+			},
+			args: []interface{}{"2020-10-01", "2020-10-01"},
+		},
+		{
+			name: "filtered",
+			q: Query{From: "2020-10-01", To: "2020-10-07", Aggregates: []Aggregate{{Fn: "max", Field: "cluster.cpu.cores"}},
+				Filters: []string{`install.version="v2.5.*"`, "cluster.total>=10", "install.hasInternal=true"}},
+			parts: []string{
+				"(max(CASE WHEN jsonb_typeof(r.data #> '{cluster,cpu,cores}') = 'number' THEN (r.data #>> '{cluster,cpu,cores}')::numeric END))::float8",
+				"WHERE TRUE\n\tAND r.install_version::text LIKE $3\n\tAND r.cluster_total >= $4\n\tAND r.data #>> '{install,hasInternal}' = $5\n",
+			},
+			args: []interface{}{"2020-10-01", "2020-10-07", "v2.5.%", float64(10), "true"},
+		},
+		{
+			name: "since an hour",
+			q:    Query{Since: &since, Aggregates: []Aggregate{{Fn: "count"}}, Filters: []string{"cluster.total>1"}},
+			parts: []string{
+				"WHERE TRUE\n\tAND r.cluster_total > $3\n\tAND r.ts >= $4::timestamptz\n",
+			},
+			args: []interface{}{"2020-10-05", daysAgo(0).Format("2006-01-02"), float64(1), since},
+		},
+	}
+
+	for _, test := range tests {
+		q := test.q
+		if err := q.Validate(); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+
+		sql, args := q.postgresSql()
+		for _, part := range test.parts {
+			if !strings.Contains(sql, part) {
+				t.Errorf("%s: %q missing from\n%s", test.name, part, sql)
+			}
+		}
+		if !reflect.DeepEqual(args, test.args) {
+			t.Errorf("%s: got args %#v, want %#v", test.name, args, test.args)
+		}
+	}
+}
+
+// TestQuerySince counts the installs whose last record came since a time, as Postgres does with
+// the SQL above
+func TestQuerySince(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2020, 10, d, 0, 0, 0, 0, time.Local) }
+	records := []dayRecord{
+		{Day: day(4), Uid: "a", Ts: day(4).Add(20 * time.Hour), Data: map[string]interface{}{}},
+		{Day: day(5), Uid: "b", Ts: day(5).Add(8 * time.Hour), Data: map[string]interface{}{}},
+		{Day: day(5), Uid: "c", Ts: day(5).Add(10 * time.Hour), Data: map[string]interface{}{}},
+		// a's last record is before the hour
+		{Day: day(5), Uid: "a", Ts: day(5).Add(9 * time.Hour), Data: map[string]interface{}{}},
+	}
+
+	since := day(5).Add(9*time.Hour + 30*time.Minute)
+	q := Query{Since: &since, To: "2020-10-05", Aggregates: []Aggregate{{Fn: "count"}}}
+	if err := q.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if q.From != "2020-10-05" {
+		t.Errorf("From: got %s, want the day of since", q.From)
+	}
+
+	result := runQuery(&q, records)
+	if len(result.Rows) != 1 || result.Rows[0].Values["count"] != 1 {
+		t.Errorf("Installs since 9:30: got %+v, want c alone", result.Rows)
+	}
+}
+
+func TestParseFilter(t *testing.T) {
+	tests := []struct {
+		s    string
+		want Filter
+	}{
+		{"cluster.total>=10", Filter{Field: "cluster.total", Op: ">=", Value: float64(10)}},
+		{" install.hasInternal = true ", Filter{Field: "install.hasInternal", Op: "=", Value: true}},
+		{`install.version="v2.5.*"`, Filter{Field: "install.version", Op: "=", Value: "v2.5.*"}},
+		{"install.version!=v2.5.1", Filter{Field: "install.version", Op: "!=", Value: "v2.5.1"}},
+		{`node.os.linux-amd64="10"`, Filter{Field: "node.os.linux-amd64", Op: "=", Value: "10"}},
+	}
+	for _, test := range tests {
+		got, err := ParseFilter(test.s)
+		if err != nil {
+			t.Errorf("%s: %s", test.s, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %#v, want %#v", test.s, got, test.want)
+		}
+		// String gives back what ParseFilter reads
+		if again, err := ParseFilter(got.String()); err != nil || !reflect.DeepEqual(again, got) {
+			t.Errorf("%s: %s parses as %#v, %v", test.s, got.String(), again, err)
+		}
+	}
+
+	for _, s := range []string{
+		"",
+		"cluster.total",
+		"=10",
+		"install version=v2.5.1",
+		"install'.version=1",
+		"data#>>'{install}'=1",
+		"cluster.total;--=1",
+		`install.version>"v2.5"`,
+		"install.hasInternal<true",
+	} {
+		if f, err := ParseFilter(s); err == nil {
+			t.Errorf("%q: got %#v, want an error", s, f)
+		}
+	}
+}
+
+// TestQueryValidateFields rejects fields the SQL would have to quote
+func TestQueryValidateFields(t *testing.T) {
+	for _, q := range []Query{
+		{GroupBy: []string{"install.version'"}, Aggregates: []Aggregate{{Fn: "count"}}},
+		{GroupBy: []string{"node.*.*"}, Aggregates: []Aggregate{{Fn: "count"}}},
+		{GroupBy: []string{""}, Aggregates: []Aggregate{{Fn: "count"}}},
+		{Aggregates: []Aggregate{{Fn: "sum", Field: "cluster total"}}},
+		{Aggregates: []Aggregate{{Fn: "max", Field: "cluster.total}'"}}},
+		{Aggregates: []Aggregate{{Fn: "count", Field: "node.kubelet.*"}}},
+		{Filters: []string{"install.version);--=1"}, Aggregates: []Aggregate{{Fn: "count"}}},
+	} {
+		if err := q.Validate(); err == nil {
+			t.Errorf("%+v: got no error", q)
+		}
+	}
+}
+
+// TestQueryFilters runs filters through the SQL Postgres answers with and through runQuery, where
+// only * is a wildcard and the % and _ of LIKE match themselves
+func TestQueryFilters(t *testing.T) {
+	day := time.Date(2020, 10, 5, 0, 0, 0, 0, time.Local)
+	install := func(uid string, version string, name string) dayRecord {
+		data := map[string]interface{}{"uid": uid, "name": name}
+		if version != "" {
+			data["version"] = version
+		}
+		return dayRecord{Day: day, Uid: uid, Ts: day, Data: map[string]interface{}{"install": data}}
+	}
+	records := []dayRecord{
+		install("a", "v2.5_1-rc1", "my_cluster"),
+		install("b", "v2.5a1", "mycluster"),
+		install("c", `a\bc`, "mine"),
+		install("d", "100%-off", "my%cluster"),
+		install("e", "", "none"),
+	}
+
+	tests := []struct {
+		filter string
+		sql    string
+		arg    interface{}
+		want   []string
+	}{
+		{`install.version="v2.5_1*"`, "r.install_version::text LIKE $1", `v2.5\_1%`, []string{"a"}},
+		{`install.version!="100%*"`, "r.install_version::text NOT LIKE $1", `100\%%`, []string{"a", "b", "c"}},
+		{`install.version="a\b*"`, "r.install_version::text LIKE $1", `a\\b%`, []string{"c"}},
+		{`install.version="v2.5_1"`, "r.install_version::text = $1", "v2.5_1", []string{}},
+		{`install.name="my_*"`, "r.data #>> '{install,name}' LIKE $1", `my\_%`, []string{"a"}},
+		{`install.name="*%*"`, "r.data #>> '{install,name}' LIKE $1", `%\%%`, []string{"d"}},
+	}
+
+	for _, test := range tests {
+		f, err := ParseFilter(test.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		args := []interface{}{nil}
+		if sql := filterSql("r", f, 1, args); sql != test.sql || args[0] != test.arg {
+			t.Errorf("%s: got %s with %q, want %s with %q", test.filter, sql, args[0], test.sql, test.arg)
+		}
+
+		q := Query{From: "2020-10-05", To: "2020-10-05", GroupBy: []string{"install.uid"},
+			Filters: []string{test.filter}, Aggregates: []Aggregate{{Fn: "count"}}}
+		if err := q.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for _, row := range runQuery(&q, records).Rows {
+			got = append(got, row.Group["install.uid"].(string))
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.filter, got, test.want)
+		}
+	}
+}
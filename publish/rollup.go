@@ -0,0 +1,656 @@
+package publish
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+)
+
+// String fields unique to each install, which would make a rollup row per install
+var rollupSkipValues = []string{"ts", "install.uid"}
+
+// rollupDay flattens the records of every install on a day into sums of each numeric field, keyed by
+// the parent path and key so map entries like node.kubelet.v1.18.3 stay apart from nested fields,
+// and counts of each string value
+const rollupDay = `WITH RECURSIVE flat(parent, key, value) AS (
+	SELECT ''::text, e.key, e.value
+	FROM byday b
+		JOIN record r ON (b.record_id = r.id),
+		jsonb_each(r.data) AS e
+	WHERE b.day = $1::date
+UNION ALL
+	SELECT CASE WHEN f.parent = '' THEN f.key ELSE f.parent || '.' || f.key END, e.key, e.value
+	FROM flat f,
+		jsonb_each(CASE WHEN jsonb_typeof(f.value) = 'object' THEN f.value ELSE '{}' END) AS e
+), numbers AS (
+	INSERT INTO rollup_number(day,field,key,sum,count,min,max)
+	SELECT $1::date, parent, key, sum(value::text::numeric), count(*), min(value::text::numeric), max(value::text::numeric)
+	FROM flat
+	WHERE jsonb_typeof(value) = 'number'
+	GROUP BY parent, key
+)
+INSERT INTO rollup_value(day,field,value,count)
+SELECT $1::date, path, value #>> '{}', count(*)
+FROM (SELECT CASE WHEN parent = '' THEN key ELSE parent || '.' || key END AS path, value FROM flat) AS v
+WHERE jsonb_typeof(value) IN ('string','boolean')
+	AND NOT (path = ANY($2))
+GROUP BY path, value #>> '{}'`
+
+// rollupLock is taken for a day while its rollups change, by a report applying its record or a
+// refresh recomputing the day, so the two don't interleave
+const rollupLock = `SELECT pg_advisory_xact_lock(hashtext('rollup'), $1::date - DATE '2000-01-01')`
+
+// Changed numeric fields of a record, as the parent, key, and the old and new value of each; a
+// field new to the record has no old value and one gone from it no new value
+const (
+	rollupNumbers = `unnest($2::text[], $3::text[], $4::numeric[], $5::numeric[]) AS d(field, key, old, new)`
+
+	rollupAddNumbers = `INSERT INTO rollup_number(day,field,key,sum,count,min,max)
+SELECT $1::date, field, key, new, 1, new, new
+FROM ` + rollupNumbers + `
+WHERE old IS NULL
+ORDER BY field, key
+ON CONFLICT(day,field,key) DO UPDATE SET
+	sum = rollup_number.sum + EXCLUDED.sum,
+	count = rollup_number.count + 1,
+	min = LEAST(rollup_number.min, EXCLUDED.min),
+	max = GREATEST(rollup_number.max, EXCLUDED.max)`
+
+	rollupChangeNumbers = `UPDATE rollup_number n SET
+	sum = n.sum - d.old + COALESCE(d.new, 0),
+	count = n.count - CASE WHEN d.new IS NULL THEN 1 ELSE 0 END,
+	min = LEAST(n.min, d.new),
+	max = GREATEST(n.max, d.new)
+FROM ` + rollupNumbers + `
+WHERE d.old IS NOT NULL AND n.day = $1 AND n.field = d.field AND n.key = d.key`
+
+	// An old value that was the min or max may have been the only one, which only a refresh can tell
+	rollupStaleNumbers = `SELECT EXISTS (SELECT 1
+FROM rollup_number n, ` + rollupNumbers + `
+WHERE d.old IS NOT NULL AND n.day = $1 AND n.field = d.field AND n.key = d.key AND n.count > 0
+	AND ((n.min = d.old AND (d.new IS NULL OR d.new > d.old)) OR (n.max = d.old AND (d.new IS NULL OR d.new < d.old))))`
+
+	rollupDeleteNumbers = `DELETE FROM rollup_number WHERE day = $1 AND field = ANY($2) AND count <= 0`
+)
+
+// Changed string and boolean fields of a record, as the path, and the old and new value of each
+const (
+	rollupValues = `unnest($2::text[], $3::text[], $4::text[]) AS d(field, old, new)`
+
+	rollupAddValues = `INSERT INTO rollup_value(day,field,value,count)
+SELECT $1::date, field, new, 1
+FROM ` + rollupValues + `
+WHERE new IS NOT NULL
+ORDER BY field, new
+ON CONFLICT(day,field,value) DO UPDATE SET count = rollup_value.count + 1`
+
+	rollupRemoveValues = `UPDATE rollup_value v SET count = v.count - 1
+FROM ` + rollupValues + `
+WHERE d.old IS NOT NULL AND v.day = $1 AND v.field = d.field AND v.value = d.old`
+
+	rollupDeleteValues = `DELETE FROM rollup_value WHERE day = $1 AND field = ANY($2) AND count <= 0`
+)
+
+// markDirty queues a day's rollups to be recomputed
+func markDirty(tx *sql.Tx, day string) error {
+	_, err := tx.Exec(`INSERT INTO rollup_dirty(day) VALUES ($1) ON CONFLICT(day) DO NOTHING`, day)
+	return err
+}
+
+// updateRollups applies a day's record of an install to the day's rollups, replacing the install's
+// previous record of the day if there was one. Only the fields that changed are touched. Days
+// waiting for a refresh are left to it, and so are days whose min or max a replaced value may
+// have been, as those can only be found again from all the records.
+func updateRollups(tx *sql.Tx, day string, oldId sql.NullInt64, newId int) error {
+	_, err := tx.Exec(rollupLock, day)
+	if err != nil {
+		return err
+	}
+
+	var dirty bool
+	err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM rollup_dirty WHERE day = $1)`, day).Scan(&dirty)
+	if err != nil || dirty {
+		return err
+	}
+
+	// A first record of the install on the day
+	if !oldId.Valid {
+		_, err = tx.Exec(`
+			INSERT INTO rollup_install(day,installs) VALUES ($1,1)
+			ON CONFLICT(day) DO UPDATE SET installs = rollup_install.installs + 1`, day)
+		if err != nil {
+			return err
+		}
+	}
+
+	oldFields := newRollupFields()
+	if oldId.Valid {
+		if err = oldFields.load(tx, int(oldId.Int64)); err != nil {
+			return err
+		}
+	}
+	newFields := newRollupFields()
+	if err = newFields.load(tx, newId); err != nil {
+		return err
+	}
+
+	var parents, keys []string
+	var oldNumbers, newNumbers []sql.NullString
+	for _, k := range changedKeys(oldFields.numbers, newFields.numbers) {
+		parents = append(parents, k.field)
+		keys = append(keys, k.key)
+		oldNumbers = append(oldNumbers, oldFields.numbers[k])
+		newNumbers = append(newNumbers, newFields.numbers[k])
+	}
+
+	if len(keys) > 0 {
+		args := []interface{}{day, pq.Array(parents), pq.Array(keys), pq.Array(oldNumbers), pq.Array(newNumbers)}
+		for _, query := range []string{rollupAddNumbers, rollupChangeNumbers} {
+			log.Debugf("Query: %s", query)
+			if _, err = tx.Exec(query, args...); err != nil {
+				return err
+			}
+		}
+
+		var stale bool
+		log.Debugf("Query: %s", rollupStaleNumbers)
+		err = tx.QueryRow(rollupStaleNumbers, args...).Scan(&stale)
+		if err != nil {
+			return err
+		}
+		if stale {
+			if err = markDirty(tx, day); err != nil {
+				return err
+			}
+		}
+
+		if _, err = tx.Exec(rollupDeleteNumbers, day, pq.Array(parents)); err != nil {
+			return err
+		}
+	}
+
+	var paths []string
+	var oldValues, newValues []sql.NullString
+	for _, k := range changedKeys(oldFields.values, newFields.values) {
+		paths = append(paths, k.field)
+		oldValues = append(oldValues, oldFields.values[k])
+		newValues = append(newValues, newFields.values[k])
+	}
+
+	if len(paths) > 0 {
+		args := []interface{}{day, pq.Array(paths), pq.Array(oldValues), pq.Array(newValues)}
+		for _, query := range []string{rollupAddValues, rollupRemoveValues} {
+			log.Debugf("Query: %s", query)
+			if _, err = tx.Exec(query, args...); err != nil {
+				return err
+			}
+		}
+
+		if _, err = tx.Exec(rollupDeleteValues, day, pq.Array(paths)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type rollupKey struct {
+	field string
+	key   string
+}
+
+// rollupFields are the fields of a record as rollupDay flattens them: numbers by parent and key,
+// and strings and booleans by path
+type rollupFields struct {
+	numbers map[rollupKey]sql.NullString
+	values  map[rollupKey]sql.NullString
+}
+
+func newRollupFields() *rollupFields {
+	return &rollupFields{
+		numbers: map[rollupKey]sql.NullString{},
+		values:  map[rollupKey]sql.NullString{},
+	}
+}
+
+func (f *rollupFields) load(tx *sql.Tx, id int) error {
+	var data []byte
+	err := tx.QueryRow(`SELECT data FROM record WHERE id = $1`, id).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var obj map[string]interface{}
+	if err = dec.Decode(&obj); err != nil {
+		return err
+	}
+
+	f.add("", obj)
+	return nil
+}
+
+func (f *rollupFields) add(parent string, obj map[string]interface{}) {
+	for key, value := range obj {
+		path := key
+		if parent != "" {
+			path = parent + "." + key
+		}
+
+		switch v := value.(type) {
+		case json.Number:
+			f.numbers[rollupKey{parent, key}] = sql.NullString{String: v.String(), Valid: true}
+		case string:
+			if !isRollupSkipped(path) {
+				f.values[rollupKey{field: path}] = sql.NullString{String: v, Valid: true}
+			}
+		case bool:
+			if !isRollupSkipped(path) {
+				f.values[rollupKey{field: path}] = sql.NullString{String: strconv.FormatBool(v), Valid: true}
+			}
+		case map[string]interface{}:
+			f.add(path, v)
+		}
+	}
+}
+
+func isRollupSkipped(path string) bool {
+	for _, skip := range rollupSkipValues {
+		if path == skip {
+			return true
+		}
+	}
+	return false
+}
+
+// changedKeys returns the keys whose value differs between old and new, sorted
+func changedKeys(old, new map[rollupKey]sql.NullString) []rollupKey {
+	out := []rollupKey{}
+	for k, v := range old {
+		if new[k] != v {
+			out = append(out, k)
+		}
+	}
+	for k := range new {
+		if _, ok := old[k]; !ok {
+			out = append(out, k)
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].field != out[j].field {
+			return out[i].field < out[j].field
+		}
+		return out[i].key < out[j].key
+	})
+	return out
+}
+
+// RefreshRollups recomputes the rollups of the days marked dirty: days from before the rollups
+// existed, and days whose min or max a replaced record may have held. Reports keep the rollups of
+// other days up to date as they arrive.
+func (p *Postgres) RefreshRollups() (int, error) {
+	rows, err := p.Conn.Query(`SELECT day FROM rollup_dirty ORDER BY day DESC`)
+	if err != nil {
+		return 0, err
+	}
+
+	days := []time.Time{}
+	for rows.Next() {
+		var day time.Time
+		err = rows.Scan(&day)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		days = append(days, day)
+	}
+	rows.Close()
+
+	refreshed := 0
+	for _, day := range days {
+		done, err := p.refreshRollup(day.Format("2006-01-02"))
+		if err != nil {
+			return refreshed, fmt.Errorf("Refreshing rollups of %s failed: %s", day.Format("2006-01-02"), err)
+		}
+		if done {
+			refreshed++
+		}
+	}
+
+	return refreshed, nil
+}
+
+func (p *Postgres) refreshRollup(day string) (bool, error) {
+	tx, err := p.Conn.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(rollupLock, day)
+	if err != nil {
+		return false, err
+	}
+
+	// Another server may have got to it first
+	res, err := tx.Exec(`DELETE FROM rollup_dirty WHERE day = $1`, day)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+
+	_, err = tx.Exec(`DELETE FROM rollup_number WHERE day = $1`, day)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = tx.Exec(`DELETE FROM rollup_value WHERE day = $1`, day)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = tx.Exec(`DELETE FROM rollup_install WHERE day = $1`, day)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO rollup_install(day,installs)
+		SELECT $1::date, count(*) FROM byday WHERE day = $1 HAVING count(*) > 0`, day)
+	if err != nil {
+		return false, err
+	}
+
+	log.Debugf("Query: %s", rollupDay)
+	_, err = tx.Exec(rollupDay, day, pq.Array(rollupSkipValues))
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// splitField splits a field like node.kubelet into the rollup parent and key
+func splitField(field string) (string, string) {
+	i := strings.LastIndex(field, ".")
+	if i < 0 {
+		return "", field
+	}
+	return field[:i], field[i+1:]
+}
+
+// rollupQuery answers a query by day over every install from the rollups when it only asks for
+// what they hold: sums, mins, maxes and averages of number fields or of the numbers in a map by key,
+// or counts of installs by a string or boolean field. ok is false for other queries, which are read
+// from the records. Keys of a map whose values are not numbers are left out.
+func (p *Postgres) rollupQuery(q *Query) (*QueryResult, bool, error) {
+	if q.Interval != "day" || len(q.filters) > 0 || len(q.GroupBy) > 1 || q.Since != nil {
+		return nil, false, nil
+	}
+
+	mapField, byKeys := q.mapGroup()
+	numbers, counts := len(q.GroupBy) == 0 || byKeys, len(q.GroupBy) == 1 && !byKeys
+	for _, a := range q.Aggregates {
+		switch {
+		case a.Fn == "count" && a.Field == "":
+			numbers = false
+		case a.Fn == "sum" || a.Fn == "min" || a.Fn == "max" || a.Fn == "avg":
+			counts = false
+			if byKeys && a.Field != mapField {
+				numbers = false
+			}
+		default:
+			return nil, false, nil
+		}
+	}
+
+	switch {
+	case numbers:
+		out, err := p.rollupNumbers(q)
+		return out, true, err
+	case counts:
+		return p.rollupCounts(q)
+	}
+	return nil, false, nil
+}
+
+// rollupResult collects the rows of a query answered from the rollups, ordered as Query orders them
+type rollupResult struct {
+	q    *Query
+	rows map[string]*QueryRow
+}
+
+func (r *rollupResult) row(day time.Time, group *string) *QueryRow {
+	id, _ := json.Marshal([]interface{}{day.Format("2006-01-02"), group})
+	row, ok := r.rows[string(id)]
+	if !ok {
+		groups := []*string{}
+		if len(r.q.GroupBy) > 0 {
+			groups = append(groups, group)
+		}
+		out := newQueryRow(r.q, day, groups, make([]*float64, len(r.q.Aggregates)))
+		row = &out
+		r.rows[string(id)] = row
+	}
+	return row
+}
+
+func (r *rollupResult) result() *QueryResult {
+	out := &QueryResult{Rows: make([]QueryRow, 0, len(r.rows))}
+	for _, row := range r.rows {
+		out.Rows = append(out.Rows, *row)
+	}
+
+	// By day, then group with nulls last
+	sort.Slice(out.Rows, func(i, j int) bool {
+		a, b := out.Rows[i], out.Rows[j]
+		if a.Period != b.Period {
+			return a.Period < b.Period
+		}
+		for _, field := range r.q.GroupBy {
+			x, y := a.Group[field], b.Group[field]
+			switch {
+			case x == nil || y == nil:
+				return y == nil && x != nil
+			case x != y:
+				return x.(string) < y.(string)
+			}
+		}
+		return false
+	})
+	return out
+}
+
+// rollupNumbers answers a query of number aggregates from rollup_number
+func (p *Postgres) rollupNumbers(q *Query) (*QueryResult, error) {
+	mapField, byKeys := q.mapGroup()
+	out := &rollupResult{q: q, rows: map[string]*QueryRow{}}
+
+	// Every day with records gets a row, even without any of the fields, unless grouping by keys
+	if !byKeys {
+		sql := `SELECT day FROM rollup_install WHERE day >= $1 AND day <= $2`
+		log.Debugf("Query: %s", sql)
+		rows, err := p.Conn.Query(sql, q.From, q.To)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var day time.Time
+			if err = rows.Scan(&day); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			out.row(day, nil)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	parents := []string{}
+	for _, a := range q.Aggregates {
+		parent, _ := splitField(a.Field)
+		if byKeys {
+			parent = strings.TrimSuffix(mapField, ".*")
+		}
+		parents = append(parents, parent)
+	}
+
+	sql := `SELECT day, field, key, sum::float8, count, min::float8, max::float8
+FROM rollup_number
+WHERE day >= $1 AND day <= $2
+	AND field = ANY($3)`
+	log.Debugf("Query: %s", sql)
+	rows, err := p.Conn.Query(sql, q.From, q.To, pq.Array(parents))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var day time.Time
+		var parent, key string
+		var sum, min, max float64
+		var count int64
+
+		err = rows.Scan(&day, &parent, &key, &sum, &count, &min, &max)
+		if err != nil {
+			return nil, err
+		}
+
+		field := key
+		if parent != "" {
+			field = parent + "." + key
+		}
+
+		var row *QueryRow
+		if byKeys {
+			field = parent + ".*"
+			row = out.row(day, &key)
+		} else {
+			row = out.row(day, nil)
+		}
+
+		for _, a := range q.Aggregates {
+			if a.Field != field {
+				continue
+			}
+			switch a.Fn {
+			case "sum":
+				row.Values[a.Name()] = sum
+			case "min":
+				row.Values[a.Name()] = min
+			case "max":
+				row.Values[a.Name()] = max
+			case "avg":
+				row.Values[a.Name()] = sum / float64(count)
+			}
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return out.result(), nil
+}
+
+// rollupCounts answers a query counting installs by a field from rollup_value. Only string and
+// boolean values are rolled up, so ok is false for a number field.
+func (p *Postgres) rollupCounts(q *Query) (*QueryResult, bool, error) {
+	field := q.GroupBy[0]
+	parent, key := splitField(field)
+
+	var numeric bool
+	err := p.Conn.QueryRow(`SELECT EXISTS (SELECT 1 FROM rollup_number WHERE field = $1 AND key = $2)`, parent, key).Scan(&numeric)
+	if err != nil || numeric {
+		return nil, err != nil, err
+	}
+
+	// Installs without the field are counted under a null group, as what the values leave of the
+	// installs on the day
+	type dayInstalls struct {
+		day time.Time
+		n   float64
+	}
+	installs := map[string]*dayInstalls{}
+	sql := `SELECT day, installs::float8 FROM rollup_install WHERE day >= $1 AND day <= $2`
+	log.Debugf("Query: %s", sql)
+	rows, err := p.Conn.Query(sql, q.From, q.To)
+	if err != nil {
+		return nil, true, err
+	}
+	for rows.Next() {
+		var day time.Time
+		var n float64
+		if err = rows.Scan(&day, &n); err != nil {
+			rows.Close()
+			return nil, true, err
+		}
+		installs[day.Format("2006-01-02")] = &dayInstalls{day, n}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, true, err
+	}
+
+	sql = `SELECT day, value, count::float8
+FROM rollup_value
+WHERE day >= $1 AND day <= $2
+	AND field = $3`
+	log.Debugf("Query: %s", sql)
+	rows, err = p.Conn.Query(sql, q.From, q.To, field)
+	if err != nil {
+		return nil, true, err
+	}
+	defer rows.Close()
+
+	out := &rollupResult{q: q, rows: map[string]*QueryRow{}}
+	for rows.Next() {
+		var day time.Time
+		var value string
+		var n float64
+		if err = rows.Scan(&day, &value, &n); err != nil {
+			return nil, true, err
+		}
+
+		row := out.row(day, &value)
+		for _, a := range q.Aggregates {
+			row.Values[a.Name()] = n
+		}
+		if left, ok := installs[day.Format("2006-01-02")]; ok {
+			left.n -= n
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, true, err
+	}
+
+	for _, left := range installs {
+		if left.n <= 0 {
+			continue
+		}
+		row := out.row(left.day, nil)
+		for _, a := range q.Aggregates {
+			row.Values[a.Name()] = left.n
+		}
+	}
+
+	return out.result(), true, nil
+}
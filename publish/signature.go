@@ -0,0 +1,141 @@
+package publish
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+)
+
+const (
+	HeaderUid       = "X-Telemetry-Uid"
+	HeaderTimestamp = "X-Telemetry-Timestamp"
+	HeaderNonce     = "X-Telemetry-Nonce"
+	HeaderSignature = "X-Telemetry-Signature"
+	HeaderKey       = "X-Telemetry-Key"
+)
+
+// Sign returns the hex HMAC-SHA256 of the timestamp, nonce and body
+func Sign(key string, ts int64, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(strconv.FormatInt(ts, 10) + "\n" + nonce + "\n"))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func VerifySignature(key string, ts int64, nonce string, body []byte, signature string) bool {
+	expected := Sign(key, ts, nonce, body)
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
+
+func NewNonce() string {
+	return randomHex(16)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// SigningKey is the per install key a client signs its records with. Each server learns it on
+// first contact and rejects records for the install signed with anything else afterwards.
+type SigningKey struct {
+	Key        string          `json:"key"`
+	Registered map[string]bool `json:"registered"`
+
+	path string
+	mu   sync.Mutex
+}
+
+var (
+	signingKeys   = map[string]*SigningKey{}
+	signingKeysMu sync.Mutex
+)
+
+// LoadSigningKey reads the key stored at path, generating and saving a new one if there is none.
+// Publishers sharing a path share the key.
+func LoadSigningKey(path string) (*SigningKey, error) {
+	signingKeysMu.Lock()
+	defer signingKeysMu.Unlock()
+
+	if k, ok := signingKeys[path]; ok {
+		return k, nil
+	}
+
+	out := &SigningKey{path: path}
+
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(data, out)
+		if err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if out.Registered == nil {
+		out.Registered = map[string]bool{}
+	}
+
+	if out.Key == "" {
+		out.Key = randomHex(32)
+		out.Registered = map[string]bool{}
+		if err = out.save(); err != nil {
+			return nil, err
+		}
+	}
+
+	signingKeys[path] = out
+	return out, nil
+}
+
+func (k *SigningKey) IsRegistered(target string) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.Registered[target]
+}
+
+// Unregister forgets that a server accepted the key, so it is sent again, e.g. after an admin
+// reset the install's key on the server
+func (k *SigningKey) Unregister(target string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if !k.Registered[target] {
+		return nil
+	}
+
+	delete(k.Registered, target)
+	return k.save()
+}
+
+// MarkRegistered records that a server accepted the key, so it doesn't need sending again
+func (k *SigningKey) MarkRegistered(target string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.Registered[target] {
+		return nil
+	}
+
+	k.Registered[target] = true
+	return k.save()
+}
+
+func (k *SigningKey) save() error {
+	data, err := json.Marshal(k)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(k.path, data, 0600)
+}
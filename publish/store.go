@@ -0,0 +1,65 @@
+package publish
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/urfave/cli"
+
+	record "github.com/rancher/telemetry/record"
+)
+
+var ErrNotFound = errors.New("Not found")
+
+// Store keeps the records received by the server and answers the admin queries about them
+type Store interface {
+	Publisher
+	ReportAt(r record.Record, clientIp string, ts time.Time) error
+	Ping() error
+
+	// Filters select records by their fields; installs are filtered by their last record
+	GetAllInstalls(filters []Filter) ([]ApiInstallation, error)
+	GetActiveInstalls(hours int, filters []Filter) ([]ApiInstallation, error)
+	CountActiveInstalls(hours int) (int64, error)
+	GetActiveCountByDay(filters []Filter) (AggregatedFields, error)
+	GetRecordsGroupedByDay(days int, filters []Filter) (RecordsByDateByUid, error)
+	GetRecordsByUid(uid string, days int) ([]ApiRecord, error)
+	GetRecordById(id string) (ApiRecord, error)
+	// EachRecordByDay calls fn with the last record of each install on each day, by day and uid,
+	// without loading them all at once
+	EachRecordByDay(days int, filters []Filter, fn func(day string, rec ApiRecord) error) error
+
+	Query(q *Query) (*QueryResult, error)
+	Cohorts(q *CohortQuery) (*CohortResult, error)
+	Upgrades(q *UpgradeQuery) (*UpgradeResult, error)
+
+	GetAccountHash(user string) (string, error)
+	// SetAccount adds an admin account with a bcrypt password hash, or changes its hash
+	SetAccount(name string, hash string) error
+	GetInstallKey(uid string) (string, error)
+	// RegisterInstallKey sets the signing key of an install unless it has one already, returning
+	// the key it has afterwards, so of concurrent registrations only one wins
+	RegisterInstallKey(uid string, key string) (string, error)
+	// ResetInstallKey forgets the signing key of an install, which registers a new one next time
+	ResetInstallKey(uid string) error
+	UseNonce(uid string, nonce string, window time.Duration) (bool, error)
+}
+
+// NewStore opens the store selected by the storage flag
+func NewStore(c *cli.Context) (Store, error) {
+	switch c.String("storage") {
+	case "postgres":
+		p := NewPostgres(c)
+		if p.Conn == nil {
+			return nil, fmt.Errorf("Postgres host, user and password are required")
+		}
+		return p, nil
+	case "embedded":
+		return NewEmbedded(c.String("embedded-path"))
+	case "memory":
+		return NewMemory(), nil
+	}
+
+	return nil, fmt.Errorf("Unknown storage %s, known: postgres, embedded, memory", c.String("storage"))
+}
@@ -2,11 +2,17 @@ package publish
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
@@ -20,16 +26,91 @@ type ToUrl struct {
 	telemetryVersion string
 	rancherImage     string
 	rancherVersion   string
+
+	gzip  bool
+	batch int
+	key   *SigningKey
+
+	outbox  *Outbox
+	backoff Backoff
+	pending chan struct{}
+	mu      sync.Mutex
+}
+
+// StatusError is returned when the server answers with a non-2xx status
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("Server returned %d", e.StatusCode)
+}
+
+// Permanent reports whether retrying the same payload can't succeed: the server found it invalid
+// or too large. Other errors, like a 401 for a clock that is off or a proxy failing, may clear up.
+func (e *StatusError) Permanent() bool {
+	return e.StatusCode == http.StatusBadRequest ||
+		e.StatusCode == http.StatusRequestEntityTooLarge ||
+		e.StatusCode == http.StatusUnprocessableEntity
+}
+
+func init() {
+	Register("http", newToUrl)
+	Register("https", newToUrl)
 }
 
-func NewToUrl(c *cli.Context) *ToUrl {
+func newToUrl(c *cli.Context, target *url.URL) (Publisher, error) {
+	return NewToUrl(c, target.String()), nil
+}
+
+func NewToUrl(c *cli.Context, to string) *ToUrl {
 	out := &ToUrl{
 		telemetryVersion: c.App.Version,
-		url:              c.String("to-url"),
+		url:              to,
+		gzip:             c.Bool("gzip"),
+		batch:            c.Int("batch-size"),
+		backoff: Backoff{
+			Min: c.Duration("retry-min"),
+			Max: c.Duration("retry-max"),
+		},
+		pending: make(chan struct{}, 1),
 	}
 
 	if out.url == "" {
-		log.Warn("No to-url configured, not publishing")
+		log.Warn("No url configured, not publishing")
+		return out
+	}
+
+	keyFile := c.String("key-file")
+	if keyFile != "" {
+		key, err := LoadSigningKey(keyFile)
+		if err != nil {
+			log.Errorf("Error loading signing key %s, not signing: %s", keyFile, err)
+		} else {
+			out.key = key
+		}
+	}
+
+	dir := c.String("outbox-dir")
+	if dir == "" {
+		return out
+	}
+	// Each url gets its own outbox, so one server being down doesn't hold back another
+	dir = filepath.Join(dir, outboxName(to))
+
+	outbox, err := NewOutbox(dir, int64(c.Int("outbox-max-size"))*1024*1024, c.Duration("outbox-max-age"))
+	if err != nil {
+		log.Errorf("Error creating outbox %s, not spooling: %s", dir, err)
+		return out
+	}
+
+	log.Infof("Spooling unsent records to %s", dir)
+	out.outbox = outbox
+	go out.retry()
+
+	// Pick up whatever a previous run left behind
+	if outbox.Len() > 0 {
+		out.schedule()
 	}
 
 	return out
@@ -45,7 +126,109 @@ func (p *ToUrl) Report(r record.Record, clientIp string) error {
 		return err
 	}
 
-	res, err := http.Post(p.url, "application/json", bytes.NewBuffer(b))
+	if p.outbox == nil {
+		return p.send([][]byte{b})
+	}
+
+	err = p.outbox.Add(b)
+	if err != nil {
+		log.Errorf("Error spooling record, sending directly: %s", err)
+		return p.send([][]byte{b})
+	}
+
+	err = p.Flush()
+	if err != nil {
+		p.schedule()
+	}
+
+	return err
+}
+
+// Flush sends every spooled record, oldest first
+func (p *ToUrl) Flush() error {
+	if p.outbox == nil {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.outbox.Drain(p.batch, func(payloads [][]byte) error {
+		err := p.send(payloads)
+		if !isPermanent(err) {
+			return err
+		}
+		if len(payloads) == 1 {
+			log.Errorf("Dropping record rejected by server: %s", err)
+			return nil
+		}
+
+		// Send the records of a rejected batch one by one, so only the ones at fault are dropped
+		for _, payload := range payloads {
+			err = p.send([][]byte{payload})
+			if isPermanent(err) {
+				log.Errorf("Dropping record rejected by server: %s", err)
+			} else if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func isPermanent(err error) bool {
+	statusErr, ok := err.(*StatusError)
+	return ok && statusErr.Permanent()
+}
+
+// Depth returns the number of records waiting in the outbox
+func (p *ToUrl) Depth() int {
+	if p.outbox == nil {
+		return 0
+	}
+	return p.outbox.Len()
+}
+
+func (p *ToUrl) schedule() {
+	select {
+	case p.pending <- struct{}{}:
+	default:
+	}
+}
+
+func (p *ToUrl) retry() {
+	for range p.pending {
+		for {
+			wait := p.backoff.Next()
+			log.Infof("Retrying spooled records in %s", wait)
+			<-time.After(wait)
+
+			err := p.Flush()
+			if err == nil {
+				p.backoff.Reset()
+				break
+			}
+			log.Errorf("Error sending spooled records: %s", err)
+		}
+	}
+}
+
+// send posts a single record, or a JSON array of records if there is more than one
+func (p *ToUrl) send(payloads [][]byte) error {
+	var b []byte
+	if len(payloads) == 1 {
+		b = payloads[0]
+	} else {
+		b = append([]byte("["), bytes.Join(payloads, []byte(","))...)
+		b = append(b, ']')
+	}
+
+	req, err := p.newRequest(payloads, b)
+	if err != nil {
+		return err
+	}
+
+	res, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return err
 	}
@@ -58,9 +241,90 @@ func (p *ToUrl) Report(r record.Record, clientIp string) error {
 
 	if res.StatusCode >= 200 && res.StatusCode <= 299 {
 		log.Debugf(fmt.Sprintf("Server said %d: %s", res.StatusCode, body))
+		if p.key != nil {
+			if err := p.key.MarkRegistered(p.url); err != nil {
+				log.Errorf("Error saving signing key: %s", err)
+			}
+		}
 		return nil
 	} else {
 		log.Errorf(fmt.Sprintf("Server said %d: %s", res.StatusCode, body))
-		return errors.New(fmt.Sprintf("Server returned %d", res.StatusCode))
+		if p.key != nil && res.StatusCode == http.StatusUnauthorized {
+			if err := p.key.Unregister(p.url); err != nil {
+				log.Errorf("Error saving signing key: %s", err)
+			}
+		}
+		return &StatusError{StatusCode: res.StatusCode}
+	}
+}
+
+func (p *ToUrl) newRequest(payloads [][]byte, b []byte) (*http.Request, error) {
+	if p.gzip {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write(b); err != nil {
+			return nil, err
+		}
+		if err := gz.Close(); err != nil {
+			return nil, err
+		}
+		b = buf.Bytes()
+	}
+
+	req, err := http.NewRequest("POST", p.url, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	// Records without an install uid go unsigned, there being no install to sign for
+	if uid := payloadsUid(payloads); p.key != nil && uid != "" {
+		ts := time.Now().Unix()
+		nonce := NewNonce()
+
+		req.Header.Set(HeaderUid, uid)
+		req.Header.Set(HeaderTimestamp, strconv.FormatInt(ts, 10))
+		req.Header.Set(HeaderNonce, nonce)
+		req.Header.Set(HeaderSignature, Sign(p.key.Key, ts, nonce, b))
+		if !p.key.IsRegistered(p.url) {
+			req.Header.Set(HeaderKey, p.key.Key)
+		}
+	}
+
+	return req, nil
+}
+
+func outboxName(to string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, to)
+}
+
+// payloadsUid returns the first install uid of the payloads, which all come from the same install
+func payloadsUid(payloads [][]byte) string {
+	for _, b := range payloads {
+		if uid := payloadUid(b); uid != "" {
+			return uid
+		}
+	}
+	return ""
+}
+
+func payloadUid(b []byte) string {
+	var r struct {
+		Install struct {
+			Uid string `json:"uid"`
+		} `json:"install"`
+	}
+
+	if err := json.Unmarshal(b, &r); err != nil {
+		return ""
 	}
+	return r.Install.Uid
 }
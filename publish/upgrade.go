@@ -0,0 +1,342 @@
+package publish
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+)
+
+const DefaultUpgradeDays = 90
+
+// UpgradeQuery follows installs from one install.version to the next. Upgrades are counted when the
+// new version is first reported within the range, while the time on the old version includes days
+// before it.
+type UpgradeQuery struct {
+	From string   `json:"from"`          // first day, defaults to 90 days before To
+	To   string   `json:"to"`            // last day, defaults to today
+	EOL  []string `json:"eol,omitempty"` // versions no longer supported, with * and ? wildcards, e.g. v2.4.*
+
+	from time.Time
+	to   time.Time
+	eol  []*regexp.Regexp
+}
+
+// Distribution summarizes a number of days
+type Distribution struct {
+	Min float64 `json:"min"`
+	Avg float64 `json:"avg"`
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	Max float64 `json:"max"`
+}
+
+// UpgradePath counts installs moving from one version to another, with the days they spent on the
+// first one
+type UpgradePath struct {
+	From  string       `json:"from"`
+	To    string       `json:"to"`
+	Count int64        `json:"count"`
+	Days  Distribution `json:"days"`
+}
+
+// StuckVersion counts the installs still on an EOL version at their last record in the range, with
+// the days they have been on it
+type StuckVersion struct {
+	Version  string       `json:"version"`
+	Installs int64        `json:"installs"`
+	Days     Distribution `json:"days"`
+}
+
+type UpgradeResult struct {
+	Query    UpgradeQuery   `json:"query"`
+	Installs int64          `json:"installs"` // installs that reported a version in the range
+	Upgraded int64          `json:"upgraded"` // of those, installs that changed version in the range
+	Paths    []UpgradePath  `json:"paths"`
+	Stuck    []StuckVersion `json:"stuck"`
+}
+
+// Validate checks the query and fills in its defaults
+func (q *UpgradeQuery) Validate() error {
+	var err error
+
+	q.to = daysAgo(0)
+	if q.To != "" {
+		if q.to, err = time.ParseInLocation("2006-01-02", q.To, time.Local); err != nil {
+			return fmt.Errorf("Invalid to %q", q.To)
+		}
+	}
+	q.from = q.to.AddDate(0, 0, -DefaultUpgradeDays)
+	if q.From != "" {
+		if q.from, err = time.ParseInLocation("2006-01-02", q.From, time.Local); err != nil {
+			return fmt.Errorf("Invalid from %q", q.From)
+		}
+	}
+	if q.from.After(q.to) {
+		return fmt.Errorf("from is after to")
+	}
+	q.From = q.from.Format("2006-01-02")
+	q.To = q.to.Format("2006-01-02")
+
+	// Only the wildcards LIKE has too, so every store matches the same versions
+	q.eol = nil
+	for _, eol := range q.EOL {
+		if eol == "" || strings.ContainsAny(eol, `[]\`) {
+			return fmt.Errorf("Invalid EOL version %q, only * and ? are wildcards", eol)
+		}
+
+		re := strings.NewReplacer(`\*`, `.*`, `\?`, `.`).Replace(regexp.QuoteMeta(eol))
+		q.eol = append(q.eol, regexp.MustCompile(`(?s)^`+re+`$`))
+	}
+
+	return nil
+}
+
+// isEOL checks a version against the EOL patterns of the query
+func (q *UpgradeQuery) isEOL(version string) bool {
+	for _, eol := range q.eol {
+		if eol.MatchString(version) {
+			return true
+		}
+	}
+	return false
+}
+
+// eolLikes returns the EOL patterns as LIKE patterns
+func (q *UpgradeQuery) eolLikes() []string {
+	likes := []string{}
+	for _, eol := range q.EOL {
+		likes = append(likes, strings.NewReplacer(`%`, `\%`, `_`, `\_`, `*`, `%`, `?`, `_`).Replace(eol))
+	}
+	return likes
+}
+
+// Each row of changes starts a run of days an install reported the same version on, with the
+// version before and the day the run before started. Runs are found from the whole history, so the
+// time spent on a version doesn't depend on the range.
+const upgradeChanges = `WITH days AS (
+	SELECT b.uid, b.day, r.install_version AS version
+	FROM byday b
+		JOIN record r ON (r.id = b.record_id)
+	WHERE b.day <= $2 AND r.install_version IS NOT NULL
+),
+changes AS (
+	SELECT uid, day, version, prev, lag(day) OVER (PARTITION BY uid ORDER BY day) AS since
+	FROM (
+		SELECT uid, day, version, lag(version) OVER (PARTITION BY uid ORDER BY day) AS prev
+		FROM days
+	) d
+	WHERE prev IS DISTINCT FROM version
+)`
+
+// distributionSql returns the columns summarizing a number of days, scanned into Distribution.dest
+func distributionSql(days string) string {
+	return fmt.Sprintf(`min(%[1]s)::float8, avg(%[1]s)::float8,
+	percentile_cont(0.5) WITHIN GROUP (ORDER BY (%[1]s)::float8),
+	percentile_cont(0.9) WITHIN GROUP (ORDER BY (%[1]s)::float8),
+	max(%[1]s)::float8`, days)
+}
+
+func (d *Distribution) dest() []interface{} {
+	return []interface{}{&d.Min, &d.Avg, &d.P50, &d.P90, &d.Max}
+}
+
+func (p *Postgres) Upgrades(q *UpgradeQuery) (*UpgradeResult, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+
+	out := &UpgradeResult{Query: *q, Paths: []UpgradePath{}, Stuck: []StuckVersion{}}
+
+	query := upgradeChanges + `
+SELECT
+	(SELECT count(DISTINCT uid) FROM days WHERE day >= $1),
+	(SELECT count(DISTINCT uid) FROM changes WHERE prev IS NOT NULL AND day >= $1)`
+	log.Debugf("Query: %s", query)
+	err := p.Conn.QueryRow(query, q.From, q.To).Scan(&out.Installs, &out.Upgraded)
+	if err != nil {
+		return nil, err
+	}
+
+	query = upgradeChanges + `
+SELECT prev, version, count(*),
+	%s
+FROM changes
+WHERE prev IS NOT NULL AND day >= $1
+GROUP BY prev, version
+ORDER BY 3 DESC, 1, 2`
+
+	query = fmt.Sprintf(query, distributionSql("day - since"))
+	log.Debugf("Query: %s", query)
+	rows, err := p.Conn.Query(query, q.From, q.To)
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		var u UpgradePath
+		if err = rows.Scan(append([]interface{}{&u.From, &u.To, &u.Count}, u.Days.dest()...)...); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		out.Paths = append(out.Paths, u)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(q.EOL) == 0 {
+		return out, nil
+	}
+
+	query = upgradeChanges + `,
+latest AS (
+	SELECT DISTINCT ON (uid) uid, day AS since, version
+	FROM changes
+	ORDER BY uid, day DESC
+),
+lastday AS (
+	SELECT uid, max(day) AS day
+	FROM days
+	GROUP BY uid
+)
+SELECT c.version, count(*),
+	%s
+FROM latest c
+	JOIN lastday l ON (l.uid = c.uid)
+WHERE l.day >= $1 AND c.version LIKE ANY($3)
+GROUP BY c.version
+ORDER BY 2 DESC, 1`
+
+	query = fmt.Sprintf(query, distributionSql("l.day - c.since"))
+	log.Debugf("Query: %s", query)
+	rows, err = p.Conn.Query(query, q.From, q.To, pq.Array(q.eolLikes()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var s StuckVersion
+		if err = rows.Scan(append([]interface{}{&s.Version, &s.Installs}, s.Days.dest()...)...); err != nil {
+			return nil, err
+		}
+		out.Stuck = append(out.Stuck, s)
+	}
+
+	return out, rows.Err()
+}
+
+// versionDay is the version an install reported on a day, for the stores that run queries in Go
+type versionDay struct {
+	Day     time.Time
+	Version string
+}
+
+// recordVersion returns the install.version of a decoded record, as the generated column holds it
+func recordVersion(data interface{}) (string, bool) {
+	v, ok := fieldValue(data, "install.version")
+	if !ok {
+		return "", false
+	}
+	return textValue(v), true
+}
+
+// runUpgrades answers a validated query from the versions each install reported up to its last
+// day, sorted by day, as Postgres.Upgrades would
+func runUpgrades(q *UpgradeQuery, installs map[string][]versionDay) *UpgradeResult {
+	type fromTo struct {
+		from string
+		to   string
+	}
+
+	paths := map[fromTo][]float64{}
+	stuck := map[string][]float64{}
+	out := &UpgradeResult{Query: *q, Paths: []UpgradePath{}, Stuck: []StuckVersion{}}
+
+	for _, days := range installs {
+		if len(days) == 0 {
+			continue
+		}
+
+		upgraded := false
+		version, since := days[0].Version, days[0].Day
+		for _, d := range days[1:] {
+			if d.Version == version {
+				continue
+			}
+			if !d.Day.Before(q.from) {
+				k := fromTo{version, d.Version}
+				paths[k] = append(paths[k], daysBetween(since, d.Day))
+				upgraded = true
+			}
+			version, since = d.Version, d.Day
+		}
+
+		last := days[len(days)-1].Day
+		if last.Before(q.from) {
+			continue
+		}
+		out.Installs++
+		if upgraded {
+			out.Upgraded++
+		}
+		if q.isEOL(version) {
+			stuck[version] = append(stuck[version], daysBetween(since, last))
+		}
+	}
+
+	for k, days := range paths {
+		out.Paths = append(out.Paths, UpgradePath{From: k.from, To: k.to, Count: int64(len(days)), Days: newDistribution(days)})
+	}
+	sort.Slice(out.Paths, func(i, j int) bool {
+		a, b := out.Paths[i], out.Paths[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		if a.From != b.From {
+			return a.From < b.From
+		}
+		return a.To < b.To
+	})
+
+	for version, days := range stuck {
+		out.Stuck = append(out.Stuck, StuckVersion{Version: version, Installs: int64(len(days)), Days: newDistribution(days)})
+	}
+	sort.Slice(out.Stuck, func(i, j int) bool {
+		a, b := out.Stuck[i], out.Stuck[j]
+		if a.Installs != b.Installs {
+			return a.Installs > b.Installs
+		}
+		return a.Version < b.Version
+	})
+
+	return out
+}
+
+func daysBetween(from time.Time, to time.Time) float64 {
+	return math.Round(to.Sub(from).Hours() / 24)
+}
+
+func newDistribution(days []float64) Distribution {
+	value := func(fn string, p float64) float64 {
+		if v := aggregateNumbers(Aggregate{Fn: fn, P: p}, days); v != nil {
+			return *v
+		}
+		return 0
+	}
+
+	return Distribution{
+		Min: value("min", 0),
+		Avg: value("avg", 0),
+		P50: value("percentile", 0.5),
+		P90: value("percentile", 0.9),
+		Max: value("max", 0),
+	}
+}
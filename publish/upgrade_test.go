@@ -0,0 +1,105 @@
+package publish
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	record "github.com/rancher/telemetry/record"
+)
+
+// testStores returns the stores that answer queries in Go, and Postgres when TELEMETRY_TEST_PG is
+// set, so one test checks they agree
+func testStores(t *testing.T) map[string]Store {
+	dir, err := ioutil.TempDir("", "telemetry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	e, err := NewEmbedded(filepath.Join(dir, "telemetry.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { e.Close() })
+
+	stores := map[string]Store{"memory": NewMemory(), "embedded": e}
+	if os.Getenv("TELEMETRY_TEST_PG") != "" {
+		p := testPostgres(t)
+		if err = p.CheckSchema(true); err != nil {
+			t.Fatal(err)
+		}
+		stores["postgres"] = p
+	}
+	return stores
+}
+
+func versionRecord(uid string, version string) record.Record {
+	return record.Record{
+		"r":       float64(record.VERSION),
+		"install": map[string]interface{}{"uid": uid, "version": version},
+	}
+}
+
+func TestUpgradeEOLValidate(t *testing.T) {
+	for _, eol := range []string{"", "v2.[34].*", `v2\.4`, "v2.4]"} {
+		q := UpgradeQuery{EOL: []string{eol}}
+		if err := q.Validate(); err == nil {
+			t.Errorf("EOL %q: got no error", eol)
+		}
+	}
+
+	q := UpgradeQuery{EOL: []string{"v2.4.*", "v2?5", "100%_*"}}
+	if err := q.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := q.eolLikes(), []string{"v2.4.%", "v2_5", `100\%\_%`}; !reflect.DeepEqual(got, want) {
+		t.Errorf("LIKE patterns: got %q, want %q", got, want)
+	}
+}
+
+// TestUpgradeEOLMatch runs one set of EOL patterns against each store
+func TestUpgradeEOLMatch(t *testing.T) {
+	versions := map[string]string{
+		"a": "v2.4.5",
+		"b": "v2.4.5-rc1",
+		"c": "v2.40.1",
+		"d": "v2.5.0",
+		"e": "v2_5",
+		"f": "v2/5",
+		"g": "100%_x",
+		"h": "100ab",
+	}
+	want := []string{"100%_x", "v2.4.5", "v2.4.5-rc1", "v2/5", "v2_5"}
+
+	for name, s := range testStores(t) {
+		now := time.Now()
+		for uid, version := range versions {
+			if err := s.ReportAt(versionRecord(uid, version), "127.0.0.1", now); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		res, err := s.Upgrades(&UpgradeQuery{EOL: []string{"v2.4.*", "v2?5", "100%_*"}})
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		got := []string{}
+		for _, stuck := range res.Stuck {
+			got = append(got, stuck.Version)
+		}
+		// Postgres may sort by a collation
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got stuck %q, want %q", name, got, want)
+		}
+		if res.Installs != int64(len(versions)) {
+			t.Errorf("%s: got %d installs, want %d", name, res.Installs, len(versions))
+		}
+	}
+}
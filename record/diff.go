@@ -0,0 +1,121 @@
+package record
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+const (
+	Added   = "+"
+	Removed = "-"
+	Changed = "~"
+)
+
+// Change is one field that differs between two records, at a dotted path like node.cpu.util_avg
+type Change struct {
+	Path string      `json:"path"`
+	Kind string      `json:"kind"`
+	Old  interface{} `json:"old,omitempty"`
+	New  interface{} `json:"new,omitempty"`
+}
+
+func (c Change) String() string {
+	switch c.Kind {
+	case Added:
+		return fmt.Sprintf("%s %s: %s", c.Kind, c.Path, diffValue(c.New))
+	case Removed:
+		return fmt.Sprintf("%s %s: %s", c.Kind, c.Path, diffValue(c.Old))
+	}
+	return fmt.Sprintf("%s %s: %s -> %s", c.Kind, c.Path, diffValue(c.Old), diffValue(c.New))
+}
+
+// Diff compares two records as they would be sent, field by field, with the changes sorted by path
+func Diff(old Record, new Record) ([]Change, error) {
+	a, err := plain(old)
+	if err != nil {
+		return nil, err
+	}
+	b, err := plain(new)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := []Change{}
+	diff("", a, b, &changes)
+	return changes, nil
+}
+
+// plain round trips a record through JSON, so structs, typed maps and numbers compare the same way
+// whether the record was just collected or read from a file
+func plain(r Record) (interface{}, error) {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var out interface{}
+	err = json.Unmarshal(b, &out)
+	return out, err
+}
+
+func diff(path string, a interface{}, b interface{}, changes *[]Change) {
+	am, aok := a.(map[string]interface{})
+	bm, bok := b.(map[string]interface{})
+	if aok && bok {
+		keys := []string{}
+		for k := range am {
+			keys = append(keys, k)
+		}
+		for k := range bm {
+			if _, ok := am[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			av, inA := am[k]
+			bv, inB := bm[k]
+			switch {
+			case !inA:
+				*changes = append(*changes, Change{Path: join(path, k), Kind: Added, New: bv})
+			case !inB:
+				*changes = append(*changes, Change{Path: join(path, k), Kind: Removed, Old: av})
+			default:
+				diff(join(path, k), av, bv, changes)
+			}
+		}
+		return
+	}
+
+	al, aok := a.([]interface{})
+	bl, bok := b.([]interface{})
+	if aok && bok {
+		for i := 0; i < len(al) || i < len(bl); i++ {
+			switch {
+			case i >= len(al):
+				*changes = append(*changes, Change{Path: join(path, strconv.Itoa(i)), Kind: Added, New: bl[i]})
+			case i >= len(bl):
+				*changes = append(*changes, Change{Path: join(path, strconv.Itoa(i)), Kind: Removed, Old: al[i]})
+			default:
+				diff(join(path, strconv.Itoa(i)), al[i], bl[i], changes)
+			}
+		}
+		return
+	}
+
+	if !reflect.DeepEqual(a, b) {
+		*changes = append(*changes, Change{Path: path, Kind: Changed, Old: a, New: b})
+	}
+}
+
+func diffValue(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
@@ -0,0 +1,78 @@
+package record
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// VERSION is the record version written by this client and stored by this server
+const VERSION = 2
+
+// A Migration upgrades a record in place from the version it is registered for to the next one
+type Migration func(r Record) error
+
+var migrations = map[int]Migration{}
+
+func RegisterMigration(from int, m Migration) {
+	migrations[from] = m
+}
+
+// Version returns the record version in the "r" field
+func (r Record) Version() (int, error) {
+	switch v := r["r"].(type) {
+	case float64:
+		if v == float64(int(v)) {
+			return int(v), nil
+		}
+	case int:
+		return v, nil
+	case json.Number:
+		i, err := v.Int64()
+		if err == nil {
+			return int(i), nil
+		}
+	case nil:
+		return 0, fmt.Errorf("Record version is missing")
+	}
+
+	return 0, fmt.Errorf("Invalid record version %v", r["r"])
+}
+
+// Migrate upgrades a record to VERSION, one version at a time
+func Migrate(r Record) error {
+	for {
+		v, err := r.Version()
+		if err != nil {
+			return err
+		}
+
+		if v == VERSION {
+			return nil
+		}
+
+		if v > VERSION {
+			return fmt.Errorf("Record version %d is newer than %d", v, VERSION)
+		}
+
+		m, ok := migrations[v]
+		if !ok {
+			return fmt.Errorf("No migration from record version %d", v)
+		}
+
+		if err = m(r); err != nil {
+			return fmt.Errorf("Migrating record version %d: %s", v, err)
+		}
+
+		r["r"] = float64(v + 1)
+	}
+}
+
+// Version 1 records predate this repo and none are kept to show how they differ, so they are
+// taken as they are; sections the schema doesn't know show up in Schema.Unknown
+func migrateV1(r Record) error {
+	return nil
+}
+
+func init() {
+	RegisterMigration(1, migrateV1)
+}
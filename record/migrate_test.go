@@ -0,0 +1,73 @@
+package record
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	tests := []struct {
+		name string
+		in   Record
+		want Record
+		err  string
+	}{
+		{
+			name: "current",
+			in:   Record{"r": float64(VERSION), "install": map[string]interface{}{"uid": "a"}},
+			want: Record{"r": float64(VERSION), "install": map[string]interface{}{"uid": "a"}},
+		},
+		{
+			name: "version 1 taken as it is",
+			in:   Record{"r": float64(1), "install": map[string]interface{}{"uid": "a"}, "host": map[string]interface{}{"total": float64(3)}},
+			want: Record{"r": float64(VERSION), "install": map[string]interface{}{"uid": "a"}, "host": map[string]interface{}{"total": float64(3)}},
+		},
+		{name: "missing version", in: Record{}, err: "missing"},
+		{name: "fractional version", in: Record{"r": 1.5}, err: "Invalid record version"},
+		{name: "newer", in: Record{"r": float64(VERSION + 1)}, err: "newer"},
+		{name: "no migration", in: Record{"r": float64(0)}, err: "No migration from record version 0"},
+	}
+
+	for _, test := range tests {
+		err := Migrate(test.in)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(test.in, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, test.in, test.want)
+		}
+	}
+}
+
+func TestSchemaUnknown(t *testing.T) {
+	type node struct {
+		Total  int               `json:"total"`
+		Labels map[string]string `json:"labels"`
+	}
+	s := SchemaFor(struct {
+		Nodes []node `json:"nodes"`
+	}{})
+
+	v := map[string]interface{}{
+		"nodes": []interface{}{
+			map[string]interface{}{"total": float64(1), "labels": map[string]interface{}{"any": "thing"}},
+			map[string]interface{}{"total": float64(2), "cpu": float64(4)},
+		},
+		"host": map[string]interface{}{"total": float64(3)},
+	}
+
+	if errs := s.Validate(v); len(errs) != 0 {
+		t.Errorf("Validate: got %v, want unknown properties allowed", errs)
+	}
+	if got, want := s.Unknown(v), []string{"host", "nodes[1].cpu"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Unknown: got %v, want %v", got, want)
+	}
+}
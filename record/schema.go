@@ -0,0 +1,253 @@
+package record
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Schema is the subset of JSON schema needed to describe a record
+type Schema struct {
+	Type                 string             `json:"type,omitempty"`
+	Nullable             bool               `json:"nullable,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	MinLength            int                `json:"minLength,omitempty"`
+}
+
+type ValidationError struct {
+	Path    string
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	if e.Path == "" {
+		return e.Message
+	}
+	return e.Path + ": " + e.Message
+}
+
+// SchemaFor derives a schema from a Go type using its json tags
+func SchemaFor(v interface{}) *Schema {
+	return schemaForType(reflect.TypeOf(v))
+}
+
+func schemaForType(t reflect.Type) *Schema {
+	if t == nil {
+		return &Schema{}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		s := schemaForType(t.Elem())
+		s.Nullable = true
+		return s
+	case reflect.Struct:
+		s := &Schema{
+			Type:       "object",
+			Properties: map[string]*Schema{},
+		}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+
+			name := field.Name
+			if tag, ok := field.Tag.Lookup("json"); ok {
+				tagName := strings.Split(tag, ",")[0]
+				if tagName == "-" {
+					continue
+				}
+				if tagName != "" {
+					name = tagName
+				}
+			}
+
+			s.Properties[name] = schemaForType(field.Type)
+		}
+		return s
+	case reflect.Map:
+		return &Schema{
+			Type:                 "object",
+			Nullable:             true,
+			AdditionalProperties: schemaForType(t.Elem()),
+		}
+	case reflect.Slice, reflect.Array:
+		return &Schema{
+			Type:     "array",
+			Nullable: true,
+			Items:    schemaForType(t.Elem()),
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	}
+
+	// interface{} and anything else accepts any value
+	return &Schema{}
+}
+
+// Validate checks a decoded JSON value against the schema. Properties not in the schema are
+// allowed, so newer clients can add fields without being rejected; Unknown lists them.
+func (s *Schema) Validate(v interface{}) []error {
+	return s.validate(v, "")
+}
+
+// Unknown returns the paths of properties in a decoded JSON value that the schema doesn't
+// describe, which Validate lets through, so drift between clients and the schema can be watched
+func (s *Schema) Unknown(v interface{}) []string {
+	var paths []string
+	s.unknown(v, "", &paths)
+	return paths
+}
+
+func (s *Schema) unknown(v interface{}, path string, paths *[]string) {
+	switch s.Type {
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return
+		}
+
+		keys := make([]string, 0, len(obj))
+		for k := range obj {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			child := s.Properties[k]
+			if child == nil {
+				child = s.AdditionalProperties
+			}
+			if child == nil {
+				*paths = append(*paths, join(path, k))
+				continue
+			}
+			child.unknown(obj[k], join(path, k), paths)
+		}
+	case "array":
+		arr, _ := v.([]interface{})
+		for i, item := range arr {
+			s.Items.unknown(item, fmt.Sprintf("%s[%d]", path, i), paths)
+		}
+	}
+}
+
+func (s *Schema) validate(v interface{}, path string) []error {
+	if v == nil {
+		if s.Nullable || s.Type == "" {
+			return nil
+		}
+		return []error{ValidationError{path, "must not be null"}}
+	}
+
+	switch s.Type {
+	case "":
+		return nil
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return []error{mismatch(path, s.Type, v)}
+		}
+		return s.validateObject(obj, path)
+	case "array":
+		arr, ok := v.([]interface{})
+		if !ok {
+			return []error{mismatch(path, s.Type, v)}
+		}
+		var errs []error
+		for i, item := range arr {
+			errs = append(errs, s.Items.validate(item, fmt.Sprintf("%s[%d]", path, i))...)
+		}
+		return errs
+	case "integer":
+		f, ok := v.(float64)
+		if !ok || f != math.Trunc(f) {
+			return []error{mismatch(path, s.Type, v)}
+		}
+	case "number":
+		if _, ok := v.(float64); !ok {
+			return []error{mismatch(path, s.Type, v)}
+		}
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			return []error{mismatch(path, s.Type, v)}
+		}
+		if len(str) < s.MinLength {
+			return []error{ValidationError{path, fmt.Sprintf("must be at least %d characters", s.MinLength)}}
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return []error{mismatch(path, s.Type, v)}
+		}
+	}
+
+	return nil
+}
+
+func (s *Schema) validateObject(obj map[string]interface{}, path string) []error {
+	var errs []error
+
+	for _, name := range s.Required {
+		if _, ok := obj[name]; !ok {
+			errs = append(errs, ValidationError{join(path, name), "is required"})
+		}
+	}
+
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		child := s.Properties[k]
+		if child == nil {
+			child = s.AdditionalProperties
+		}
+		if child == nil {
+			continue
+		}
+		errs = append(errs, child.validate(obj[k], join(path, k))...)
+	}
+
+	return errs
+}
+
+func join(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func mismatch(path string, want string, v interface{}) error {
+	got := "unknown"
+	switch v.(type) {
+	case map[string]interface{}:
+		got = "object"
+	case []interface{}:
+		got = "array"
+	case float64:
+		got = "number"
+	case string:
+		got = "string"
+	case bool:
+		got = "boolean"
+	}
+
+	return ValidationError{path, "expected " + want + ", got " + got}
+}
@@ -0,0 +1,305 @@
+package record
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	ScrubOther      = "other"
+	ScrubHashPrefix = "hash:"
+)
+
+// ScrubRule says which values of a field may be kept. Fields are LabelCount-like maps, whose keys
+// are the values, or plain strings.
+type ScrubRule struct {
+	// Pattern is a regexp whose first group replaces each value, e.g. to cut a version to major.minor
+	Pattern string `json:"pattern,omitempty"`
+	// Allow lists the values kept as they are, with * wildcards; others become "other"
+	Allow []string `json:"allow,omitempty"`
+	// Hash replaces values that are not allowed with a salted hash instead, so they can still be
+	// told apart without being readable
+	Hash bool `json:"hash,omitempty"`
+	// TopKeys keeps the most counted keys of a map within each record and adds the counts of the
+	// rest to "other". It only caps the size of the map: a value no other install has is kept if it
+	// is among the install's top keys, so fields whose values could identify one need Allow or Hash.
+	TopKeys int `json:"topKeys,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// ScrubRules remove values that could identify an install from records, by field path. A * in a
+// path matches any key, e.g. app.rancheCatalogs.*.apps. Rules that hash need a secret salt, as a
+// short hash of a name is otherwise easily reversed with a list of likely names.
+type ScrubRules struct {
+	Salt   string                `json:"salt,omitempty"`
+	Fields map[string]*ScrubRule `json:"fields"`
+}
+
+// LoadScrubRules reads rules from a JSON file, or returns the built in rules for "default" and no
+// rules for "". Hashed values are salted with salt, unless the rules have a salt of their own.
+func LoadScrubRules(spec string, salt string) (*ScrubRules, error) {
+	var rules *ScrubRules
+
+	switch spec {
+	case "":
+		return nil, nil
+	case "default":
+		rules = DefaultScrubRules()
+	default:
+		b, err := ioutil.ReadFile(spec)
+		if err != nil {
+			return nil, err
+		}
+		rules = &ScrubRules{}
+		if err = json.Unmarshal(b, rules); err != nil {
+			return nil, fmt.Errorf("%s: %s", spec, err)
+		}
+	}
+
+	if rules.Salt == "" {
+		rules.Salt = salt
+	}
+	return rules, rules.Compile()
+}
+
+// Compile checks the rules, and must be called before Scrub on rules not from LoadScrubRules
+func (s *ScrubRules) Compile() error {
+	for field, rule := range s.Fields {
+		if rule == nil {
+			return fmt.Errorf("Scrub rule for %s is empty", field)
+		}
+		if rule.Hash && s.Salt == "" {
+			return fmt.Errorf("Scrub rule for %s hashes values, which needs a salt", field)
+		}
+
+		for _, allow := range rule.Allow {
+			if _, err := path.Match(allow, ""); err != nil {
+				return fmt.Errorf("Scrub rule for %s: bad allow %q: %s", field, allow, err)
+			}
+		}
+
+		if rule.Pattern != "" {
+			re, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return fmt.Errorf("Scrub rule for %s: %s", field, err)
+			}
+			if re.NumSubexp() < 1 {
+				return fmt.Errorf("Scrub rule for %s: pattern needs a group", field)
+			}
+			rule.re = re
+		}
+	}
+	return nil
+}
+
+// Scrub applies the rules to a record in place. Sections the rules touch are converted to their
+// JSON form first, as a record collected by the client holds structs.
+func (s *ScrubRules) Scrub(r Record) error {
+	if s == nil {
+		return nil
+	}
+
+	fields := make([]string, 0, len(s.Fields))
+	for field := range s.Fields {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	for _, field := range fields {
+		parts := strings.Split(field, ".")
+
+		section, ok := r[parts[0]]
+		if !ok || section == nil {
+			continue
+		}
+		if _, ok := section.(map[string]interface{}); !ok {
+			b, err := json.Marshal(section)
+			if err != nil {
+				return err
+			}
+			var plain interface{}
+			if err = json.Unmarshal(b, &plain); err != nil {
+				return err
+			}
+			r[parts[0]] = plain
+		}
+
+		s.scrubPath(map[string]interface{}(r), parts, s.Fields[field])
+	}
+	return nil
+}
+
+// scrubPath finds the values at a path below obj, where the last part names the field to scrub
+func (s *ScrubRules) scrubPath(obj map[string]interface{}, parts []string, rule *ScrubRule) {
+	keys := []string{parts[0]}
+	if parts[0] == "*" {
+		keys = keys[:0]
+		for k := range obj {
+			keys = append(keys, k)
+		}
+	}
+
+	for _, k := range keys {
+		v, ok := obj[k]
+		if !ok {
+			continue
+		}
+
+		if len(parts) > 1 {
+			if child, ok := v.(map[string]interface{}); ok {
+				s.scrubPath(child, parts[1:], rule)
+			}
+			continue
+		}
+
+		switch value := v.(type) {
+		case string:
+			obj[k] = s.scrubValue(value, rule)
+		case map[string]interface{}:
+			obj[k] = s.scrubMap(value, rule)
+		}
+	}
+}
+
+func (s *ScrubRules) scrubMap(in map[string]interface{}, rule *ScrubRule) map[string]interface{} {
+	out := map[string]interface{}{}
+	for k, v := range in {
+		merge(out, s.scrubValue(k, rule), v)
+	}
+
+	if rule.TopKeys <= 0 || len(out) <= rule.TopKeys {
+		return out
+	}
+
+	// Keep the most counted keys, ties broken by name so the result doesn't depend on map order
+	keys := []string{}
+	for k, v := range out {
+		if _, ok := v.(float64); ok && k != ScrubOther {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := out[keys[i]].(float64), out[keys[j]].(float64)
+		if a != b {
+			return a > b
+		}
+		return keys[i] < keys[j]
+	})
+
+	for _, k := range keys[min(rule.TopKeys, len(keys)):] {
+		v := out[k]
+		delete(out, k)
+		merge(out, ScrubOther, v)
+	}
+	return out
+}
+
+// merge adds a value under a key; counts add up, anything else that collides is dropped
+func merge(out map[string]interface{}, k string, v interface{}) {
+	cur, ok := out[k]
+	if !ok {
+		out[k] = v
+		return
+	}
+
+	a, aok := cur.(float64)
+	b, bok := v.(float64)
+	if aok && bok {
+		out[k] = a + b
+	}
+}
+
+func (s *ScrubRules) scrubValue(v string, rule *ScrubRule) string {
+	if v == ScrubOther || strings.HasPrefix(v, ScrubHashPrefix) {
+		return v
+	}
+
+	if rule.re != nil {
+		if m := rule.re.FindStringSubmatch(v); m != nil {
+			v = m[1]
+		}
+	}
+
+	if len(rule.Allow) == 0 && !rule.Hash {
+		return v
+	}
+	for _, allow := range rule.Allow {
+		if ok, _ := path.Match(allow, v); ok {
+			return v
+		}
+	}
+
+	if rule.Hash {
+		sum := sha256.Sum256([]byte(s.Salt + v))
+		return ScrubHashPrefix + hex.EncodeToString(sum[:])[:12]
+	}
+	return ScrubOther
+}
+
+func min(x, y int) int {
+	if x < y {
+		return x
+	}
+	return y
+}
+
+// DefaultScrubRules keep the values Rancher ships with and fold or hash anything custom
+func DefaultScrubRules() *ScrubRules {
+	catalogs := &ScrubRule{Allow: []string{"library", "system-library", "helm", "helm3-library"}, Hash: true}
+	versions := &ScrubRule{Pattern: `^(v?\d+\.\d+\.\d+)`}
+
+	return &ScrubRules{
+		Fields: map[string]*ScrubRule{
+			"install.auth": {Allow: []string{
+				"local", "github", "activeDirectory", "azureAD", "openLdap", "freeIpa",
+				"ping", "adfs", "keyCloak", "okta", "shibboleth", "googleOauth",
+			}},
+			"install.users": {Allow: []string{
+				"local", "system", "github_user", "activedirectory_user", "azuread_user",
+				"openldap_user", "freeipa_user", "ping_user", "adfs_user", "keycloak_user",
+				"okta_user", "shibboleth_user", "googleoauth_user",
+			}},
+			"install.nodeDrivers": {Allow: []string{
+				"aliyunecs", "amazonec2", "azure", "cloudca", "digitalocean", "exoscale",
+				"linode", "openstack", "otc", "packet", "pinganyunecs", "rackspace",
+				"softlayer", "vmwarevsphere",
+			}},
+			"install.kontainerDrivers": {Allow: []string{
+				"aliyunkubernetescontainerservice", "amazonelasticcontainerservice",
+				"azurekubernetesservice", "baiducloudcontainerengine", "googlekubernetesengine",
+				"huaweicontainercloudengine", "import", "linodekubernetesengine",
+				"opentelekomcloudcontainerengine", "oraclecontainerengine",
+				"rancherkubernetesengine", "tencentkubernetesengine",
+			}},
+			"node.driver": {Allow: []string{
+				"aliyunecs", "amazonec2", "azure", "cloudca", "digitalocean", "exoscale",
+				"linode", "openstack", "otc", "packet", "pinganyunecs", "rackspace",
+				"softlayer", "vmwarevsphere",
+			}},
+			"node.kernel": {Pattern: `^(\d+\.\d+)`, TopKeys: 10},
+			// Distributions are kept with their version, anything custom is folded
+			"node.os": {Allow: []string{
+				"Alpine*", "Amazon Linux*", "CentOS*", "Container-Optimized OS*", "Debian*",
+				"Fedora*", "Flatcar*", "k3OS*", "openSUSE*", "Oracle Linux*", "Photon OS*",
+				"RancherOS*", "Red Hat Enterprise Linux*", "Rocky Linux*", "SUSE Linux Enterprise*",
+				"Ubuntu*", "Windows*",
+			}, TopKeys: 10},
+			"node.docker":    versions,
+			"node.kubelet":   versions,
+			"node.kubeproxy": versions,
+
+			"app.rancheCatalogs":      catalogs,
+			"mca.rancheCatalogs":      catalogs,
+			"project.pipeline.source": {Allow: []string{"githubProvider", "gitlabProvider", "bitbucketCloudProvider", "bitbucketServerProvider"}},
+			"cluster.cloudProvider":   {Allow: []string{"aws", "azure", "gce", "openstack", "vsphere", "external"}},
+		},
+	}
+}
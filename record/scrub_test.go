@@ -0,0 +1,135 @@
+package record
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func scrubDefault(t *testing.T, salt string, r Record) Record {
+	t.Helper()
+	rules, err := LoadScrubRules("default", salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = rules.Scrub(r); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestScrubDefaultAllow(t *testing.T) {
+	r := scrubDefault(t, "salt", Record{
+		"install": map[string]interface{}{
+			"auth":  map[string]interface{}{"github": float64(1), "myCompanySSO": float64(1), "mySSO": float64(2)},
+			"users": map[string]interface{}{"local": float64(3), "acme_user": float64(4)},
+		},
+		"node": map[string]interface{}{
+			"os": map[string]interface{}{
+				"Ubuntu 18.04.4 LTS":     float64(2),
+				"RancherOS v1.5.6":       float64(1),
+				"acme-hardened-os 2.1.7": float64(1),
+			},
+		},
+		"cluster": map[string]interface{}{"cloudProvider": "aws"},
+	})
+
+	want := Record{
+		"install": map[string]interface{}{
+			"auth":  map[string]interface{}{"github": float64(1), ScrubOther: float64(3)},
+			"users": map[string]interface{}{"local": float64(3), ScrubOther: float64(4)},
+		},
+		"node": map[string]interface{}{
+			"os": map[string]interface{}{
+				"Ubuntu 18.04.4 LTS": float64(2),
+				"RancherOS v1.5.6":   float64(1),
+				ScrubOther:           float64(1),
+			},
+		},
+		"cluster": map[string]interface{}{"cloudProvider": "aws"},
+	}
+	if !reflect.DeepEqual(r, want) {
+		t.Errorf("got %v, want %v", r, want)
+	}
+}
+
+func TestScrubDefaultPattern(t *testing.T) {
+	r := scrubDefault(t, "salt", Record{
+		"node": map[string]interface{}{
+			"kubelet": map[string]interface{}{"v1.18.3-rancher1": float64(2), "v1.18.3": float64(1), "v1.17.9-rancher1-1": float64(1)},
+			"docker":  map[string]interface{}{"19.03.8": float64(1), "not a version": float64(1)},
+			"kernel":  map[string]interface{}{"4.15.0-101-generic": float64(1), "4.15.0-99-generic": float64(2), "5.4.0": float64(1)},
+		},
+	})
+
+	want := map[string]interface{}{
+		"kubelet": map[string]interface{}{"v1.18.3": float64(3), "v1.17.9": float64(1)},
+		"docker":  map[string]interface{}{"19.03.8": float64(1), "not a version": float64(1)},
+		"kernel":  map[string]interface{}{"4.15": float64(3), "5.4": float64(1)},
+	}
+	if !reflect.DeepEqual(r["node"], want) {
+		t.Errorf("got %v, want %v", r["node"], want)
+	}
+}
+
+func TestScrubDefaultHash(t *testing.T) {
+	catalogs := func() Record {
+		return Record{"app": map[string]interface{}{
+			"rancheCatalogs": map[string]interface{}{"library": float64(1), "acme-internal": float64(2)},
+		}}
+	}
+	hashed := func(r Record) string {
+		t.Helper()
+		m := r["app"].(map[string]interface{})["rancheCatalogs"].(map[string]interface{})
+		if m["library"] != float64(1) || len(m) != 2 {
+			t.Fatalf("Catalogs: got %v, want library kept and one hash", m)
+		}
+		for k := range m {
+			if k != "library" {
+				return k
+			}
+		}
+		return ""
+	}
+
+	a := hashed(scrubDefault(t, "salt", catalogs()))
+	if !regexp.MustCompile(`^` + ScrubHashPrefix + `[0-9a-f]{12}$`).MatchString(a) {
+		t.Errorf("Hash: got %q", a)
+	}
+	if b := hashed(scrubDefault(t, "salt", catalogs())); b != a {
+		t.Errorf("Same salt: got %q then %q", a, b)
+	}
+	if b := hashed(scrubDefault(t, "other salt", catalogs())); b == a {
+		t.Errorf("Different salts: both got %q", a)
+	}
+
+	// Scrubbing again leaves a hash as it is
+	r := scrubDefault(t, "salt", catalogs())
+	if b := hashed(scrubDefault(t, "salt", r)); b != a {
+		t.Errorf("Scrubbed twice: got %q, want %q", b, a)
+	}
+
+	if _, err := LoadScrubRules("default", ""); err == nil {
+		t.Error("Default rules without a salt: got no error")
+	}
+}
+
+func TestScrubTopKeys(t *testing.T) {
+	rules := &ScrubRules{Fields: map[string]*ScrubRule{"node.kernel": {TopKeys: 2}}}
+	if err := rules.Compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := Record{"node": map[string]interface{}{
+		"kernel": map[string]interface{}{"a": float64(5), "b": float64(3), "c": float64(3), "d": float64(1), ScrubOther: float64(1)},
+	}}
+	if err := rules.Scrub(r); err != nil {
+		t.Fatal(err)
+	}
+
+	// Ties go to the first name
+	want := map[string]interface{}{"a": float64(5), "b": float64(3), ScrubOther: float64(5)}
+	if got := r["node"].(map[string]interface{})["kernel"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
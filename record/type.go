@@ -1,3 +1,18 @@
 package record
 
+import (
+	"errors"
+	"time"
+)
+
 type Record map[string]interface{}
+
+// Time returns when the client collected the record, from the "ts" field
+func (r Record) Time() (time.Time, error) {
+	str, ok := r["ts"].(string)
+	if !ok || str == "" {
+		return time.Time{}, errors.New("Record ts is missing")
+	}
+
+	return time.Parse(time.RFC3339, str)
+}